@@ -0,0 +1,70 @@
+"""
+Memory allocated per chunk fetch with and without the buffer pool, measured
+with tracemalloc, and the time per fetch. Each fetch fills a chunk-sized
+buffer part by part the way a Range body arrives, then copies out the bytes
+the caches keep (BlockBuffer.getvalue), as fetch_chunk does. That copy is
+allocated either way; the pool saves the buffer itself and zeroing it.
+
+    python -m benchmarks.buffer_pool
+"""
+
+import time
+import tracemalloc
+
+from config.constants import DEFAULT_CHUNK_SIZE
+from shared.buffers import BufferPool
+
+PART = b"x" * (64 * 1024)
+FETCHES = 200
+
+
+def fetch(pool, chunk_size):
+    buffer = pool.get(chunk_size)
+    try:
+        for _ in range(chunk_size // len(PART)):
+            buffer.extend(PART)
+        return buffer.getvalue()
+    finally:
+        pool.put(buffer)
+
+
+def allocated_per_fetch(pool, chunk_size):
+    """
+    Mean peak of bytes allocated during a fetch, over FETCHES fetches.
+    """
+    fetch(pool, chunk_size)  # warm the pool
+    total = 0
+    tracemalloc.start()
+    try:
+        for _ in range(FETCHES):
+            tracemalloc.reset_peak()
+            before, _ = tracemalloc.get_traced_memory()
+            data = fetch(pool, chunk_size)
+            _, peak = tracemalloc.get_traced_memory()
+            del data
+            total += peak - before
+    finally:
+        tracemalloc.stop()
+    return total / FETCHES
+
+
+def seconds_per_fetch(pool, chunk_size):
+    started = time.perf_counter()
+    for _ in range(FETCHES):
+        fetch(pool, chunk_size)
+    return (time.perf_counter() - started) / FETCHES
+
+
+def main(chunk_size=DEFAULT_CHUNK_SIZE):
+    print(f"{FETCHES} fetches of {chunk_size // 1024} KiB chunks")
+    for name, pool in (("no pool", BufferPool(0)), ("pool", BufferPool(1))):
+        allocated = allocated_per_fetch(pool, chunk_size)
+        elapsed = seconds_per_fetch(pool, chunk_size)
+        print(
+            f"{name:>7}: {allocated / 1024:8.0f} KiB allocated per fetch, "
+            f"{elapsed * 1e3:.3f} ms per fetch"
+        )
+
+
+if __name__ == "__main__":
+    main()
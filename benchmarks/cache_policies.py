@@ -0,0 +1,57 @@
+"""
+Hit rates of the block cache's eviction policies on a skewed workload: a few
+hot files read over and over amid one-shot reads of many cold ones.
+
+    python -m benchmarks.cache_policies
+"""
+
+import random
+import time
+
+from shared.cache import BlockCache, cache_policies
+
+BLOCK = b"x" * 4096
+CACHE_BLOCKS = 64
+HOT_BLOCKS = 48
+ACCESSES = 200_000
+# Share of reads that go to the hot blocks; the rest are never read again
+HOT_SHARE = 0.5
+
+
+def workload(seed=0):
+    rng = random.Random(seed)
+    cold = HOT_BLOCKS
+    for _ in range(ACCESSES):
+        if rng.random() < HOT_SHARE:
+            yield (1, rng.randrange(HOT_BLOCKS))
+        else:
+            yield (2, cold)
+            cold += 1
+
+
+def run(policy):
+    cache = BlockCache(CACHE_BLOCKS * len(BLOCK), policy)
+    started = time.perf_counter()
+    for key in workload():
+        if cache.get(key) is None:
+            cache.put(key, BLOCK)
+    elapsed = time.perf_counter() - started
+    stats = cache.stats()
+    return stats["hits"] / (stats["hits"] + stats["misses"]), elapsed
+
+
+def main():
+    print(
+        f"{ACCESSES} reads, {HOT_SHARE:.0%} of them of {HOT_BLOCKS} hot blocks, "
+        f"into a cache of {CACHE_BLOCKS} blocks"
+    )
+    for policy in sorted(cache_policies):
+        hit_rate, elapsed = run(policy)
+        print(
+            f"{policy:>5}: hit rate {hit_rate:6.1%}, "
+            f"{elapsed / ACCESSES * 1e6:.2f} us per read"
+        )
+
+
+if __name__ == "__main__":
+    main()
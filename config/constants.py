@@ -1,12 +1,87 @@
+VERSION = "0.1.0"
+
 MAX_FH = (
     2**31 - 1
 )  # 32-bits ensures compat with libfuse and more than enough open handles
 
+# Default block size reported in attrs and statfs (see MountConfig.block_size)
+BLOCK_SIZE = 4096
+
+# Extended attribute holding a file's source URL
+URL_XATTR = b"user.httpfs.url"
+# Most recent error recorded for a file, and its HTTP status if it had one
+LAST_ERROR_XATTR = b"user.httpfs.last_error"
+LAST_STATUS_XATTR = b"user.httpfs.last_status"
+# Directory that permanent redirect targets are mapped under
+REDIRECTS_DIR = ".redirects"
+# Generated file in the root listing every mapped file and its status
+INDEX_FILE = ".httpfs-index"
+
 # Read cache configuration
 DEFAULT_CHUNK_SIZE = 1 * 1024 * 1024  # 1MB per chunk
+MIN_CHUNK_SIZE = 4 * 1024
 CACHE_MAX_SIZE = 200 * 1024 * 1024  # 200MB total
-NUM_CACHE_CHUNKS = CACHE_MAX_SIZE // DEFAULT_CHUNK_SIZE
 
-MAX_PREFETCH_AHEAD = 100 * 1024 * 1024  # e.g., 100MB ahead
+MAX_PREFETCH_AHEAD = 100 * 1024 * 1024  # default readahead window
 # How many chunks to fetch concurrently each batch.
 PREFETCH_BATCH_SIZE = 3
+# Largest body we'll buffer when a server can't serve ranges
+MAX_BUFFERED_BODY = 256 * 1024 * 1024  # 256MB
+# How long cached attributes and blocks are trusted before revalidating
+DEFAULT_REVALIDATE_TTL = 60  # seconds
+# How long the kernel may reuse attributes and lookups before asking us again
+DEFAULT_ATTR_TIMEOUT = 5  # seconds
+# How long a 404/403 for a file is remembered before asking again
+DEFAULT_NEGATIVE_TTL = 5  # seconds
+# How often origins are probed while waiting for the network at startup
+DEFAULT_NETWORK_RETRY_INTERVAL = 2  # seconds
+# How often cached blocks of files past their TTL are swept out of memory
+DEFAULT_SWEEP_INTERVAL = 300  # seconds
+# With relatime, how stale atime may get before a read advances it anyway
+RELATIME_INTERVAL = 24 * 60 * 60  # seconds
+# FUSE requests handled at once. Well above the chunk fetch concurrency so
+# cached reads and lookups aren't stuck behind reads waiting on the network.
+DEFAULT_FUSE_WORKERS = 32
+
+# HTTP client defaults
+DEFAULT_USER_AGENT = f"httpfs/{VERSION}"
+# Requests in flight to any one host at once, across all files
+DEFAULT_MAX_CONNS_PER_HOST = 8
+# Hosts whose connection pools are kept; requests' own default. Mounts
+# rarely talk to more origins than this, and each pool holds its sockets.
+DEFAULT_MAX_IDLE_HOSTS = 10
+# Raised to the chunk concurrency if lower, or urllib3 discards connections.
+# Twice FETCH_WORKERS so readahead and reads on other files can reuse too.
+DEFAULT_MAX_IDLE_CONNS_PER_HOST = 16
+# Long enough to survive pauses between reads of a file, short enough that
+# an idle mount doesn't hold sockets the origin will drop anyway
+DEFAULT_IDLE_CONN_TIMEOUT = 300  # seconds
+DEFAULT_MAX_REDIRECTS = 10
+DEFAULT_CONNECT_TIMEOUT = 10  # seconds
+DEFAULT_HEADER_TIMEOUT = 30  # seconds
+DEFAULT_REQUEST_TIMEOUT = 30  # seconds
+DEFAULT_STALL_TIMEOUT = 30  # seconds
+DEFAULT_MAX_ATTEMPTS = 3
+DEFAULT_RETRY_BACKOFF = 0.5  # seconds, doubled on each retry
+# Fraction of each backoff delay that is randomized (1 is full jitter)
+DEFAULT_RETRY_JITTER = 1.0
+# Retries saved up mount-wide and per host, and how many come back per second;
+# once spent, failures are returned without retrying until they refill
+DEFAULT_RETRY_BUDGET = 100
+DEFAULT_RETRY_BUDGET_RATE = 10  # per second
+DEFAULT_HOST_RETRY_BUDGET = 20
+DEFAULT_HOST_RETRY_BUDGET_RATE = 2  # per second
+# A host failing this many requests within the window is given up on for the
+# cool-down, so reads of its files fail fast instead of each retrying in turn
+DEFAULT_BREAKER_THRESHOLD = 5
+DEFAULT_BREAKER_WINDOW = 30  # seconds
+DEFAULT_BREAKER_COOLDOWN = 30  # seconds
+# Upper bounds of the request latency histogram buckets
+DEFAULT_LATENCY_BUCKETS = (0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+# How far an origin's Date header may be from our clock before we warn
+DEFAULT_MAX_CLOCK_SKEW = 60  # seconds
+# Worker threads used to fetch chunks of a single read concurrently.
+FETCH_WORKERS = 8
+
+# On-disk cache (disabled unless a directory is configured)
+DISK_CACHE_MAX_SIZE = 10 * 1024 * 1024 * 1024  # 10GB
@@ -0,0 +1,321 @@
+from dataclasses import dataclass, field
+from typing import Any
+
+from config.constants import (
+    BLOCK_SIZE,
+    DEFAULT_ATTR_TIMEOUT,
+    DEFAULT_CHUNK_SIZE,
+    DEFAULT_CONNECT_TIMEOUT,
+    DEFAULT_FUSE_WORKERS,
+    DEFAULT_HEADER_TIMEOUT,
+    DEFAULT_HOST_RETRY_BUDGET,
+    DEFAULT_HOST_RETRY_BUDGET_RATE,
+    DEFAULT_IDLE_CONN_TIMEOUT,
+    DEFAULT_LATENCY_BUCKETS,
+    DEFAULT_MAX_ATTEMPTS,
+    DEFAULT_MAX_CLOCK_SKEW,
+    DEFAULT_MAX_CONNS_PER_HOST,
+    DEFAULT_MAX_IDLE_CONNS_PER_HOST,
+    DEFAULT_MAX_IDLE_HOSTS,
+    DEFAULT_MAX_REDIRECTS,
+    DEFAULT_NEGATIVE_TTL,
+    DEFAULT_NETWORK_RETRY_INTERVAL,
+    DEFAULT_REQUEST_TIMEOUT,
+    DEFAULT_RETRY_BACKOFF,
+    DEFAULT_RETRY_BUDGET,
+    DEFAULT_RETRY_BUDGET_RATE,
+    DEFAULT_RETRY_JITTER,
+    DEFAULT_BREAKER_THRESHOLD,
+    DEFAULT_BREAKER_WINDOW,
+    DEFAULT_BREAKER_COOLDOWN,
+    DEFAULT_REVALIDATE_TTL,
+    DEFAULT_STALL_TIMEOUT,
+    DEFAULT_SWEEP_INTERVAL,
+    DEFAULT_USER_AGENT,
+    FETCH_WORKERS,
+    MAX_BUFFERED_BODY,
+    MAX_PREFETCH_AHEAD,
+    MIN_CHUNK_SIZE,
+    PREFETCH_BATCH_SIZE,
+)
+
+
+@dataclass
+class ClientConfig:
+    # Redirect hops followed before a request fails with EIO
+    max_redirects: int = DEFAULT_MAX_REDIRECTS
+    # Default auth (a requests auth tuple or AuthBase) for files without their own
+    auth: Any = None
+    # Seconds to establish a connection
+    connect_timeout: float = DEFAULT_CONNECT_TIMEOUT
+    # Seconds to wait for response headers
+    header_timeout: float = DEFAULT_HEADER_TIMEOUT
+    # Seconds a streamed body may go without a byte arriving before the read
+    # fails with EIO. However slowly bytes keep coming, only request_timeout
+    # ends the read (and downloads of whole files ignore that). 0 leaves
+    # bodies to header_timeout.
+    stall_timeout: float = DEFAULT_STALL_TIMEOUT
+    # Seconds for a whole request, redirects, retries and body included
+    request_timeout: float = DEFAULT_REQUEST_TIMEOUT
+    # Attempts per request on connection errors, 5xx and 429 (1 disables retries)
+    max_attempts: int = DEFAULT_MAX_ATTEMPTS
+    # Base delay for exponential backoff between attempts, in seconds
+    retry_backoff: float = DEFAULT_RETRY_BACKOFF
+    # Fraction of each backoff delay drawn at random, from 0 (fixed delays) to
+    # 1 (anywhere between zero and the full delay)
+    retry_jitter: float = DEFAULT_RETRY_JITTER
+    # Retries the whole mount, and each host, may make in a burst, refilled at
+    # the rate per second. Every retry spends one from both; with either
+    # empty, a failure is returned at once, so widespread failures don't turn
+    # into a retry storm against a struggling origin (0 is unlimited)
+    retry_budget: float = DEFAULT_RETRY_BUDGET
+    retry_budget_rate: float = DEFAULT_RETRY_BUDGET_RATE
+    host_retry_budget: float = DEFAULT_HOST_RETRY_BUDGET
+    host_retry_budget_rate: float = DEFAULT_HOST_RETRY_BUDGET_RATE
+    # Failed requests (connection errors, timeouts, 5xx) to one host within
+    # breaker_window seconds that open its circuit breaker (0 disables)
+    breaker_threshold: int = DEFAULT_BREAKER_THRESHOLD
+    breaker_window: float = DEFAULT_BREAKER_WINDOW
+    # Seconds an open breaker fails requests with EIO before letting one
+    # trial request through; its outcome closes or reopens the breaker
+    breaker_cooldown: float = DEFAULT_BREAKER_COOLDOWN
+    # Sent unless a file's own headers set User-Agent
+    user_agent: str = DEFAULT_USER_AGENT
+    # Headers sent with every request; a file's own headers override them
+    default_headers: dict[str, str] = field(default_factory=dict)
+    # Proxy URL for every request; None uses HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+    proxy: str | None = None
+    # CA bundle (file or directory) used instead of the system trust store
+    ca_bundle: str | None = None
+    # Client certificate for mutual TLS, and its key if not in the same file
+    client_cert: str | None = None
+    client_key: str | None = None
+    # Skip certificate verification entirely; for development only
+    insecure_skip_verify: bool = False
+    # Remember Set-Cookie responses and send them back to the same host on
+    # later requests, for every file. Off by default since state leaking
+    # between files can be surprising.
+    cookies: bool = False
+    # Negotiate HTTP/2 over TLS where the origin offers it (needs the h2
+    # package). Off by default: requests speaks HTTP/1.1, and some origins
+    # reset streams under many concurrent ranges.
+    http2: bool = False
+    # Body bytes per second across the whole mount (0 is unlimited); slow
+    # rates may need a longer request_timeout
+    rate_limit: int = 0
+    # Body bytes per second for each file on its own (0 is unlimited)
+    per_file_rate_limit: int = 0
+    # Seconds resolved host addresses are reused in-process (0 disables)
+    dns_cache_ttl: float = 0
+    # Seconds an origin's Date header may be off our clock before a warning
+    # is logged (0 disables); the measured skew is kept per host either way
+    max_clock_skew: float = DEFAULT_MAX_CLOCK_SKEW
+    # Count Expires from the origin's clock: its Date header, else our clock
+    # shifted by the skew last measured for its host. Off counts from our own
+    # clock, for origins whose Date is stale (e.g. replayed by a cache).
+    server_clock_freshness: bool = True
+    # Upper bounds in seconds of the per-host latency histogram buckets (time
+    # to first byte of every request, and whole chunk fetches)
+    latency_buckets: tuple[float, ...] = DEFAULT_LATENCY_BUCKETS
+    # Range requests in flight at once, shared by all reads and readahead
+    max_concurrent_chunks: int = FETCH_WORKERS
+    # Requests in flight to one host at once, shared by every file on it; the
+    # rest queue (0 is unlimited)
+    max_conns_per_host: int = DEFAULT_MAX_CONNS_PER_HOST
+    # Hosts whose pools are kept at once; idle connections are bounded by this
+    # times max_idle_conns_per_host (urllib3 has no single total cap)
+    max_idle_hosts: int = DEFAULT_MAX_IDLE_HOSTS
+    # Connections kept open per host in the shared pool
+    max_idle_conns_per_host: int = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+    # Seconds without requests before pooled connections are closed
+    idle_conn_timeout: float = DEFAULT_IDLE_CONN_TIMEOUT
+    # func(adapter) -> requests transport adapter, called once with our
+    # pooled HTTPAdapter to wrap or replace it (to sign requests, add
+    # tracing, ...). Every request and redirect hop goes through what it
+    # returns, after auth, default headers and User-Agent have been applied,
+    # so it sees the final headers. A replacement owns its connection pooling,
+    # leaving max_idle_hosts and max_idle_conns_per_host advisory;
+    # max_conns_per_host still limits requests in flight.
+    transport: Any = None
+    # Stat URLs ending in "/" with HEAD like any other. Off by default, since
+    # generated index documents often answer HEAD with 403 or without a
+    # Content-Length; a ranged GET is sent instead.
+    head_index_urls: bool = False
+
+
+def validate_mode(mode):
+    if not 0 <= mode <= 0o7777:
+        raise ValueError(f"mode {mode:o} has bits outside the permission bits")
+
+
+def validate_chunk_size(chunk_size):
+    if chunk_size < MIN_CHUNK_SIZE or chunk_size & (chunk_size - 1):
+        raise ValueError(
+            f"chunk size must be a power of two of at least {MIN_CHUNK_SIZE} bytes"
+        )
+
+
+@dataclass
+class CacheConfig:
+    # Bytes per Range request and cache block; offsets are aligned to it. Larger
+    # blocks mean fewer round trips but every cache miss downloads (and keeps in
+    # memory) a whole block, so small random reads waste more bandwidth and
+    # the same cache budget holds fewer distinct regions.
+    chunk_size: int = DEFAULT_CHUNK_SIZE
+    # Bytes read ahead in the background once a handle reads sequentially (0 disables)
+    readahead: int = MAX_PREFETCH_AHEAD
+    # Chunks each readahead batch requests concurrently
+    readahead_parallelism: int = PREFETCH_BATCH_SIZE
+    # Ask for the chunks of a readahead batch that aren't cached in a single
+    # multi-range request, parsing the multipart/byteranges reply. Servers
+    # answering with one range or the whole body get separate requests from
+    # then on. Helps sparse access where cached chunks split the batch.
+    multi_range_readahead: bool = False
+    # Download whole files in the background on first open and serve reads
+    # from the cache (best with a disk cache big enough to hold them)
+    download_on_open: bool = False
+    # Serve every read with its own Range request straight from the server,
+    # with no block cache, disk cache or readahead (files opened with
+    # O_DIRECT get this regardless). Memory stays at one read's worth and
+    # one-pass reads of huge files don't evict everything else, but every
+    # read is a round trip, rereads fetch again, small reads cost a request
+    # each and sha256 isn't checked.
+    uncached: bool = False
+    # How the in-memory block cache picks blocks to evict: "lru", "lfu" or
+    # "fifo" (or a name registered with register_cache_policy)
+    eviction_policy: str = "lru"
+    # Bytes a whole-body fetch may hold in memory. Past that it spills to the
+    # disk cache, or fails with EFBIG if there is none (or the file is no-store)
+    max_buffered_body: int = MAX_BUFFERED_BODY
+    # Chunk-sized fetch buffers kept for reuse instead of allocating one per
+    # Range request; one per concurrent chunk fetch is enough (0 disables)
+    buffer_pool_size: int = FETCH_WORKERS
+    # Largest file fetched whole when ranges don't work, or downloaded on open
+    # (0 is unlimited). Unlimited lets one huge URL fill the disk cache; ranged
+    # reads stream and ignore this.
+    max_file_size: int = 0
+    # Seconds a cached file is trusted when the origin sends no Cache-Control/Expires
+    revalidate_ttl: float = DEFAULT_REVALIDATE_TTL
+    # Seconds the kernel trusts attributes and lookups without asking us. 0
+    # makes every stat reach us; with revalidate_ttl 0 too, every one reaches
+    # the origin.
+    attr_timeout: float = DEFAULT_ATTR_TIMEOUT
+    # Seconds an ENOENT/EACCES for a file is reused without asking (0 disables)
+    negative_ttl: float = DEFAULT_NEGATIVE_TTL
+    # Seconds between sweeps that drop the in-memory blocks of files past their
+    # revalidate TTL, and expired negative entries (0 disables). Swept files
+    # are still revalidated on their next access.
+    sweep_interval: float = DEFAULT_SWEEP_INTERVAL
+
+    def __post_init__(self):
+        validate_chunk_size(self.chunk_size)
+
+
+@dataclass
+class MountConfig:
+    # List extensionless files under a name with an extension guessed from
+    # their Content-Type (e.g. report -> report.json); the bare name still works
+    content_type_extensions: bool = False
+    # When reads advance atime: "noatime" (never; atime reports mtime),
+    # "relatime" (once it's no newer than mtime or a day old) or "strict"
+    atime: str = "noatime"
+    # Show files whose URL permanently redirects (301/308) as symlinks to a
+    # file mapped to the target, instead of following the redirect silently
+    redirect_symlinks: bool = False
+    # Put each file under a directory named after its URL's host (with the
+    # port when it isn't the scheme's default), e.g. cdn.example.org/report
+    group_by_host: bool = False
+    # Name given to manifest entries without one whose URL ends in "/" (or is
+    # a bare host), where the last path segment can't name the file
+    index_name: str = "index.html"
+    # Keep the query string in names derived from URLs (report?v=2); by
+    # default it is dropped. Derived names are always percent-decoded, with
+    # "/" and control characters replaced by "_".
+    name_query: bool = False
+    # What happens when a name derived from a URL is already taken: "error"
+    # rejects the entry, "suffix" appends a short hash of the URL
+    # (report-1a2b3c4d.csv) so every URL gets its own name
+    name_collisions: str = "error"
+    # Allow manifest symlinks whose target is absolute or climbs out of the
+    # mount with "..", which then resolves against the host's filesystem
+    unsafe_symlinks: bool = False
+    # Owner reported for every file and directory (None is the mounting user)
+    uid: int | None = None
+    gid: int | None = None
+    # Permission bits of files and directories; the type bits are always ours
+    file_mode: int = 0o444
+    dir_mode: int = 0o755
+    # Let users other than the one mounting see the files. Anything the
+    # mount's credentials can fetch becomes readable to every local user, so
+    # pair it with default_permissions and a restrictive file/dir mode.
+    # Unless mounting as root it needs user_allow_other in /etc/fuse.conf.
+    allow_other: bool = False
+    # Have the kernel enforce the reported owner and mode bits; without it
+    # anyone who can reach the mount can read every file
+    default_permissions: bool = False
+    # Source and type shown by mount(8) and /proc/mounts (fuse.<subtype>)
+    fsname: str = "httpls"
+    subtype: str | None = None
+    # FUSE requests served concurrently. Reads, lookups and getattrs wait on
+    # the network in a thread each, so this is how many can be in flight;
+    # every busy read may hold a chunk-sized buffer on top of the caches, so
+    # peak memory grows by about workers * chunk_size.
+    workers: int = DEFAULT_FUSE_WORKERS
+    # Background requests (async reads, readahead) the kernel keeps
+    # outstanding to us; None keeps its default of 12. Set through
+    # /sys/fs/fuse/connections, which only root may write. Very high values
+    # let one busy reader queue more work than the workers can take on.
+    max_background: int | None = None
+    # Seconds to wait at startup for any origin (or the proxy) to accept a
+    # connection before mounting, for mounts started before the network is
+    # up (0 doesn't wait). Either way files are listed even while their
+    # origins are down; sizes that can't be learned are asked for again on
+    # the next stat.
+    wait_for_network: float = 0
+    # Seconds between connection attempts while waiting for the network
+    network_retry_interval: float = DEFAULT_NETWORK_RETRY_INTERVAL
+    # Let the kernel's page cache keep file contents across opens, and push
+    # blocks warmed by warm_cache into it (FUSE notify_store) so rereads of
+    # hot files never reach us. Pages are kept only while the file's ETag or
+    # Last-Modified is unchanged since the last open; files with neither are
+    # read afresh on each open. Uncached and stream-only files never use it.
+    kernel_cache: bool = False
+    # Give every path in the store an inode before mounting, directories and
+    # symlinks included, in sorted order, so the same manifest always gets
+    # the same numbers (a persisted inode map still wins). Otherwise only
+    # files get one up front and directories get theirs on first lookup.
+    # Files added later are numbered as they come either way.
+    eager_inodes: bool = False
+    # Block size reported as st_blksize and by statfs. Programs size their
+    # reads by it, so a larger one means fewer, bigger reads, which amortizes
+    # round trips to slow origins; 0 reports cache_config.chunk_size to keep
+    # reads aligned with cache blocks and readahead
+    block_size: int = BLOCK_SIZE
+
+    def __post_init__(self):
+        validate_mode(self.file_mode)
+        validate_mode(self.dir_mode)
+
+
+# Mount-wide configuration, adjusted at startup before mounting.
+client_config = ClientConfig()
+cache_config = CacheConfig()
+mount_config = MountConfig()
+
+
+def configure(**options):
+    """
+    Set fields of client_config, cache_config or mount_config by name, e.g.
+    configure(request_timeout=10, chunk_size=65536). Raises TypeError for
+    unknown names and ValueError for invalid chunk sizes or modes.
+    """
+    configs = (client_config, cache_config, mount_config)
+    for name, value in options.items():
+        config = next((c for c in configs if name in c.__dataclass_fields__), None)
+        if config is None:
+            raise TypeError(f"unknown option '{name}'")
+        if name == "chunk_size":
+            validate_chunk_size(value)
+        elif name in ("file_mode", "dir_mode"):
+            validate_mode(value)
+        setattr(config, name, value)
@@ -0,0 +1,145 @@
+import errno
+import os
+from types import SimpleNamespace
+from unittest import mock
+
+import pyfuse3
+import trio
+
+from main import HTTPFS
+from shared.cache import block_cache
+from shared.files import ROOT_INODE, clear_store
+from shared.requests import (
+    chunk_coverage,
+    full_fetch_urls,
+    host_breakers,
+    host_cooldowns,
+    mirror_index,
+    no_store_urls,
+    single_range_urls,
+    stream_only_urls,
+    verified_inodes,
+)
+
+
+def reset():
+    """
+    Empty the file store and forget what was learned about its URLs (caches,
+    range support, breakers), so each test starts afresh. Config changes are
+    the caller's to undo.
+    """
+    block_cache.invalidate_inodes(clear_store())
+    for state in (
+        chunk_coverage,
+        full_fetch_urls,
+        host_breakers,
+        host_cooldowns,
+        mirror_index,
+        no_store_urls,
+        single_range_urls,
+        stream_only_urls,
+        verified_inodes,
+    ):
+        state.clear()
+
+
+def request_context(uid=None, gid=None):
+    """
+    Stand-in for the pyfuse3.RequestContext the kernel would pass, as the
+    mounting user unless `uid` and `gid` say otherwise.
+    """
+    return SimpleNamespace(
+        uid=os.getuid() if uid is None else uid,
+        gid=os.getgid() if gid is None else gid,
+        pid=os.getpid(),
+        umask=0o022,
+    )
+
+
+class FileSystem:
+    """
+    The HTTPFS handlers called directly, by path, as the kernel would call
+    them but without a mount. Failures raise the handlers' pyfuse3.FUSEError;
+    its errno says what the caller would have seen.
+
+        fs = FileSystem()
+        assert fs.getattr("data.bin").st_size == 11
+        assert fs.read("data.bin", 6) == b"world"
+    """
+
+    def __init__(self, ctx=None):
+        self.ops = HTTPFS()
+        self.ctx = ctx or request_context()
+
+    def _run(self, handler, *args):
+        # Each call is its own trio run, and trio objects don't outlive theirs
+        self.ops._limiter = None
+        return trio.run(handler, *args)
+
+    def lookup(self, path):
+        """
+        Attributes of `path`, looked up one component at a time from the
+        root like a path walk.
+        """
+        attr = self._run(self.ops.getattr, ROOT_INODE, self.ctx)
+        for name in filter(None, path.split("/")):
+            attr = self._run(self.ops.lookup, attr.st_ino, name.encode(), self.ctx)
+        return attr
+
+    def inode(self, path):
+        return self.lookup(path).st_ino
+
+    def getattr(self, path):
+        return self._run(self.ops.getattr, self.inode(path), self.ctx)
+
+    def listdir(self, path=""):
+        """
+        (name, attributes) of each entry readdir returns for directory `path`,
+        in order, leaving out "." and "..".
+        """
+        entries = []
+
+        def reply(token, name, attr, next_id):
+            entries.append((os.fsdecode(name), attr))
+            return True
+
+        fh = self._run(self.ops.opendir, self.inode(path), self.ctx)
+        try:
+            with mock.patch.object(pyfuse3, "readdir_reply", reply):
+                self._run(self.ops.readdir, fh, 0, None)
+        finally:
+            self._run(self.ops.releasedir, fh)
+        return [entry for entry in entries if entry[0] not in (".", "..")]
+
+    def readlink(self, path):
+        return os.fsdecode(self._run(self.ops.readlink, self.inode(path), self.ctx))
+
+    def access(self, path, mode):
+        return self._run(self.ops.access, self.inode(path), mode, self.ctx)
+
+    def read(self, path, offset=0, size=None, flags=os.O_RDONLY):
+        """
+        Open `path`, read `size` bytes from `offset` (to the end by default)
+        and release it again.
+        """
+        info = self._run(self.ops.open, self.inode(path), flags, self.ctx)
+        try:
+            if size is not None:
+                return self._run(self.ops.read, info.fh, offset, size)
+            data = bytearray()
+            while True:
+                part = self._run(self.ops.read, info.fh, offset + len(data), 1 << 20)
+                if not part:
+                    return bytes(data)
+                data.extend(part)
+        finally:
+            self._run(self.ops.release, info.fh)
+
+    def exists(self, path):
+        try:
+            self.lookup(path)
+        except pyfuse3.FUSEError as e:
+            if e.errno == errno.ENOENT:
+                return False
+            raise
+        return True
@@ -0,0 +1,217 @@
+import hashlib
+import socket
+import sys
+import threading
+import time
+from email.utils import formatdate
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+
+class Origin:
+    """
+    In-memory HTTP origin on localhost for exercising the filesystem without
+    a real server. Serves the bodies added with `add` to HEAD and GET, with
+    single byte ranges, ETag and Last-Modified; multi-range requests, and
+    ranges whose If-Range no longer matches, get the whole body. It listens
+    on `host`, which may be an IPv6 literal ("::1"), and `port` (by default
+    any free one). Every request is
+    recorded in `requests` as (method, path, headers), and the client address
+    it came from in `peers`, so connection reuse shows up as a repeated port.
+
+        with Origin() as origin:
+            add_file("data.bin", origin.add("/data.bin", b"..."))
+    """
+
+    def __init__(self, host="127.0.0.1", port=0):
+        self._lock = threading.Lock()
+        # path -> (status, body, headers, ranges, pace)
+        self.files = {}
+        self.requests = []
+        self.peers = []
+        server_class = _Server6 if ":" in host else _Server
+        self.server = server_class((host, port), self._handler())
+        self._thread = None
+
+    def __enter__(self):
+        return self.start()
+
+    def __exit__(self, *exc):
+        self.close()
+
+    def start(self):
+        self._thread = threading.Thread(target=self.server.serve_forever, daemon=True)
+        self._thread.start()
+        return self
+
+    def close(self):
+        self.server.shutdown()
+        self.server.server_close()
+
+    def url(self, path):
+        host, port = self.server.server_address[:2]
+        if ":" in host:
+            host = f"[{host}]"
+        return f"http://{host}:{port}{path}"
+
+    def add(self, path, body=b"", status=200, headers=None, ranges=True, pace=0):
+        """
+        Serve `body` at `path` (answering with `status` instead if it isn't
+        200) with extra response `headers`, ignoring Range unless `ranges`.
+        A Content-Length among them is sent in place of the real one, to
+        stand in for an origin that lies about its length; the connection is
+        closed after a body that falls short of it. So is a Content-Range, on
+        every 206, for a proxy that answers with the wrong window. A `pace`
+        sends the body a KiB at a time, that many seconds apart, for a slow
+        origin. `body` may be a Zeros, for a file too large to hold. Returns
+        its URL.
+        """
+        if isinstance(body, Zeros):
+            etag = f"zeros-{len(body)}"
+        else:
+            body = bytes(body)
+            etag = hashlib.sha256(body).hexdigest()[:16]
+        headers = {
+            "Content-Type": "application/octet-stream",
+            "ETag": f'"{etag}"',
+            "Last-Modified": formatdate(time.time(), usegmt=True),
+            **(headers or {}),
+        }
+        with self._lock:
+            self.files[path] = (status, body, headers, ranges, pace)
+        return self.url(path)
+
+    def remove(self, path):
+        with self._lock:
+            self.files.pop(path, None)
+
+    def requests_for(self, path, method=None):
+        with self._lock:
+            return [
+                request
+                for request in self.requests
+                if request[1] == path and method in (None, request[0])
+            ]
+
+    def _lookup(self, method, path, headers, peer):
+        with self._lock:
+            self.requests.append((method, path, headers))
+            self.peers.append(peer)
+            return self.files.get(path)
+
+    def _handler(self):
+        origin = self
+
+        class Handler(BaseHTTPRequestHandler):
+            protocol_version = "HTTP/1.1"
+
+            def log_message(self, format, *args):
+                pass
+
+            def do_HEAD(self):
+                self._respond(send_body=False)
+
+            def do_GET(self):
+                self._respond(send_body=True)
+
+            def _respond(self, send_body):
+                found = origin._lookup(
+                    self.command, self.path, dict(self.headers), self.client_address
+                )
+                if found is None:
+                    return self._send(404, b"", {}, send_body)
+                status, body, headers, ranges, pace = found
+                if ranges:
+                    headers = {"Accept-Ranges": "bytes", **headers}
+                if status != 200:
+                    return self._send(status, b"", headers, send_body)
+                byte_range = parse_range(self.headers.get("Range"), len(body))
+                if_range = self.headers.get("If-Range")
+                if if_range is not None and if_range not in (
+                    headers["ETag"],
+                    headers["Last-Modified"],
+                ):
+                    byte_range = None
+                if byte_range is None or not ranges:
+                    return self._send(200, body, headers, send_body, pace)
+                if byte_range == "unsatisfiable":
+                    headers = {**headers, "Content-Range": f"bytes */{len(body)}"}
+                    return self._send(416, b"", headers, send_body)
+                start, end = byte_range
+                headers = {
+                    "Content-Range": f"bytes {start}-{end}/{len(body)}",
+                    **headers,
+                }
+                self._send(206, body[start : end + 1], headers, send_body, pace)
+
+            def _send(self, status, body, headers, send_body, pace=0):
+                self.send_response(status)
+                for name, value in headers.items():
+                    self.send_header(name, value)
+                if "Content-Length" not in headers:
+                    self.send_header("Content-Length", str(len(body)))
+                elif int(headers["Content-Length"]) > len(body):
+                    self.close_connection = True
+                self.end_headers()
+                if not send_body:
+                    return
+                if not pace:
+                    self.wfile.write(body)
+                    return
+                for start in range(0, len(body), 1024):
+                    self.wfile.write(body[start : start + 1024])
+                    self.wfile.flush()
+                    time.sleep(pace)
+
+        return Handler
+
+
+class Zeros:
+    """
+    A body of `size` zero bytes that is never held in memory, for files too
+    large to serve for real. Only ranges of it should be asked for.
+    """
+
+    def __init__(self, size):
+        self.size = size
+
+    def __len__(self):
+        return self.size
+
+    def __getitem__(self, key):
+        start, stop, _ = key.indices(self.size)
+        return bytes(max(0, stop - start))
+
+
+class _Server(ThreadingHTTPServer):
+    daemon_threads = True
+
+    def handle_error(self, request, client_address):
+        # Clients hang up mid-response on purpose, on a body over a cap say
+        if not isinstance(sys.exc_info()[1], ConnectionError):
+            super().handle_error(request, client_address)
+
+
+class _Server6(_Server):
+    address_family = socket.AF_INET6
+
+
+def parse_range(value, length):
+    """
+    (first, last) byte of a single-range Range header against a body of
+    `length` bytes, "unsatisfiable" if it lies past the end, or None if there
+    is no range we serve (absent, malformed or multi-range).
+    """
+    if not value or not value.startswith("bytes=") or "," in value:
+        return None
+    first, sep, last = value[len("bytes=") :].strip().partition("-")
+    if not sep or not (first.isdigit() or last.isdigit()):
+        return None
+    if not first:
+        # A suffix: the last `last` bytes
+        first, last = max(0, length - int(last)), length - 1
+    else:
+        first = int(first)
+        last = min(int(last), length - 1) if last.isdigit() else length - 1
+    if first >= length or first > last:
+        return "unsatisfiable"
+    return first, last
@@ -1,9 +1,13 @@
 #!/usr/bin/env python3
+import argparse
 import errno
 import json
 import logging
 import os
+import shlex
+import signal
 import socket
+import subprocess
 import sys
 import threading
 
@@ -13,69 +17,252 @@ import trio
 from pyfuse3 import FileHandleT, FileNameT, Operations, RequestContext
 
 from config.constants import (
-    DEFAULT_CHUNK_SIZE,
+    CACHE_MAX_SIZE,
+    DISK_CACHE_MAX_SIZE,
+    FETCH_WORKERS,
+    INDEX_FILE,
+    LAST_ERROR_XATTR,
+    LAST_STATUS_XATTR,
+    URL_XATTR,
 )
+from config.settings import (
+    cache_config,
+    client_config,
+    configure,
+    mount_config,
+    validate_chunk_size,
+    validate_mode,
+)
+from shared.buffers import buffer_pool
+from shared.cache import block_cache, cache_policies, disk_cache
+from shared.dns import dns_cache
+from shared.metrics import metrics
+from shared.requests import fuse_mounted
+from shared.stats import host_latency, stats
+from shared.throttle import retry_budget, throttle
 from shared.files import (
-    FILES_LOCK,
-    inode_map,
-    source_files,
+    add_file,
+    assign_inode,
+    file_redirects,
+    get_entry,
+    get_filename,
+    get_inode,
+    get_inode_count,
+    get_symlink,
+    get_url,
+    is_dir,
+    list_dir,
+    rename_file,
+    set_url_refresher,
+)
+from utils.fetch_utils import (
+    BodyStream,
+    FetchError,
+    FullFetchRequired,
+    cancel_prefetch,
+    buffer_limit,
+    fetch_chunk,
+    is_cacheable,
+    is_network_error,
+    is_stream_only,
+    make_auth,
+    mark_full_fetch,
+    maybe_prefetch,
+    needs_full_fetch,
+    read_chunks,
+    resume_requests,
+    shutdown_requests,
+    start_full_download,
 )
-from utils.fetch_utils import fetch_chunks_sync, maybe_prefetch
 from utils.file_utils import (
+    block_size,
+    check_files,
+    extension_alias,
+    get_dir_attr,
     get_file_attr,
+    get_index_attr,
+    get_known_total_size,
     get_root_attr,
     get_next_fh,
+    get_symlink_attr,
+    invalidate_file,
+    layout_name,
+    may_access,
+    placeholder_attr,
+    preassign_inodes,
+    url_filename,
+    keep_kernel_cache,
+    prefetch_attrs,
+    wait_for_network,
+    warm_cache,
+    warm_file,
+    fall_back_to_local,
+    is_serving_local,
+    read_local,
+    record_access,
+    release_fh,
+    render_index,
+    resolve_alias,
+    start_sweeper,
     FH_LOCK,
     open_handles,
 )
-from utils.logger import logger
+from utils.inode_utils import load_inode_map, save_inode_map
+from utils.logger import configure_logging, logger
+from utils.manifest_utils import RemoteManifest, load_manifest, manifest_parsers
+from utils.mount_utils import Server, check_mount_options, serve
+
 
-# This should not block execution
-debugpy.listen(("0.0.0.0", 5678))
-print("Debugpy is listening on port 5678; wait_for_client")
-# debugpy.wait_for_client()
+def fuse_error(err):
+    """
+    The FUSEError to raise for `err`, counted in the metrics.
+    """
+    metrics.fuse_error(err)
+    return pyfuse3.FUSEError(err)
 
 
-next_inode = 2  # starting inode (root is 1)
+# Open flags that would modify a file
+WRITE_FLAGS = os.O_WRONLY | os.O_RDWR | os.O_TRUNC | os.O_APPEND | os.O_CREAT
 
 
 class HTTPFS(Operations):
+    def __init__(self):
+        super().__init__()
+        # Created on first use, inside the trio run serving the mount
+        self._limiter = None
+        # Requests running in _in_thread, and whether drain() refuses more
+        self._running = 0
+        self._draining = False
+        self._idle = threading.Condition()
+
+    async def _in_thread(self, func, *args):
+        """
+        Run the blocking part of a handler on a worker thread so other
+        requests are served while it waits on the network, at most
+        mount_config.workers at once.
+        """
+        with self._idle:
+            if self._draining:
+                raise fuse_error(errno.ENOTCONN)
+            self._running += 1
+        try:
+            if self._limiter is None:
+                self._limiter = trio.CapacityLimiter(mount_config.workers)
+            return await trio.to_thread.run_sync(func, *args, limiter=self._limiter)
+        finally:
+            with self._idle:
+                self._running -= 1
+                self._idle.notify_all()
+
+    def drain(self, timeout=None):
+        """
+        Refuse new requests that would go to the network (ENOTCONN) and wait
+        up to `timeout` seconds for running ones to finish. Returns whether they
+        did; if not, requests are accepted again.
+        """
+        with self._idle:
+            self._draining = True
+            if self._idle.wait_for(lambda: self._running == 0, timeout):
+                return True
+            self._draining = False
+            return False
+
+    def invalidate(self, filename, refresh=False):
+        """
+        Drop `filename`'s cached attributes and blocks and have the kernel
+        forget its attributes, lookup and pages, so the next access fetches
+        it afresh. With `refresh` it is fetched again right away (and, with
+        kernel_cache, pushed to the kernel); returns the failure, if any, as
+        warm_file does. Must not be called from a request handler. Raises
+        FileNotFoundError if it isn't mapped.
+        """
+        inode = invalidate_file(filename)
+        if inode is None:
+            raise FileNotFoundError(filename)
+        if not fuse_mounted.is_set():
+            # No FUSE session to notify, and so nothing cached in the kernel
+            return warm_file(filename) if refresh else None
+        try:
+            pyfuse3.invalidate_inode(inode)
+        except OSError as e:
+            # ENOENT: the kernel has nothing cached for it
+            if e.errno != errno.ENOENT:
+                raise
+        parent, _, name = filename.rpartition("/")
+        parent_inode = get_inode(parent)
+        # A parent without an inode was never looked up, so has no entries
+        if parent_inode is not None:
+            pyfuse3.invalidate_entry_async(parent_inode, name.encode("utf-8"))
+        return warm_file(filename) if refresh else None
+
+    def _attr_for_path(self, path, op):
+        """
+        Attributes for a file or synthesized directory, as FUSE errors on failure.
+        """
+        if path == INDEX_FILE:
+            return get_index_attr()
+        if is_dir(path):
+            return get_dir_attr(path)
+        if get_symlink(path) is not None:
+            return get_symlink_attr(path)
+        try:
+            return get_file_attr(path)
+        except FileNotFoundError:
+            logger.error("%s: '%s' not found", op, path)
+            raise fuse_error(errno.ENOENT)
+        except FetchError as e:
+            logger.error("%s: '%s' failed: %s", op, path, e)
+            stats.error(path, e)
+            if is_network_error(e) or (e.status or 0) >= 500:
+                # An origin being down only fails reads; the file still
+                # stats, with a stand-in size, and the error is in its xattrs
+                return placeholder_attr(path)
+            raise fuse_error(e.errno)
+
     async def lookup(self, parent_inode, name, ctx):
-        if parent_inode != pyfuse3.ROOT_INODE:
-            logger.error("lookup: non-root parent inode %d", parent_inode)
-            raise pyfuse3.FUSEError(errno.ENOENT)
+        parent = get_filename(parent_inode)
         filename = name.decode("utf-8") if isinstance(name, bytes) else name
+        if parent is not None and filename == ".":
+            # How the kernel resolves an NFS file handle once the node has
+            # left its cache: "." of the handle's inode, whatever kind it is.
+            # It compares the generation itself.
+            return await self._in_thread(self._attr_for_path, parent, "lookup")
+        if parent is None or not is_dir(parent):
+            logger.error("lookup: parent inode %d is not a directory", parent_inode)
+            raise fuse_error(errno.ENOENT)
         # if filename[0] != ".":
         #     logger.debug("lookup: parent_inode=%d, name=%s", parent_inode, name)
-        with FILES_LOCK:
-            if filename not in source_files:
-                logging.error("lookup: '%s' not found", filename)
-                raise pyfuse3.FUSEError(errno.ENOENT)
-            inode = inode_map.get(filename)
-            if inode is None:
-                global next_inode
-                inode = next_inode
-                inode_map[filename] = inode
-                next_inode += 1
-                logger.debug("lookup: assigned new inode %d to '%s'", inode, filename)
-        return get_file_attr(filename)
+        if filename == "..":
+            path = parent.rpartition("/")[0]
+        else:
+            path = f"{parent}/{filename}" if parent else filename
+        known = get_url(path) is not None or get_symlink(path) is not None
+        if not known and not is_dir(path) and path != INDEX_FILE:
+            original = resolve_alias(path)
+            if original is None:
+                logger.debug("lookup: '%s' not found", path)
+                raise fuse_error(errno.ENOENT)
+            path = original
+        return await self._in_thread(self._attr_for_path, path, "lookup")
 
     async def getattr(self, inode, ctx):
         logger.debug("getattr: inode=%d", inode)
         if inode == pyfuse3.ROOT_INODE:
             return get_root_attr()
-        with FILES_LOCK:
-            filename = next((fn for fn, ino in inode_map.items() if ino == inode), None)
+        filename = get_filename(inode)
         if filename is None:
             logger.error("getattr: inode %d not found", inode)
-            raise pyfuse3.FUSEError(errno.ENOENT)
-        return get_file_attr(filename)
+            raise fuse_error(errno.ENOENT)
+        return await self._in_thread(self._attr_for_path, filename, "getattr")
 
     async def opendir(self, inode: int, ctx: RequestContext) -> FileHandleT:
         logger.debug("opendir: inode=%d", inode)
-        if inode != pyfuse3.ROOT_INODE:
-            logger.error("opendir: inode %d is not root", inode)
-            raise pyfuse3.FUSEError(errno.ENOTDIR)
+        path = get_filename(inode)
+        if path is None:
+            raise fuse_error(errno.ENOENT)
+        if not is_dir(path):
+            logger.error("opendir: inode %d is not a directory", inode)
+            raise fuse_error(errno.ENOTDIR)
         fh = get_next_fh(inode)
         return fh
 
@@ -83,78 +270,271 @@ class HTTPFS(Operations):
         self, fh: FileHandleT, start_id: int, token: pyfuse3.ReaddirToken
     ) -> None:
         logger.debug("readdir: fh=%d, start_id=%d", fh, start_id)
-        # if fh != pyfuse3.ROOT_INODE:
-        #     logger.error("readdir: file handle %d is not root", fh)
-        #     return
-
-        # Build directory entry list including '.' and '..'
-        entries = [
-            (FileNameT(b"."), get_root_attr()),
-            (FileNameT(b".."), get_root_attr()),
-        ]
-        with FILES_LOCK:
-            for filename in source_files.keys():
-                try:
-                    attr = get_file_attr(filename)
-                    entries.append((FileNameT(filename.encode("utf-8")), attr))
-                    logger.debug("readdir: adding entry '%s'", filename)
-                except FileNotFoundError:
-                    logger.error("readdir: file '%s' not found", filename)
-                    continue
+        with FH_LOCK:
+            handle_details = open_handles.get(fh)
+        if handle_details is None:
+            raise fuse_error(errno.EBADF)
+        inode = handle_details["inode"]
+        path = get_filename(inode)
+        if path is None:
+            raise fuse_error(errno.ENOENT)
+        parent = path.rpartition("/")[0]
+        prefix = f"{path}/" if path else ""
+
+        # Snapshot the listing when reading starts (or is rewound) so offsets
+        # handed to the kernel keep naming the same entries across calls.
+        with FH_LOCK:
+            listing = handle_details.get("listing")
+            if listing is None or start_id == 0:
+                files, dirs = list_dir(path)
+                listing = [(".", "dir", path), ("..", "dir", parent)]
+                if path == "":
+                    listing.append((INDEX_FILE, "index", INDEX_FILE))
+                listing += [(name, "dir", prefix + name) for name in dirs]
+                listing += [(name, "file", prefix + name) for name in files]
+                handle_details["listing"] = listing
 
-        # Use the pyfuse3.readdir_reply method to add each entry.
-        for idx, (name, attr) in enumerate(entries):
-            if idx < start_id:
-                continue
-            next_id = idx + 1
-            if not pyfuse3.readdir_reply(token, name, attr, next_id):
+        # Attributes are only fetched for the entries this call returns, and
+        # entries that fail are skipped without renumbering the rest.
+        for idx in range(start_id, len(listing)):
+            name, kind, entry_path = listing[idx]
+            if kind == "dir":
+                attr = get_dir_attr(entry_path)
+            elif kind == "index":
+                attr = get_index_attr()
+            elif get_symlink(entry_path) is not None:
+                attr = await self._in_thread(get_symlink_attr, entry_path)
+            else:
+                attr = await self._in_thread(self._readdir_file_attr, entry_path)
+                if attr is None:
+                    continue
+                alias = extension_alias(entry_path)
+                if alias is not None:
+                    name = alias[len(prefix) :]
+                logger.debug("readdir: adding entry '%s'", name)
+            if not pyfuse3.readdir_reply(
+                token, FileNameT(name.encode("utf-8")), attr, idx + 1
+            ):
                 break
 
+    def _readdir_file_attr(self, path):
+        """
+        Attributes for a file being listed, or None to leave it out.
+        """
+        try:
+            return get_file_attr(path)
+        except FileNotFoundError:
+            logger.error("readdir: file '%s' not found", path)
+            return None
+        except FetchError as e:
+            # Listed anyway; reading it is what reports the failure
+            logger.error("readdir: file '%s' failed: %s", path, e)
+            stats.error(path, e)
+            return placeholder_attr(path)
+
+    async def releasedir(self, fh: FileHandleT) -> None:
+        logger.debug("releasedir: fh=%d", fh)
+        release_fh(fh)
+
+    async def readlink(self, inode, ctx):
+        filename = get_filename(inode)
+        if filename is None:
+            raise fuse_error(errno.ENOENT)
+        await self._in_thread(self._attr_for_path, filename, "readlink")
+        link = file_redirects.get(filename) or get_symlink(filename)
+        if link is None:
+            raise fuse_error(errno.EINVAL)
+        return os.fsencode(link)
+
+    async def getxattr(self, inode, name, ctx):
+        path = get_filename(inode)
+        if path is None:
+            raise fuse_error(errno.ENOENT)
+        if is_dir(path):
+            raise fuse_error(errno.ENOTSUP)
+        url = get_url(path)
+        if url is None:
+            raise fuse_error(errno.ENODATA)
+        if name == URL_XATTR:
+            return url.encode("utf-8")
+        value = self._diagnostic_xattrs(path).get(name)
+        if value is None:
+            raise fuse_error(errno.ENODATA)
+        return value
+
+    async def listxattr(self, inode, ctx):
+        path = get_filename(inode)
+        if path is None:
+            raise fuse_error(errno.ENOENT)
+        if is_dir(path):
+            raise fuse_error(errno.ENOTSUP)
+        if get_url(path) is None:
+            return []
+        return [URL_XATTR, *self._diagnostic_xattrs(path)]
+
+    def _diagnostic_xattrs(self, path):
+        """
+        The error xattrs that have a value for `path`, from its stats.
+        """
+        file_stats = stats.get(path) or {}
+        values = {
+            LAST_ERROR_XATTR: file_stats.get("last_error"),
+            LAST_STATUS_XATTR: file_stats.get("last_status"),
+        }
+        return {
+            name: str(value).encode("utf-8")
+            for name, value in values.items()
+            if value is not None
+        }
+
+    async def statfs(self, ctx: RequestContext) -> pyfuse3.StatvfsData:
+        logger.debug("statfs")
+        stat_ = pyfuse3.StatvfsData()
+        # The same block size as stat reports
+        stat_.f_bsize = block_size()
+        stat_.f_frsize = block_size()
+        stat_.f_blocks = -(-get_known_total_size() // block_size())
+        # Read-only, so nothing is ever free
+        stat_.f_bfree = 0
+        stat_.f_bavail = 0
+        stat_.f_files = get_inode_count()
+        stat_.f_ffree = 0
+        stat_.f_favail = 0
+        stat_.f_namemax = 255
+        return stat_
+
+    async def access(self, inode, mode, ctx):
+        """
+        Checked against the mode and owner we report, as default_permissions
+        would; nothing is writable. Only the caller's primary group is known.
+        """
+        path = get_filename(inode)
+        if path is None:
+            raise fuse_error(errno.ENOENT)
+        if mode & os.W_OK:
+            raise fuse_error(errno.EROFS)
+        bits = mount_config.dir_mode if is_dir(path) else mount_config.file_mode
+        return may_access(bits, mode, ctx.uid, ctx.gid)
+
     async def open(
         self, inode: int, flags: int, ctx: RequestContext
     ) -> pyfuse3.FileInfo:
         logger.debug("open: inode=%d, flags=%d", inode, flags)
-        if flags & (os.O_WRONLY | os.O_RDWR):
+        if flags & WRITE_FLAGS:
             logger.error("open: write access denied for inode=%d", inode)
-            raise pyfuse3.FUSEError(errno.EACCES)
+            raise fuse_error(errno.EROFS)
+        filename = get_filename(inode)
+        if filename is None:
+            raise fuse_error(errno.ENOENT)
+        if is_dir(filename):
+            raise fuse_error(errno.EISDIR)
+        if filename == INDEX_FILE:
+            fh = get_next_fh(inode)
+            with FH_LOCK:
+                # Rendered once per open so every read sees the same contents
+                open_handles[fh]["content"] = render_index()
+            return pyfuse3.FileInfo(fh=fh, direct_io=True)
+        entry = get_entry(filename)
+        if entry is None:
+            raise fuse_error(errno.ENOENT)
+        uncached = not is_cacheable(entry) or bool(flags & os.O_DIRECT)
+        if cache_config.download_on_open and not uncached:
+            try:
+                attr = await self._in_thread(get_file_attr, filename)
+            except FetchError as e:
+                logger.error("open: '%s' failed: %s", filename, e)
+                raise fuse_error(e.errno)
+            start_full_download(inode, entry, attr.st_size)
 
+        kernel_cache = (
+            mount_config.kernel_cache
+            and not uncached
+            and not is_stream_only(entry["url"])
+        )
         fi = pyfuse3.FileInfo(
-            fh=get_next_fh(inode),
-            direct_io=True,  # take over responsibilty for caching, buffering, etc from kernel
+            fh=get_next_fh(inode, entry["url"]),
+            # Otherwise we take over responsibility for caching, buffering etc.
+            # from the kernel
+            direct_io=not kernel_cache,
+            keep_cache=kernel_cache and keep_kernel_cache(filename, inode),
         )
+        if uncached:
+            with FH_LOCK:
+                open_handles[fi.fh]["uncached"] = True
 
         return fi
 
     async def read(self, fh: FileHandleT, off: int, size: int) -> bytes:
+        return await self._in_thread(self._read, fh, off, size)
+
+    def _read(self, fh, off, size):
         logger.debug("read: fh=%d, off=%d, size=%d", fh, off, size)
         with FH_LOCK:
             handle_details = open_handles.get(fh)
             ino = handle_details.get("inode") if handle_details else None
             if not ino:
                 logger.error(f"no inode found for handle {fh}")
-                raise pyfuse3.FUSEError(errno.ENOENT)
-        with FILES_LOCK:
-            # TODO: refactor INODE_MAP to be inode -> filename
-            filename = next((fn for fn, _ino in inode_map.items() if _ino == fh), None)
-            if filename is None:
-                raise pyfuse3.FUSEError(errno.ENOENT)
-            url = source_files.get(filename)
-        if not url:
-            raise pyfuse3.FUSEError(errno.ENOENT)
-        attr = get_file_attr(filename)
-        total_size = attr.st_size
-        # Determine chunk boundaries covering the requested range.
-        start_offset = off - (off % DEFAULT_CHUNK_SIZE)
-        end_offset = off + size
-        # Offsets at which each chunk starts
-        offsets = list(range(start_offset, end_offset, DEFAULT_CHUNK_SIZE))
-        # If range() is empty, force at least one offset
-        if not offsets:
-            offsets = [start_offset]
-
-        # Fetch all needed chunks concurrently.
-        # fetch_chunks_sync expects a list of offsets.
-        chunks = fetch_chunks_sync(url, offsets, DEFAULT_CHUNK_SIZE, total_size)
+                raise fuse_error(errno.ENOENT)
+            # Checked and advanced together, before any data is fetched, so
+            # reads overlapping on one handle (concurrent pread, kernel async
+            # readahead) see the cursor a sequential predecessor will leave
+            sequential = handle_details["next_offset"] == off
+            handle_details["next_offset"] = off + size
+            cancel = handle_details["cancel"]
+            content = handle_details.get("content")
+            uncached = handle_details.get("uncached", False)
+        if content is not None:
+            return content[off : off + size]
+        filename = get_filename(ino)
+        if filename is None:
+            raise fuse_error(errno.ENOENT)
+        entry = get_entry(filename)
+        if not entry:
+            raise fuse_error(errno.ENOENT)
+        try:
+            attr = get_file_attr(filename)
+            if is_serving_local(filename):
+                return read_local(filename, entry, off, size)
+            if is_stream_only(entry["url"]):
+                # Size unknown (reported as 0); direct_io still sends reads
+                with FH_LOCK:
+                    stream = handle_details.setdefault(
+                        "stream", BodyStream(entry, buffer_limit())
+                    )
+                return stream.read(off, size, cancel)
+            total_size = attr.st_size
+            if off >= total_size:
+                return b""
+            # Don't ask for bytes past EOF
+            size = min(size, total_size - off)
+            if uncached:
+                result = self._read_uncached(handle_details, ino, entry, off, size)
+                record_access(ino, attr.st_mtime_ns)
+                stats.read(filename, len(result))
+                return result
+            # Determine chunk boundaries covering the requested range.
+            chunk_size = cache_config.chunk_size
+            start_offset = off - (off % chunk_size)
+            end_offset = off + size
+            # Offsets at which each chunk starts
+            offsets = list(range(start_offset, end_offset, chunk_size))
+            # If range() is empty, force at least one offset
+            if not offsets:
+                offsets = [start_offset]
+
+            # Serve cached chunks and fetch the missing ones concurrently.
+            try:
+                chunks = read_chunks(
+                    ino, entry, offsets, chunk_size, total_size, cancel
+                )
+            except FetchError as e:
+                if not fall_back_to_local(filename, entry, e):
+                    raise
+                return read_local(filename, entry, off, size)
+        except FetchError as e:
+            logger.error("read: '%s' failed: %s", filename, e)
+            stats.error(filename, e)
+            raise fuse_error(e.errno)
 
         # Assemble the requested data:
         data = bytearray()
@@ -168,12 +548,117 @@ class HTTPFS(Operations):
         # Trim data to exactly 'size' bytes.
         result = bytes(data[:size])
 
-        # Trigger prefetch for data beyond what was just read.
-        maybe_prefetch(url, off + size, total_size)
+        record_access(ino, attr.st_mtime_ns)
+        stats.read(filename, len(result))
+        # Read ahead only for sequential access; random reads would waste it.
+        if sequential:
+            maybe_prefetch(fh, ino, entry, off + size, total_size)
 
         logger.debug("read: returning %d bytes", len(result))
         return result
 
+    def _read_uncached(self, handle_details, ino, entry, off, size):
+        """
+        Read [off, off + size) straight from the server for an uncached
+        handle. Servers that ignore Range are read front to back through a
+        chunk-sized window instead.
+        """
+        cancel = handle_details["cancel"]
+        if not needs_full_fetch(entry["url"]):
+            try:
+                return fetch_chunk(ino, entry, off, size, cancel, uncached=True)
+            except FullFetchRequired as e:
+                mark_full_fetch(entry["url"], str(e))
+        with FH_LOCK:
+            stream = handle_details.setdefault(
+                "stream", BodyStream(entry, cache_config.chunk_size)
+            )
+        return stream.read(off, size, cancel)
+
+    # Everything below would modify the filesystem, which is read-only.
+    async def write(self, fh, off, buf):
+        raise fuse_error(errno.EROFS)
+
+    async def setattr(self, inode, attr, fields, fh, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def create(self, parent_inode, name, mode, flags, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def mknod(self, parent_inode, name, mode, rdev, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def mkdir(self, parent_inode, name, mode, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def unlink(self, parent_inode, name, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def rmdir(self, parent_inode, name, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def rename(
+        self, parent_inode_old, name_old, parent_inode_new, name_new, flags, ctx
+    ):
+        """
+        Rename a file's local name within its directory; the remote is untouched.
+        """
+        if parent_inode_old != parent_inode_new:
+            raise fuse_error(errno.EXDEV)
+        if flags & pyfuse3.RENAME_EXCHANGE:
+            raise fuse_error(errno.EINVAL)
+        parent = get_filename(parent_inode_old)
+        if parent is None:
+            raise fuse_error(errno.ENOENT)
+        prefix = f"{parent}/" if parent else ""
+        old = prefix + os.fsdecode(name_old)
+        new = prefix + os.fsdecode(name_new)
+        logger.debug("rename: '%s' -> '%s'", old, new)
+        if get_url(old) is None:
+            if is_dir(old):
+                # Directories only exist as prefixes of file names
+                raise fuse_error(errno.EPERM)
+            old = resolve_alias(old) or old
+        try:
+            rename_file(old, new)
+        except FileNotFoundError:
+            raise fuse_error(errno.ENOENT)
+        except FileExistsError:
+            raise fuse_error(errno.EEXIST)
+        except ValueError as e:
+            logger.error("rename: %s", e)
+            raise fuse_error(errno.EINVAL)
+        logger.info("Renamed '%s' to '%s'", old, new)
+
+    async def symlink(self, parent_inode, name, target, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def link(self, inode, new_parent_inode, new_name, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def setxattr(self, inode, name, value, ctx):
+        raise fuse_error(errno.EROFS)
+
+    async def removexattr(self, inode, name, ctx):
+        raise fuse_error(errno.EROFS)
+
+    # Nothing is ever written, so there is nothing to flush; succeed for apps
+    # that flush or fsync read-only descriptors defensively.
+    async def flush(self, fh: FileHandleT) -> None:
+        logger.debug("flush: fh=%d", fh)
+
+    async def fsync(self, fh: FileHandleT, datasync: bool) -> None:
+        logger.debug("fsync: fh=%d", fh)
+
+    async def fsyncdir(self, fh: FileHandleT, datasync: bool) -> None:
+        logger.debug("fsyncdir: fh=%d", fh)
+
+    async def release(self, fh: FileHandleT) -> None:
+        logger.debug("release: fh=%d", fh)
+        cancel_prefetch(fh)
+        if release_fh(fh) is None:
+            logger.warning("release: fh=%d was not open", fh)
+
 
 def listen_for_updates(port=9000):
     sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
@@ -184,19 +669,37 @@ def listen_for_updates(port=9000):
         conn, _ = sock.accept()
         logger.debug("Update server: connection accepted")
         data = conn.recv(1024).decode("utf-8")
-        logger.debug("Update server: received data: %s", data)
         try:
             update = json.loads(data)
-            filename = update.get("filename")
             url = update.get("url")
+            filename = update.get("filename")
+            derived = filename is None and isinstance(url, str)
+            if derived:
+                filename = url_filename(url)
+            # Don't log the payload itself; it may carry credentials
+            logger.debug("Update server: received update for '%s'", filename)
             if filename and url:
-                with FILES_LOCK:
-                    source_files[filename] = url
-                    if filename not in inode_map:
-                        global next_inode
-                        inode_map[filename] = next_inode
-                        next_inode += 1
-                logger.info("Added mapping: '%s' -> '%s'", filename, url)
+                filename = layout_name(filename, url)
+                basic_auth = update.get("basic_auth")
+                auth = make_auth(
+                    bearer_token=update.get("bearer_token"),
+                    basic_auth=tuple(basic_auth) if basic_auth else None,
+                )
+                filename = add_file(
+                    filename,
+                    url,
+                    auth=auth,
+                    headers=update.get("headers"),
+                    mirrors=update.get("mirrors"),
+                    local_path=update.get("local_path"),
+                    sha256=update.get("sha256"),
+                    cacheable=update.get("cacheable"),
+                    compressible=update.get("compressible", False),
+                    content_type=update.get("content_type"),
+                    unique=derived and mount_config.name_collisions == "suffix",
+                )
+                assign_inode(filename)
+                logger.info("Added mapping: '%s' -> '%s'", filename, get_url(filename))
                 conn.send(b"OK")
             else:
                 logger.error("Update server: invalid data received")
@@ -208,14 +711,47 @@ def listen_for_updates(port=9000):
         logger.debug("Update server: connection closed")
 
 
-async def main(mountpoint):
-    fs = HTTPFS()
+def refresh_command(command):
+    """
+    A URL refresher that runs `command` with the filename as its last argument
+    and takes the fresh URL from its stdout.
+    """
+
+    def refresh(filename):
+        result = subprocess.run(
+            [*shlex.split(command), filename],
+            capture_output=True,
+            text=True,
+            timeout=client_config.request_timeout,
+            check=True,
+        )
+        return result.stdout.strip()
+
+    return refresh
+
+
+def configure_retry_budget():
+    retry_budget.configure(
+        client_config.retry_budget,
+        client_config.retry_budget_rate,
+        client_config.host_retry_budget,
+        client_config.host_retry_budget_rate,
+    )
+
+
+def fuse_options():
     fuse_opts = set(pyfuse3.default_options)
-    # fuse_opts.add(
-    #     "allow_other"
-    # )  # Allow all users (not just the mounter) to access the FS.
-    fuse_opts.add("ro")  # Mount as read-only.
-    fuse_opts.add("fsname=httpls")  # Set a custom filesystem name ("httpls").
+    if mount_config.allow_other:
+        # Allow all users (not just the mounter) to access the FS.
+        fuse_opts.add("allow_other")
+    if mount_config.default_permissions:
+        # Have the kernel check the owner and mode bits we report.
+        fuse_opts.add("default_permissions")
+    # Not mounted "ro": that would stop renames reaching us. Every handler that
+    # would change file contents answers EROFS instead.
+    fuse_opts.add(f"fsname={mount_config.fsname}")  # Filesystem name shown by mount(8).
+    if mount_config.subtype:
+        fuse_opts.add(f"subtype={mount_config.subtype}")
     # fuse_opts.add("max_read=65536")  # Limit each read request to 64KB.
     fuse_opts.add(
         "auto_unmount"
@@ -223,37 +759,720 @@ async def main(mountpoint):
     fuse_opts.add(
         "nodiratime"
     )  # Do not update directory access times (reduces overhead).
+    return fuse_opts
 
-    pyfuse3.init(fs, mountpoint, fuse_opts)
-    logger.info("FUSE filesystem mounted on '%s'", mountpoint)
-    try:
-        await pyfuse3.main()
-    finally:
-        logger.info("Unmounting filesystem")
-        pyfuse3.close()
+
+async def main(mountpoint):
+    # Unmounts cleanly on SIGINT/SIGTERM
+    await serve(HTTPFS(), mountpoint, fuse_options(), on_shutdown=shutdown_requests)
+
+
+def mount(
+    mountpoint,
+    log_level=None,
+    log_dir=None,
+    cache_size=None,
+    disk_cache_dir=None,
+    disk_cache_size=DISK_CACHE_MAX_SIZE,
+    **options,
+):
+    """
+    Mount the file store at `mountpoint` from a background thread and return
+    its Server (wait() / shutdown() / unmount()). Files can be added with add_file and
+    removed with remove_file while it's mounted, and once the Server is
+    unmounted mount can be called again. `options` set config fields
+    by name (timeouts, auth, chunk_size, readahead, ...; see configure).
+    `cache_size` and `disk_cache_size` are in bytes, and `log_level` turns on
+    logging to stderr (and `log_dir`).
+    """
+    if log_level is not None:
+        configure_logging(log_level, log_dir)
+    configure(**options)
+    check_mount_options()
+    resume_requests()
+    if cache_size is not None:
+        block_cache.resize(cache_size)
+    block_cache.set_policy(cache_config.eviction_policy)
+    if disk_cache_dir:
+        disk_cache.configure(disk_cache_dir, cache_config.chunk_size, disk_cache_size)
+    if client_config.dns_cache_ttl > 0:
+        dns_cache.install(client_config.dns_cache_ttl)
+    throttle.configure(client_config.rate_limit, client_config.per_file_rate_limit)
+    configure_retry_budget()
+    buffer_pool.configure(cache_config.buffer_pool_size)
+    host_latency.configure(client_config.latency_buckets)
+    preassign_inodes()
+    start_sweeper()
+    if mount_config.wait_for_network > 0:
+        wait_for_network(
+            mount_config.wait_for_network, mount_config.network_retry_interval
+        )
+    return Server(
+        HTTPFS(), mountpoint, fuse_options(), on_shutdown=shutdown_requests
+    ).start()
 
 
 if __name__ == "__main__":
-    if len(sys.argv) != 2:
-        print(f"Usage: {sys.argv[0]} <mountpoint>")
-        sys.exit(1)
-    mountpoint = sys.argv[1]
-
-    # Pre-populate the inode map.
-    with FILES_LOCK:
-        for filename in list(source_files.keys()):
-            if filename not in inode_map:
-                inode_map[filename] = next_inode
-                next_inode += 1
+    # This should not block execution
+    debugpy.listen(("0.0.0.0", 5678))
+    print("Debugpy is listening on port 5678; wait_for_client")
+    # debugpy.wait_for_client()
 
-    threading.Thread(target=listen_for_updates, daemon=True).start()
+    parser = argparse.ArgumentParser(description="Mount HTTP URLs as read-only files")
+    parser.add_argument("mountpoint")
+    parser.add_argument(
+        "--log-level",
+        default="INFO",
+        choices=["DEBUG", "INFO", "WARNING", "ERROR"],
+        help="least severe level logged",
+    )
+    parser.add_argument(
+        "--log-dir",
+        default="logs",
+        help="directory for log files (empty to log to stderr only)",
+    )
+    parser.add_argument(
+        "--metrics-port",
+        type=int,
+        default=0,
+        help="serve Prometheus metrics on localhost:PORT/metrics "
+        "(needs prometheus-client)",
+    )
+    parser.add_argument(
+        "--latency-buckets",
+        default=",".join(str(bound) for bound in client_config.latency_buckets),
+        help="comma-separated upper bounds in seconds of the latency histograms",
+    )
+    parser.add_argument(
+        "--manifest",
+        help="JSON list of {name, url, headers} entries; re-read on SIGHUP",
+    )
+    parser.add_argument(
+        "--manifest-url",
+        metavar="URL",
+        help="fetch the file list from URL, adding and removing files as it changes",
+    )
+    parser.add_argument(
+        "--manifest-format",
+        choices=sorted(manifest_parsers),
+        default="json",
+        help="format of --manifest-url (json: entries or bare names)",
+    )
+    parser.add_argument(
+        "--manifest-interval",
+        type=float,
+        default=300,
+        help="seconds between --manifest-url refreshes (0 fetches it once)",
+    )
+    parser.add_argument(
+        "--refresh-command",
+        metavar="CMD",
+        help="run CMD <filename> to get a fresh URL when one expires or gets 403",
+    )
+    parser.add_argument(
+        "--wait-for-network",
+        type=float,
+        default=mount_config.wait_for_network,
+        metavar="SECONDS",
+        help="wait up to SECONDS for an origin to accept connections before "
+        "mounting (0 doesn't wait)",
+    )
+    parser.add_argument(
+        "--network-retry-interval",
+        type=float,
+        default=mount_config.network_retry_interval,
+        help="seconds between connection attempts while waiting for the network",
+    )
+    parser.add_argument(
+        "--check",
+        action="store_true",
+        help="HEAD every URL before mounting and abort if any fails",
+    )
+    parser.add_argument(
+        "--content-type-extensions",
+        action="store_true",
+        help="list extensionless files with an extension guessed from Content-Type",
+    )
+    parser.add_argument(
+        "--atime",
+        choices=("noatime", "relatime", "strict"),
+        default="noatime",
+        help="when reads advance atime (default: noatime, atime reports mtime)",
+    )
+    parser.add_argument("--uid", type=int, help="owner of every file (default: you)")
+    parser.add_argument("--gid", type=int, help="group of every file (default: yours)")
+    parser.add_argument(
+        "--file-mode",
+        type=lambda value: int(value, 8),
+        default=mount_config.file_mode,
+        help="permission bits of files, in octal (default 444)",
+    )
+    parser.add_argument(
+        "--dir-mode",
+        type=lambda value: int(value, 8),
+        default=mount_config.dir_mode,
+        help="permission bits of directories, in octal (default 755)",
+    )
+    parser.add_argument(
+        "--allow-other",
+        action="store_true",
+        help="let other users access the mount (needs user_allow_other in "
+        "/etc/fuse.conf)",
+    )
+    parser.add_argument(
+        "--default-permissions",
+        action="store_true",
+        help="have the kernel enforce the reported owner and mode bits",
+    )
+    parser.add_argument(
+        "--fsname",
+        default=mount_config.fsname,
+        help=f"filesystem name shown by mount (default {mount_config.fsname})",
+    )
+    parser.add_argument("--subtype", help="filesystem subtype shown as fuse.SUBTYPE")
+    parser.add_argument(
+        "--workers",
+        type=int,
+        default=mount_config.workers,
+        help="FUSE requests served concurrently (each busy read may buffer a chunk)",
+    )
+    parser.add_argument(
+        "--max-background",
+        type=int,
+        help="background requests the kernel may queue to us (needs root; "
+        "kernel default 12)",
+    )
+    parser.add_argument(
+        "--index-name",
+        default=mount_config.index_name,
+        help="name for manifest entries without one whose URL ends in /",
+    )
+    parser.add_argument(
+        "--name-query",
+        action="store_true",
+        help="keep query strings in names derived from URLs",
+    )
+    parser.add_argument(
+        "--name-collisions",
+        choices=("error", "suffix"),
+        default=mount_config.name_collisions,
+        help="when a name derived from a URL is taken: reject it, or append "
+        "a short hash of the URL",
+    )
+    parser.add_argument(
+        "--unsafe-symlinks",
+        action="store_true",
+        help="allow manifest symlinks pointing outside the mount",
+    )
+    parser.add_argument(
+        "--head-index-urls",
+        action="store_true",
+        help="stat URLs ending in / with HEAD instead of a ranged GET",
+    )
+    parser.add_argument(
+        "--group-by-host",
+        action="store_true",
+        help="put each file under a directory named after its URL's host",
+    )
+    parser.add_argument(
+        "--kernel-cache",
+        action="store_true",
+        help="let the kernel page cache keep unchanged files across opens and "
+        "push warmed files into it",
+    )
+    parser.add_argument(
+        "--block-size",
+        type=int,
+        default=mount_config.block_size,
+        help="block size in bytes stat and statfs report; larger ones get "
+        "bigger reads (0 reports the chunk size)",
+    )
+    parser.add_argument(
+        "--eager-inodes",
+        action="store_true",
+        help="number every file and directory at mount in sorted order, the "
+        "same for the same manifest",
+    )
+    parser.add_argument(
+        "--redirect-symlinks",
+        action="store_true",
+        help="show files whose URL permanently redirects as symlinks to the target",
+    )
+    parser.add_argument(
+        "--prefetch-sizes",
+        type=int,
+        nargs="?",
+        const=FETCH_WORKERS,
+        default=0,
+        metavar="WORKERS",
+        help="HEAD every file at mount to learn its size, WORKERS at a time "
+        f"(default {FETCH_WORKERS})",
+    )
+    parser.add_argument(
+        "--warm",
+        action="append",
+        default=[],
+        metavar="NAME",
+        help="download NAME into the cache after mounting (repeatable)",
+    )
+    parser.add_argument(
+        "--inode-map",
+        metavar="FILE",
+        help="keep inode numbers stable across restarts by saving them to FILE",
+    )
+    parser.add_argument(
+        "--cache-size",
+        type=int,
+        default=CACHE_MAX_SIZE // (1024 * 1024),
+        help="in-memory block cache budget in MiB",
+    )
+    parser.add_argument(
+        "--cache-policy",
+        choices=sorted(cache_policies),
+        default=cache_config.eviction_policy,
+        help="how the in-memory block cache chooses blocks to evict",
+    )
+    parser.add_argument(
+        "--chunk-size",
+        type=int,
+        default=cache_config.chunk_size // 1024,
+        help="Range request and cache block size in KiB (power of two, at least 4)",
+    )
+    parser.add_argument(
+        "--disk-cache", metavar="DIR", help="persist downloaded chunks under DIR"
+    )
+    parser.add_argument(
+        "--disk-cache-size",
+        type=int,
+        default=DISK_CACHE_MAX_SIZE // (1024 * 1024),
+        help="disk cache budget in MiB",
+    )
+    parser.add_argument(
+        "--header",
+        action="append",
+        default=[],
+        metavar="NAME:VALUE",
+        help="header sent with every request unless a file sets its own (repeatable)",
+    )
+    parser.add_argument(
+        "--user-agent",
+        default=client_config.user_agent,
+        help="User-Agent for files whose headers don't set one",
+    )
+    parser.add_argument(
+        "--readahead",
+        type=int,
+        default=cache_config.readahead // (1024 * 1024),
+        help="readahead window for sequential reads in MiB (0 disables)",
+    )
+    parser.add_argument(
+        "--parallel-chunks",
+        type=int,
+        default=client_config.max_concurrent_chunks,
+        help="most Range requests in flight at once across all reads",
+    )
+    parser.add_argument(
+        "--read-only-cache",
+        action="store_true",
+        help="download each file whole in the background on first open",
+    )
+    parser.add_argument(
+        "--uncached",
+        action="store_true",
+        help="fetch every read straight from the server, bypassing the caches "
+        "and readahead (as files opened with O_DIRECT always are)",
+    )
+    parser.add_argument(
+        "--max-file-size",
+        type=int,
+        default=0,
+        help="largest file in MiB fetched whole or downloaded on open (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--max-buffered-body",
+        type=int,
+        default=cache_config.max_buffered_body // (1024 * 1024),
+        help="MiB of a whole-body fetch held in memory; more spills to the disk "
+        "cache, or fails with EFBIG without one",
+    )
+    parser.add_argument(
+        "--buffer-pool",
+        type=int,
+        default=cache_config.buffer_pool_size,
+        help="chunk buffers kept for reuse across fetches (0 disables)",
+    )
+    parser.add_argument(
+        "--readahead-parallelism",
+        type=int,
+        default=cache_config.readahead_parallelism,
+        help="chunks each readahead batch fetches concurrently",
+    )
+    parser.add_argument(
+        "--multi-range",
+        action="store_true",
+        help="fetch the uncached chunks of each readahead batch in one "
+        "multi-range request where the server supports it",
+    )
+    parser.add_argument(
+        "--timeout",
+        type=float,
+        default=client_config.request_timeout,
+        help="overall per-request timeout in seconds",
+    )
+    parser.add_argument(
+        "--stall-timeout",
+        type=float,
+        default=client_config.stall_timeout,
+        help="seconds a download may go without receiving a byte before it fails",
+    )
+    parser.add_argument(
+        "--retry-jitter",
+        type=float,
+        default=client_config.retry_jitter,
+        help="fraction of each retry delay that is randomized, 0 to 1",
+    )
+    parser.add_argument(
+        "--retry-budget",
+        type=float,
+        default=client_config.retry_budget,
+        help="retries the whole mount may make in a burst (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--retry-budget-rate",
+        type=float,
+        default=client_config.retry_budget_rate,
+        help="retries per second added back to --retry-budget",
+    )
+    parser.add_argument(
+        "--host-retry-budget",
+        type=float,
+        default=client_config.host_retry_budget,
+        help="retries each host may get in a burst (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--host-retry-budget-rate",
+        type=float,
+        default=client_config.host_retry_budget_rate,
+        help="retries per second added back to --host-retry-budget",
+    )
+    parser.add_argument(
+        "--breaker-threshold",
+        type=int,
+        default=client_config.breaker_threshold,
+        help="failed requests to a host within --breaker-window that make its "
+        "files fail fast (0 disables)",
+    )
+    parser.add_argument(
+        "--breaker-window",
+        type=float,
+        default=client_config.breaker_window,
+        help="seconds over which a host's failures are counted",
+    )
+    parser.add_argument(
+        "--breaker-cooldown",
+        type=float,
+        default=client_config.breaker_cooldown,
+        help="seconds a failing host is skipped before a trial request",
+    )
+    parser.add_argument(
+        "--max-conns-per-host",
+        type=int,
+        default=client_config.max_conns_per_host,
+        help="requests in flight to one host at once, across files (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--max-idle-hosts",
+        type=int,
+        default=client_config.max_idle_hosts,
+        help="hosts whose idle connections are kept pooled",
+    )
+    parser.add_argument(
+        "--max-idle-conns-per-host",
+        type=int,
+        default=client_config.max_idle_conns_per_host,
+        help="idle connections kept per host",
+    )
+    parser.add_argument(
+        "--idle-conn-timeout",
+        type=float,
+        default=client_config.idle_conn_timeout,
+        help="seconds without requests before pooled connections are closed",
+    )
+    parser.add_argument(
+        "--sweep-interval",
+        type=float,
+        default=cache_config.sweep_interval,
+        help="seconds between sweeps of stale blocks out of memory (0 disables)",
+    )
+    parser.add_argument(
+        "--negative-ttl",
+        type=float,
+        default=cache_config.negative_ttl,
+        help="seconds a 404/403 for a file is remembered (0 disables)",
+    )
+    parser.add_argument(
+        "--rate-limit",
+        type=int,
+        default=0,
+        help="download bandwidth cap for the whole mount in KiB/s (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--per-file-rate-limit",
+        type=int,
+        default=0,
+        help="download bandwidth cap per file in KiB/s (0 is unlimited)",
+    )
+    parser.add_argument(
+        "--max-clock-skew",
+        type=float,
+        default=client_config.max_clock_skew,
+        help="seconds an origin's Date may be off our clock before warning "
+        "(0 disables)",
+    )
+    parser.add_argument(
+        "--local-clock-freshness",
+        action="store_true",
+        help="count Expires from our clock instead of the origin's Date",
+    )
+    parser.add_argument(
+        "--dns-cache-ttl",
+        type=float,
+        default=client_config.dns_cache_ttl,
+        help="seconds to cache DNS lookups in-process (0 disables)",
+    )
+    parser.add_argument(
+        "--proxy",
+        help="proxy URL for all requests (default: HTTP_PROXY/HTTPS_PROXY/NO_PROXY)",
+    )
+    parser.add_argument("--ca-bundle", help="CA bundle to verify servers against")
+    parser.add_argument("--client-cert", help="client certificate for mutual TLS")
+    parser.add_argument(
+        "--client-key", help="key for --client-cert if it's in a separate file"
+    )
+    parser.add_argument(
+        "--insecure",
+        action="store_true",
+        help="skip TLS certificate verification (development only)",
+    )
+    parser.add_argument(
+        "--cookies",
+        action="store_true",
+        help="remember cookies origins set and send them back on later requests",
+    )
+    parser.add_argument(
+        "--http2",
+        action="store_true",
+        help="negotiate HTTP/2 with origins that offer it (needs the h2 package)",
+    )
+    parser.add_argument(
+        "--revalidate-ttl",
+        type=float,
+        default=cache_config.revalidate_ttl,
+        help="default seconds before cached files are revalidated "
+        "(Cache-Control and Expires win)",
+    )
+    parser.add_argument(
+        "--attr-timeout",
+        type=float,
+        default=cache_config.attr_timeout,
+        help="seconds the kernel caches attributes and lookups (0 asks us every time)",
+    )
+    args = parser.parse_args()
+    configure_logging(getattr(logging, args.log_level), args.log_dir)
+    mount_config.content_type_extensions = args.content_type_extensions
+    mount_config.atime = args.atime
+    mount_config.redirect_symlinks = args.redirect_symlinks
+    mount_config.kernel_cache = args.kernel_cache
+    mount_config.eager_inodes = args.eager_inodes
+    mount_config.block_size = args.block_size
+    mount_config.wait_for_network = args.wait_for_network
+    mount_config.network_retry_interval = max(0.1, args.network_retry_interval)
+    mount_config.group_by_host = args.group_by_host
+    mount_config.index_name = args.index_name
+    mount_config.name_query = args.name_query
+    mount_config.name_collisions = args.name_collisions
+    mount_config.unsafe_symlinks = args.unsafe_symlinks
+    client_config.head_index_urls = args.head_index_urls
+    try:
+        validate_mode(args.file_mode)
+        validate_mode(args.dir_mode)
+    except ValueError as e:
+        parser.error(str(e))
+    mount_config.allow_other = args.allow_other
+    mount_config.default_permissions = args.default_permissions
+    mount_config.fsname = args.fsname
+    mount_config.subtype = args.subtype
+    mount_config.workers = max(1, args.workers)
+    if args.max_background is not None and args.max_background < 1:
+        parser.error("--max-background must be positive")
+    mount_config.max_background = args.max_background
+    try:
+        check_mount_options()
+    except ValueError as e:
+        parser.error(str(e))
+    mount_config.uid = args.uid
+    mount_config.gid = args.gid
+    mount_config.file_mode = args.file_mode
+    mount_config.dir_mode = args.dir_mode
+    try:
+        client_config.latency_buckets = tuple(
+            float(bound) for bound in args.latency_buckets.split(",")
+        )
+    except ValueError:
+        parser.error("--latency-buckets must be comma-separated seconds")
+    host_latency.configure(client_config.latency_buckets)
+    if args.metrics_port:
+        try:
+            metrics.enable(latency_buckets=client_config.latency_buckets)
+        except ImportError:
+            parser.error("--metrics-port needs the prometheus-client package")
+        metrics.serve(args.metrics_port)
+    mountpoint = args.mountpoint
+    client_config.request_timeout = args.timeout
+    client_config.stall_timeout = args.stall_timeout
+    client_config.max_conns_per_host = max(0, args.max_conns_per_host)
+    client_config.max_idle_hosts = max(1, args.max_idle_hosts)
+    client_config.max_idle_conns_per_host = max(1, args.max_idle_conns_per_host)
+    if args.idle_conn_timeout <= 0:
+        parser.error("--idle-conn-timeout must be positive")
+    client_config.idle_conn_timeout = args.idle_conn_timeout
+    if not 0 <= args.retry_jitter <= 1:
+        parser.error("--retry-jitter must be between 0 and 1")
+    client_config.retry_jitter = args.retry_jitter
+    client_config.retry_budget = max(0, args.retry_budget)
+    client_config.retry_budget_rate = max(0, args.retry_budget_rate)
+    client_config.host_retry_budget = max(0, args.host_retry_budget)
+    client_config.host_retry_budget_rate = max(0, args.host_retry_budget_rate)
+    configure_retry_budget()
+    client_config.breaker_threshold = max(0, args.breaker_threshold)
+    client_config.breaker_window = args.breaker_window
+    client_config.breaker_cooldown = args.breaker_cooldown
+    client_config.user_agent = args.user_agent
+    for header in args.header:
+        name, sep, value = header.partition(":")
+        if not sep or not name.strip():
+            parser.error(f"--header expects NAME:VALUE, got {header!r}")
+        client_config.default_headers[name.strip()] = value.strip()
+    client_config.proxy = args.proxy
+    client_config.dns_cache_ttl = args.dns_cache_ttl
+    client_config.max_clock_skew = args.max_clock_skew
+    client_config.server_clock_freshness = not args.local_clock_freshness
+    if client_config.dns_cache_ttl > 0:
+        dns_cache.install(client_config.dns_cache_ttl)
+    client_config.rate_limit = args.rate_limit * 1024
+    client_config.per_file_rate_limit = args.per_file_rate_limit * 1024
+    throttle.configure(client_config.rate_limit, client_config.per_file_rate_limit)
+    client_config.ca_bundle = args.ca_bundle
+    client_config.client_cert = args.client_cert
+    client_config.client_key = args.client_key
+    client_config.insecure_skip_verify = args.insecure
+    client_config.http2 = args.http2
+    client_config.cookies = args.cookies
+    cache_config.readahead = args.readahead * 1024 * 1024
+    cache_config.readahead_parallelism = max(1, args.readahead_parallelism)
+    cache_config.multi_range_readahead = args.multi_range
+    cache_config.buffer_pool_size = max(0, args.buffer_pool)
+    buffer_pool.configure(cache_config.buffer_pool_size)
+    cache_config.download_on_open = args.read_only_cache
+    cache_config.uncached = args.uncached
+    cache_config.max_file_size = args.max_file_size * 1024 * 1024
+    cache_config.max_buffered_body = max(1, args.max_buffered_body) * 1024 * 1024
+    client_config.max_concurrent_chunks = max(1, args.parallel_chunks)
+    cache_config.revalidate_ttl = args.revalidate_ttl
+    cache_config.attr_timeout = max(0.0, args.attr_timeout)
+    cache_config.negative_ttl = args.negative_ttl
+    cache_config.sweep_interval = args.sweep_interval
+    try:
+        validate_chunk_size(args.chunk_size * 1024)
+    except ValueError as e:
+        parser.error(str(e))
+    cache_config.chunk_size = args.chunk_size * 1024
+    block_cache.resize(args.cache_size * 1024 * 1024)
+    cache_config.eviction_policy = args.cache_policy
+    block_cache.set_policy(cache_config.eviction_policy)
+    if args.disk_cache:
+        disk_cache.configure(
+            args.disk_cache, cache_config.chunk_size, args.disk_cache_size * 1024 * 1024
+        )
 
-    # Allow clean exit with Ctrl+C.
-    def sigint_handler(signum, frame):
-        logger.info("SIGINT received, exiting...")
-        pyfuse3.close()
-        sys.exit(0)
+    if args.refresh_command:
+        set_url_refresher(refresh_command(args.refresh_command))
 
-    # signal.signal(signal.SIGINT, sigint_handler)
+    # Mount-wide default credentials, e.g. HTTPFS_BASIC_AUTH=user:password
+    basic_auth = os.environ.get("HTTPFS_BASIC_AUTH")
+    client_config.auth = make_auth(
+        bearer_token=os.environ.get("HTTPFS_BEARER_TOKEN"),
+        basic_auth=tuple(basic_auth.split(":", 1)) if basic_auth else None,
+    )
+
+    if args.manifest:
+        try:
+            load_manifest(args.manifest)
+        except (OSError, ValueError) as e:
+            sys.exit(f"Invalid manifest: {e}")
+
+        def reload_manifest():
+            try:
+                load_manifest(args.manifest)
+            except (OSError, ValueError) as e:
+                logger.error("Manifest reload failed: %s", e)
+
+        # Re-read off the signal handler so the FUSE loop isn't stalled.
+        signal.signal(
+            signal.SIGHUP,
+            lambda signum, frame: threading.Thread(
+                target=reload_manifest, daemon=True
+            ).start(),
+        )
+
+    if mount_config.wait_for_network > 0:
+        wait_for_network(
+            mount_config.wait_for_network,
+            mount_config.network_retry_interval,
+            [args.manifest_url] if args.manifest_url else [],
+        )
+
+    if args.manifest_url:
+        remote_manifest = RemoteManifest(args.manifest_url, args.manifest_format)
+        try:
+            remote_manifest.sync()
+        except (FetchError, ValueError) as e:
+            sys.exit(f"Invalid manifest at {args.manifest_url}: {e}")
+        if args.manifest_interval > 0:
+            threading.Thread(
+                target=remote_manifest.watch,
+                args=(args.manifest_interval,),
+                daemon=True,
+            ).start()
+
+    if args.check:
+        failures = check_files()
+        for filename, failure in sorted(failures.items()):
+            logger.error("check: '%s': %s", filename, failure)
+        if failures:
+            sys.exit(1)
+
+    if args.inode_map:
+        try:
+            load_inode_map(args.inode_map)
+        except (OSError, ValueError) as e:
+            logger.error("Ignoring unreadable inode map: %s", e)
+
+    preassign_inodes()
+
+    threading.Thread(target=listen_for_updates, daemon=True).start()
+    start_sweeper()
+    if args.prefetch_sizes > 0:
+        # In the background so mounting isn't held up; listings made before it
+        # finishes just HEAD what isn't cached yet.
+        threading.Thread(
+            target=prefetch_attrs, args=(args.prefetch_sizes,), daemon=True
+        ).start()
+
+    if args.warm:
+        threading.Thread(target=warm_cache, args=(args.warm,), daemon=True).start()
 
     trio.run(main, mountpoint)
+
+    if args.inode_map:
+        save_inode_map(args.inode_map)
@@ -0,0 +1,70 @@
+import threading
+
+
+class BlockBuffer:
+    """
+    Fixed-capacity bytearray filled front to back, for range bodies whose
+    length is known up front. Bytes past the capacity are counted but not
+    kept, so len() still shows that a server sent too much.
+    """
+
+    def __init__(self, capacity):
+        self.data = bytearray(capacity)
+        self._view = memoryview(self.data)
+        self._length = 0
+
+    def __len__(self):
+        return self._length
+
+    def extend(self, part):
+        start = min(self._length, len(self.data))
+        end = min(start + len(part), len(self.data))
+        self._view[start:end] = part[: end - start]
+        self._length += len(part)
+
+    def getvalue(self):
+        """
+        Copy of the bytes received, safe to keep after the buffer is reused.
+        """
+        return bytes(self._view[: min(self._length, len(self.data))])
+
+    def reset(self):
+        self._length = 0
+
+
+class BufferPool:
+    """
+    Free BlockBuffers kept for reuse, so each chunk fetch doesn't allocate
+    (and page in) a fresh block-sized buffer. Holds at most `limit` buffers
+    per capacity; 0 disables pooling.
+    """
+
+    def __init__(self, limit=0):
+        self._lock = threading.Lock()
+        self.limit = limit
+        self._free = {}
+
+    def configure(self, limit):
+        with self._lock:
+            self.limit = limit
+            self._free = {}
+
+    def get(self, capacity):
+        with self._lock:
+            free = self._free.get(capacity)
+            if free:
+                return free.pop()
+        return BlockBuffer(capacity)
+
+    def put(self, buffer):
+        """
+        Return `buffer` once nothing refers to its contents any more.
+        """
+        buffer.reset()
+        with self._lock:
+            free = self._free.setdefault(len(buffer.data), [])
+            if len(free) < self.limit:
+                free.append(buffer)
+
+
+buffer_pool = BufferPool()
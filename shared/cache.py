@@ -0,0 +1,309 @@
+import hashlib
+import math
+import os
+import threading
+
+import cachetools
+
+from config.constants import CACHE_MAX_SIZE, DISK_CACHE_MAX_SIZE
+
+
+class EvictionPolicy:
+    """
+    Decides which block the block cache drops when it's over budget. The cache
+    calls admit(key) when it stores a block, touch(key) when one is read and
+    evict() for the key of the block to drop next; discard(key) forgets a
+    block dropped for another reason (invalidated or replaced).
+    """
+
+    def admit(self, key):
+        raise NotImplementedError
+
+    def touch(self, key):
+        raise NotImplementedError
+
+    def evict(self):
+        raise NotImplementedError
+
+    def discard(self, key):
+        raise NotImplementedError
+
+
+class CachetoolsPolicy(EvictionPolicy):
+    """
+    An EvictionPolicy that lets a cachetools cache class keep the order: every
+    key is an entry of size 1 in an unbounded `cache_class`, so its popitem()
+    names the key to evict.
+    """
+
+    def __init__(self, cache_class):
+        self._keys = cache_class(maxsize=math.inf)
+
+    def admit(self, key):
+        self._keys[key] = None
+
+    def touch(self, key):
+        # A lookup is what counts as a use to LRU and LFU
+        self._keys.get(key)
+
+    def evict(self):
+        key, _ = self._keys.popitem()
+        return key
+
+    def discard(self, key):
+        self._keys.pop(key, None)
+
+
+# Eviction policies the block cache can use: name -> callable returning a new
+# EvictionPolicy. LFU suits a few hot files read repeatedly among one-shot
+# reads, which under LRU push the hot blocks out; FIFO ignores reuse entirely.
+cache_policies = {
+    "lru": lambda: CachetoolsPolicy(cachetools.LRUCache),
+    "lfu": lambda: CachetoolsPolicy(cachetools.LFUCache),
+    "fifo": lambda: CachetoolsPolicy(cachetools.FIFOCache),
+}
+
+
+def register_cache_policy(name, factory):
+    """
+    Make block cache policy `name` available; `factory()` returns a new
+    EvictionPolicy for each cache that uses it.
+    """
+    cache_policies[name] = factory
+
+
+class BlockCache:
+    """
+    Byte-budgeted cache of file chunks keyed by (inode, block index), evicting
+    by one of cache_policies (LRU unless configured otherwise).
+    """
+
+    def __init__(self, max_bytes, policy="lru"):
+        self._lock = threading.Lock()
+        self.policy = policy
+        self.max_bytes = max_bytes
+        self._evictor = cache_policies[policy]()
+        self._blocks = {}
+        self._bytes = 0
+        self.hits = 0
+        self.misses = 0
+
+    def get(self, key):
+        with self._lock:
+            data = self._blocks.get(key)
+            if data is None:
+                self.misses += 1
+            else:
+                self.hits += 1
+                self._evictor.touch(key)
+            return data
+
+    def put(self, key, data):
+        with self._lock:
+            # A block larger than the whole budget would evict everything
+            if len(data) > self.max_bytes:
+                return
+            self._drop(key)
+            self._evict_to(self.max_bytes - len(data))
+            self._blocks[key] = data
+            self._bytes += len(data)
+            self._evictor.admit(key)
+
+    def _drop(self, key):
+        data = self._blocks.pop(key, None)
+        if data is not None:
+            self._bytes -= len(data)
+            self._evictor.discard(key)
+
+    def _evict_to(self, max_bytes):
+        while self._bytes > max_bytes:
+            self._bytes -= len(self._blocks.pop(self._evictor.evict()))
+
+    def __contains__(self, key):
+        with self._lock:
+            return key in self._blocks
+
+    def resize(self, max_bytes):
+        """
+        Change the memory budget, keeping as many cached blocks as still fit.
+        """
+        with self._lock:
+            self.max_bytes = max_bytes
+            self._evict_to(max_bytes)
+
+    def set_policy(self, policy):
+        """
+        Switch to eviction policy `policy`, keeping the cached blocks. Raises
+        ValueError for names not in cache_policies.
+        """
+        if policy not in cache_policies:
+            raise ValueError(f"unknown cache policy '{policy}'")
+        with self._lock:
+            self._evictor = cache_policies[policy]()
+            # Oldest first, as they were stored
+            for key in self._blocks:
+                self._evictor.admit(key)
+            self.policy = policy
+
+    def invalidate(self, inode):
+        """
+        Drop every cached block of `inode`.
+        """
+        with self._lock:
+            for key in [key for key in self._blocks if key[0] == inode]:
+                self._drop(key)
+
+    def invalidate_inodes(self, inodes):
+        """
+        Drop every cached block of the inodes in the set `inodes`, in one pass
+        over the cache. Returns the number of blocks dropped.
+        """
+        with self._lock:
+            keys = [key for key in self._blocks if key[0] in inodes]
+            for key in keys:
+                self._drop(key)
+        return len(keys)
+
+    def stats(self):
+        with self._lock:
+            return {
+                "hits": self.hits,
+                "misses": self.misses,
+                "policy": self.policy,
+                "bytes": self._bytes,
+                "blocks": len(self._blocks),
+            }
+
+
+class DiskCache:
+    """
+    Chunks persisted as one file per (URL hash, offset) under a cache directory,
+    so a warm cache survives remounts. Least recently used files are deleted once
+    the directory grows past its byte budget. Does nothing until configured.
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self.path = None
+        self.max_bytes = DISK_CACHE_MAX_SIZE
+        self.chunk_size = None
+        self._total_bytes = 0
+
+    def configure(self, path, chunk_size, max_bytes=DISK_CACHE_MAX_SIZE):
+        os.makedirs(path, exist_ok=True)
+        with self._lock:
+            self.path = path
+            self.chunk_size = chunk_size
+            self.max_bytes = max_bytes
+            self._total_bytes = 0
+            for entry in os.scandir(path):
+                if not entry.is_file():
+                    continue
+                if entry.name.endswith(".tmp"):
+                    # Left by a write cut short by a crash; eviction skips them
+                    try:
+                        os.remove(entry.path)
+                    except FileNotFoundError:
+                        pass
+                    continue
+                self._total_bytes += entry.stat().st_size
+        self._evict()
+
+    @property
+    def enabled(self):
+        return self.path is not None
+
+    def _digest(self, url):
+        return hashlib.sha256(url.encode("utf-8")).hexdigest()[:32]
+
+    def _file_for(self, url, offset):
+        # The chunk size is part of the name so a restart with a different
+        # one never serves blocks of the wrong length
+        return os.path.join(
+            self.path, f"{self._digest(url)}_{self.chunk_size}_{offset}"
+        )
+
+    def get(self, url, offset):
+        if not self.enabled:
+            return None
+        path = self._file_for(url, offset)
+        try:
+            with open(path, "rb") as f:
+                data = f.read()
+            os.utime(path)  # mark as recently used for eviction
+            return data
+        except FileNotFoundError:
+            return None
+
+    def __contains__(self, key):
+        url, offset = key
+        return self.enabled and os.path.exists(self._file_for(url, offset))
+
+    def put(self, url, offset, data):
+        if not self.enabled or len(data) > self.max_bytes:
+            return
+        path = self._file_for(url, offset)
+        tmp_path = f"{path}.{threading.get_ident()}.tmp"
+        try:
+            with open(tmp_path, "wb") as f:
+                f.write(data)
+        except OSError:
+            # Out of space, say: don't leave a partial file on every attempt
+            try:
+                os.remove(tmp_path)
+            except FileNotFoundError:
+                pass
+            raise
+        with self._lock:
+            try:
+                self._total_bytes -= os.path.getsize(path)
+            except FileNotFoundError:
+                pass
+            os.replace(tmp_path, path)
+            self._total_bytes += len(data)
+        self._evict()
+
+    def invalidate(self, url):
+        """
+        Delete every persisted chunk of `url`.
+        """
+        if not self.enabled:
+            return
+        prefix = f"{self._digest(url)}_"
+        with self._lock:
+            for entry in os.scandir(self.path):
+                if not entry.name.startswith(prefix) or entry.name.endswith(".tmp"):
+                    continue
+                try:
+                    size = entry.stat().st_size
+                    os.remove(entry.path)
+                except FileNotFoundError:
+                    continue
+                self._total_bytes -= size
+
+    def _evict(self):
+        with self._lock:
+            if self._total_bytes <= self.max_bytes:
+                return
+            # Skip in-flight writes; they are accounted for once renamed
+            entries = sorted(
+                (
+                    e
+                    for e in os.scandir(self.path)
+                    if e.is_file() and not e.name.endswith(".tmp")
+                ),
+                key=lambda e: e.stat().st_mtime,
+            )
+            for entry in entries:
+                if self._total_bytes <= self.max_bytes:
+                    break
+                try:
+                    size = entry.stat().st_size
+                    os.remove(entry.path)
+                except FileNotFoundError:
+                    continue
+                self._total_bytes -= size
+
+
+block_cache = BlockCache(CACHE_MAX_SIZE)
+disk_cache = DiskCache()
@@ -0,0 +1,55 @@
+import socket
+import threading
+import time
+
+import urllib3.util.connection
+
+
+class DNSCache:
+    """
+    In-process cache of getaddrinfo results, so readahead opening new
+    connections to the same host doesn't wait on the resolver each time.
+    Addresses of a host are forgotten as soon as connecting to it fails, so a
+    dead IP is re-resolved on the next attempt. Does nothing until installed.
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._entries = {}
+        self.ttl = 0
+        self._getaddrinfo = socket.getaddrinfo
+        self._create_connection = urllib3.util.connection.create_connection
+
+    def install(self, ttl):
+        self.ttl = ttl
+        socket.getaddrinfo = self.getaddrinfo
+        # requests connects through urllib3, whose failures tell us which
+        # host's cached addresses went stale
+        urllib3.util.connection.create_connection = self.create_connection
+
+    def getaddrinfo(self, host, port, *args, **kwargs):
+        key = (host, port, args, tuple(sorted(kwargs.items())))
+        now = time.monotonic()
+        with self._lock:
+            cached = self._entries.get(key)
+        if cached is not None and cached[0] > now:
+            return cached[1]
+        result = self._getaddrinfo(host, port, *args, **kwargs)
+        with self._lock:
+            self._entries[key] = (now + self.ttl, result)
+        return result
+
+    def invalidate(self, host):
+        with self._lock:
+            for key in [key for key in self._entries if key[0] == host]:
+                del self._entries[key]
+
+    def create_connection(self, address, *args, **kwargs):
+        try:
+            return self._create_connection(address, *args, **kwargs)
+        except OSError:
+            self.invalidate(address[0])
+            raise
+
+
+dns_cache = DNSCache()
@@ -1,27 +1,561 @@
-import json
+import hashlib
+import posixpath
+import re
 import threading
+from urllib.parse import unquote, urlparse, urlunparse
 
-import cachetools
+from config.constants import INDEX_FILE
+from shared.stats import stats
 
-from config.constants import NUM_CACHE_CHUNKS
 
-
-source_json = json.load(open("tests/fixtures/pub_sources.json"))
-# Global mapping of local filenames to HTTP URLs.
+# Global mapping of local filenames to entries:
+# {"name": ..., "url": ..., "mirrors": [url, *fallbacks], "auth": ...,
+#  "credentials": {url: (user, password)}, "headers": ..., "signer": ...,
+#  "local_path": ..., "sha256": ..., "cacheable": ..., "compressible": ...}
+# URLs are kept without userinfo; "credentials" holds what was embedded.
+# Filenames may contain slashes; the directories along the way are synthesized.
 source_files = {}
-for source_file in source_json["categories"][0]["videos"]:
-    source_url: str = source_file["sources"][0]
-    filename = source_url.split("/")[-1]
-    print(f"{filename} : {source_url}")
-
-    source_files[filename] = source_url
 
 FILES_LOCK = threading.Lock()
 file_attributes_cache = {}
+# filename -> {"etag", "last_modified", "checked_at", "ttl"} for cached attributes
+file_freshness = {}
+# filename -> Content-Type the server last reported
+file_content_types = {}
+# filename -> lowercased request headers its responses vary on (Vary)
+file_vary = {}
+# filename -> (errno, expires_at) for files the server recently refused or lacked
+negative_cache = {}
+# filename -> when to try the remote again for files being served from their
+# local copy because the network is unreachable
+local_fallbacks = {}
+
+# filename -> symlink target, for files shown as links to their permanent
+# redirect's target
+file_redirects = {}
+
+# filename -> target of symlinks declared outright (not backed by a URL)
+symlinks = {}
+
+# func(filename) -> fresh URL, called when a file's URL has expired
+url_refresher = {"func": None}
+REFRESH_LOCK = threading.Lock()
+
+inode_map = {}  # filename or synthesized directory path -> inode
+# The reverse of inode_map, so nodes resolve by inode without a scan, as NFS
+# file handles (inode and generation) need after the kernel drops its cache
+inode_names = {}
+# inode -> generation, bumped whenever an inode number is handed out again so
+# (inode, generation) never names two different files. Inode numbers are never
+# recycled: a removed and re-added file gets a new one. Only a number whose
+# generation was carried over by restore_inodes starts past 0.
+inode_generations = {}
+# inode -> last access time in ns, for atime modes that track reads
+access_times = {}
+# inode -> (ETag, Last-Modified) of the version whose pages the kernel may
+# hold, for mounts with kernel caching
+kernel_versions = {}
+ROOT_INODE = 1
+_next_inode = ROOT_INODE + 1
+
+
+def get_url(filename):
+    with FILES_LOCK:
+        entry = source_files.get(filename)
+        return entry["url"] if entry else None
+
+
+def get_entry(filename):
+    """
+    Copy of the store entry for `filename`, or None if it isn't mapped.
+    """
+    with FILES_LOCK:
+        entry = source_files.get(filename)
+        return dict(entry) if entry else None
+
+
+def find_by_url(url, exclude=None):
+    """
+    A filename other than `exclude` whose primary URL is `url`, or None.
+    """
+    with FILES_LOCK:
+        return next(
+            (
+                name
+                for name, entry in source_files.items()
+                if entry["url"] == url and name != exclude
+            ),
+            None,
+        )
+
+
+def is_valid_url(url):
+    try:
+        parsed = urlparse(url)
+        # Reading .port rejects out-of-range or non-numeric ports
+        parsed.port
+    except ValueError:
+        # e.g. an unclosed "[" around an IPv6 literal
+        return False
+    return parsed.scheme in ("http", "https") and bool(parsed.hostname)
+
+
+def split_userinfo(url):
+    """
+    (`url` without its userinfo, (user, password) from it or None), so
+    credentials embedded in a URL go out as Basic auth instead of showing up
+    in logs and xattrs.
+    """
+    parsed = urlparse(url)
+    if parsed.username is None:
+        return url, None
+    netloc = parsed.netloc.rpartition("@")[2]
+    credentials = (unquote(parsed.username), unquote(parsed.password or ""))
+    return urlunparse(parsed._replace(netloc=netloc)), credentials
+
+
+def validate_filename(filename):
+    parts = filename.split("/")
+    if any(part in ("", ".", "..") for part in parts):
+        raise ValueError(f"invalid filename '{filename}'")
+    if filename == INDEX_FILE:
+        raise ValueError(f"'{filename}' is reserved for the mount's index")
+
+
+def add_file(
+    filename,
+    url,
+    auth=None,
+    headers=None,
+    mirrors=None,
+    local_path=None,
+    sha256=None,
+    signer=None,
+    cacheable=None,
+    compressible=False,
+    content_type=None,
+    unique=False,
+):
+    """
+    Map `filename` to `url`, with `mirrors` tried in order when it fails.
+    `auth` overrides the mount-wide default auth for this file and `headers`
+    are sent with each of its requests. `signer(request)` is called on each
+    of its prepared requests, retries included, just before it is sent, and
+    may rewrite the URL or headers (e.g. a time-limited signature in the
+    query string). `local_path` is a local copy served
+    while no source can be reached, and `sha256` the hex digest downloads
+    must match. `cacheable` False never caches the file (its attributes are
+    revalidated on every access and every read goes to the server), True
+    caches it even on an uncached mount and None follows the mount.
+    `compressible` files (text, mostly) are asked for gzip: if the origin
+    compresses them they are downloaded whole and decoded into the caches,
+    reads being served from there, instead of fetched by range. A
+    `content_type` ("image/png", or "image/*" for any image) is what the
+    origin must answer with; anything else, an HTML error page sent with 200
+    say, fails with EIO instead of being served. With `unique`, a name that is
+    already taken is made unique with suffixed_name instead of raising.
+    Returns the name the file was added under. Userinfo in `url` or `mirrors`
+    is stripped and sent as Basic auth to that URL, ahead of `auth`. Raises
+    ValueError for duplicate or malformed names, names that clash with a
+    directory, and URLs that aren't absolute http(s) URLs.
+    """
+    validate_filename(filename)
+    if mirrors is not None and not isinstance(mirrors, list):
+        raise ValueError(f"mirrors for '{filename}' must be a list")
+    for candidate in [url, *(mirrors or [])]:
+        if not is_valid_url(candidate):
+            raise ValueError(f"invalid URL for '{filename}': {candidate}")
+    if headers is not None and not isinstance(headers, dict):
+        raise ValueError(f"headers for '{filename}' must be a mapping")
+    if signer is not None and not callable(signer):
+        raise ValueError(f"signer for '{filename}' must be callable")
+    if cacheable is not None and not isinstance(cacheable, bool):
+        raise ValueError(f"cacheable for '{filename}' must be a boolean")
+    if not isinstance(compressible, bool):
+        raise ValueError(f"compressible for '{filename}' must be a boolean")
+    if local_path is not None and not isinstance(local_path, str):
+        raise ValueError(f"local_path for '{filename}' must be a string")
+    if content_type is not None and not (
+        isinstance(content_type, str) and content_type.count("/") == 1
+    ):
+        raise ValueError(f"content_type for '{filename}' must look like 'type/subtype'")
+    if sha256 is not None and not (
+        isinstance(sha256, str) and re.fullmatch(r"[0-9a-fA-F]{64}", sha256)
+    ):
+        raise ValueError(f"sha256 for '{filename}' must be 64 hex digits")
+    credentials = {}
+    urls = []
+    for candidate in [url, *(mirrors or [])]:
+        candidate, userinfo = split_userinfo(candidate)
+        if userinfo is not None:
+            credentials[candidate] = userinfo
+        urls.append(candidate)
+    url = urls[0]
+    with FILES_LOCK:
+        if unique and (_exists_locked(filename) or _is_dir_locked(filename)):
+            filename = suffixed_name(filename, url)
+        _check_free_locked(filename)
+        source_files[filename] = {
+            "name": filename,
+            # The primary URL also keys the caches, whichever mirror served them
+            "url": url,
+            "mirrors": urls,
+            "auth": auth,
+            "credentials": credentials,
+            "headers": dict(headers or {}),
+            "signer": signer,
+            "local_path": local_path,
+            "sha256": sha256.lower() if sha256 else None,
+            "cacheable": cacheable,
+            "compressible": compressible,
+            "content_type": content_type.strip().lower() if content_type else None,
+        }
+        negative_cache.pop(filename, None)
+    return filename
+
+
+def _exists_locked(name):
+    return name in source_files or name in symlinks
+
+
+def _check_free_locked(name):
+    """
+    Raise ValueError unless `name` can be added: it isn't a file, symlink or
+    directory yet, and no file or symlink is in its way.
+    """
+    if _exists_locked(name):
+        raise ValueError(f"file '{name}' already exists")
+    if _is_dir_locked(name):
+        raise ValueError(f"'{name}' is already a directory")
+    parents = name.split("/")[:-1]
+    for i in range(1, len(parents) + 1):
+        if _exists_locked("/".join(parents[:i])):
+            raise ValueError(f"'{'/'.join(parents[:i])}' is already a file")
+
+
+def symlink_escapes(name, target):
+    """
+    Whether symlink `name`'s `target` is absolute or, resolved from the
+    link's directory, leads out of the mount.
+    """
+    if target.startswith("/"):
+        return True
+    resolved = posixpath.normpath(posixpath.join(posixpath.dirname(name), target))
+    return resolved == ".." or resolved.startswith("../")
+
+
+def add_symlink(name, target, allow_unsafe=False):
+    """
+    Add a symlink `name` -> `target`, a path relative to the link's directory.
+    Raises ValueError for the same name clashes as add_file, empty targets
+    and, unless `allow_unsafe`, targets that escape the mount.
+    """
+    validate_filename(name)
+    if not isinstance(target, str) or not target or "\0" in target:
+        raise ValueError(f"invalid symlink target for '{name}': {target!r}")
+    if not allow_unsafe and symlink_escapes(name, target):
+        raise ValueError(f"symlink '{name}' -> '{target}' leads out of the mount")
+    with FILES_LOCK:
+        _check_free_locked(name)
+        symlinks[name] = target
+
+
+def get_symlink(name):
+    """
+    Target of symlink `name`, or None if it isn't one.
+    """
+    with FILES_LOCK:
+        return symlinks.get(name)
+
+
+def suffixed_name(filename, url):
+    """
+    `filename` told apart by a short hash of `url` before its extension, e.g.
+    report.csv -> report-1a2b3c4d.csv; the same URL always gets the same name.
+    """
+    digest = hashlib.sha256(url.encode("utf-8")).hexdigest()[:8]
+    head, slash, base = filename.rpartition("/")
+    stem, dot, extension = base.rpartition(".")
+    if not stem:
+        # No extension (or a dotfile): the suffix goes at the end
+        stem, dot, extension = base, "", ""
+    return f"{head}{slash}{stem}-{digest}{dot}{extension}"
+
+
+def set_url_refresher(func):
+    """
+    Register `func(filename) -> url`, asked for a fresh URL when a file's
+    current one has expired or is refused with 403. It may raise to give up.
+    """
+    url_refresher["func"] = func
+
+
+def refresh_url(filename, stale_url):
+    """
+    Replace `filename`'s primary URL `stale_url` with one from the registered
+    refresher. Copies from get_entry share the mirrors list, so requests
+    already under way see the new URL too. Returns the new URL, or None if
+    there is no refresher or the file is gone.
+    """
+    refresher = url_refresher["func"]
+    if refresher is None:
+        return None
+    # One refresh at a time; concurrent failures reuse the first's result
+    with REFRESH_LOCK:
+        with FILES_LOCK:
+            entry = source_files.get(filename)
+            if entry is None:
+                return None
+            if entry["mirrors"][0] != stale_url:
+                return entry["mirrors"][0]
+        url = refresher(filename)
+        if not isinstance(url, str) or not is_valid_url(url):
+            raise ValueError(f"refreshed URL for '{filename}' is invalid: {url!r}")
+        url, userinfo = split_userinfo(url)
+        with FILES_LOCK:
+            if source_files.get(filename) is entry:
+                entry["mirrors"][0] = url
+                if userinfo is not None:
+                    entry["credentials"][url] = userinfo
+        return url
+
+
+def remove_file(filename):
+    """
+    Drop the mapping for `filename` along with its inode and cached attributes.
+    The inode number isn't handed out again. Returns False if there was
+    nothing to remove.
+    """
+    with FILES_LOCK:
+        removed = source_files.pop(filename, None) or symlinks.pop(filename, None)
+        if removed is None:
+            return False
+        inode = inode_map.pop(filename, None)
+        inode_names.pop(inode, None)
+        access_times.pop(inode, None)
+        kernel_versions.pop(inode, None)
+        file_attributes_cache.pop(filename, None)
+        file_freshness.pop(filename, None)
+        negative_cache.pop(filename, None)
+        file_content_types.pop(filename, None)
+        file_vary.pop(filename, None)
+        local_fallbacks.pop(filename, None)
+        file_redirects.pop(filename, None)
+    stats.forget(filename)
+    return True
+
+
+def rename_file(old, new):
+    """
+    Move the mapping for `old` to `new`, keeping its URL, inode and cached
+    state; nothing changes on the remote. Raises FileNotFoundError if `old`
+    isn't a file, FileExistsError if `new` is already a file, symlink or
+    directory and ValueError if `new` is malformed or runs through an
+    existing file or symlink.
+    """
+    validate_filename(new)
+    with FILES_LOCK:
+        if old not in source_files:
+            raise FileNotFoundError(old)
+        if _exists_locked(new) or _is_dir_locked(new):
+            raise FileExistsError(new)
+        parents = new.split("/")[:-1]
+        for i in range(1, len(parents) + 1):
+            if _exists_locked("/".join(parents[:i])):
+                raise ValueError(f"'{'/'.join(parents[:i])}' is already a file")
+        entry = source_files.pop(old)
+        entry["name"] = new
+        source_files[new] = entry
+        for state in (
+            inode_map,
+            file_attributes_cache,
+            file_freshness,
+            negative_cache,
+            file_content_types,
+            file_vary,
+            local_fallbacks,
+            file_redirects,
+        ):
+            if old in state:
+                state[new] = state.pop(old)
+        if new in inode_map:
+            inode_names[inode_map[new]] = new
+    stats.rename(old, new)
+
+
+def list_files():
+    """
+    Snapshot of every mapped filename, sorted so readdir offsets stay stable.
+    """
+    with FILES_LOCK:
+        return sorted(source_files.keys())
+
+
+def list_paths():
+    """
+    Every path in the store, sorted: files, symlinks and the directories
+    they imply.
+    """
+    with FILES_LOCK:
+        names = [*source_files, *symlinks]
+    paths = set(names)
+    for name in names:
+        parts = name.split("/")[:-1]
+        paths.update("/".join(parts[:i]) for i in range(1, len(parts) + 1))
+    return sorted(paths)
+
+
+def _is_dir_locked(path):
+    prefix = f"{path}/"
+    return any(name.startswith(prefix) for name in [*source_files, *symlinks])
+
+
+def is_dir(path):
+    """
+    Whether `path` is a synthesized directory ("" is the root).
+    """
+    if path == "":
+        return True
+    with FILES_LOCK:
+        return _is_dir_locked(path)
+
+
+def list_dir(path):
+    """
+    Sorted (files, dirs) names directly under directory `path` ("" is the root).
+    """
+    prefix = f"{path}/" if path else ""
+    files, dirs = set(), set()
+    with FILES_LOCK:
+        for name in [*source_files, *symlinks]:
+            if not name.startswith(prefix):
+                continue
+            head, sep, _ = name[len(prefix) :].partition("/")
+            (dirs if sep else files).add(head)
+    return sorted(files), sorted(dirs)
+
+
+def assign_inode(filename):
+    """
+    Return the inode for `filename` (a file or directory path), allocating a
+    new one on first use; numbers are never recycled. The root path "" is
+    always ROOT_INODE.
+    """
+    global _next_inode
+    if filename == "":
+        return ROOT_INODE
+    with FILES_LOCK:
+        inode = inode_map.get(filename)
+        if inode is None:
+            inode = _next_inode
+            inode_map[filename] = inode
+            inode_names[inode] = filename
+            _bump_generation_locked(inode)
+            _next_inode += 1
+        return inode
+
+
+def _bump_generation_locked(inode):
+    inode_generations[inode] = inode_generations.get(inode, -1) + 1
+
+
+def get_generation(inode):
+    with FILES_LOCK:
+        return inode_generations.get(inode, 0)
+
+
+def snapshot_inodes():
+    """
+    Copy of the inode map, the generations and the next inode to hand out,
+    for persisting.
+    """
+    with FILES_LOCK:
+        return dict(inode_map), dict(inode_generations), _next_inode
+
+
+def restore_inodes(saved_map, next_inode, saved_generations=None):
+    """
+    Reuse previously persisted inodes for paths that still exist (files or
+    directories they imply), dropping the rest. Later allocations continue
+    after both `next_inode` and every restored inode so none is reused.
+    Generations are carried over for every saved inode, kept or not, so a
+    number handed out again still gets a new generation. Returns the number of
+    inodes restored.
+    """
+    global _next_inode
+    with FILES_LOCK:
+        for inode, generation in (saved_generations or {}).items():
+            inode_generations[inode] = max(inode_generations.get(inode, 0), generation)
+        taken = set(inode_map.values())
+        restored = 0
+        for path, inode in saved_map.items():
+            exists = _exists_locked(path) or _is_dir_locked(path)
+            if not exists or path in inode_map or inode in taken or inode <= ROOT_INODE:
+                continue
+            inode_map[path] = inode
+            inode_names[inode] = path
+            taken.add(inode)
+            restored += 1
+        _next_inode = max(_next_inode, next_inode, max(taken, default=ROOT_INODE) + 1)
+        return restored
+
+
+def clear_store():
+    """
+    Forget every file, symlink and inode and their cached state, as if
+    nothing had been added yet. Inode numbers keep counting up and their
+    generations are kept, so a stale handle never resolves to a new file.
+    Returns the inodes that were in use, whose cached blocks the caller may
+    want to drop.
+    """
+    with FILES_LOCK:
+        names = [*source_files, *symlinks]
+        inodes = list(inode_map.values())
+        for state in (
+            source_files,
+            symlinks,
+            inode_map,
+            inode_names,
+            access_times,
+            kernel_versions,
+            file_attributes_cache,
+            file_freshness,
+            negative_cache,
+            file_content_types,
+            file_vary,
+            local_fallbacks,
+            file_redirects,
+        ):
+            state.clear()
+    for name in names:
+        stats.forget(name)
+    return inodes
+
+
+def get_inode_count():
+    """
+    Number of inodes handed out so far, including the root.
+    """
+    with FILES_LOCK:
+        return _next_inode - 1
+
+
+def get_inode(filename):
+    """
+    The inode `filename` was given, or None if it has none yet; unlike
+    assign_inode this never allocates one.
+    """
+    if filename == "":
+        return ROOT_INODE
+    with FILES_LOCK:
+        return inode_map.get(filename)
 
-# LRU cache to store chunks
-file_chunk_cache = cachetools.LRUCache(maxsize=NUM_CACHE_CHUNKS)
-CACHE_LOCK = threading.Lock()
 
-# TODO: INODE_MAP should be a mapping of inode -> file
-inode_map = {}  # filename -> inode
+def get_filename(inode):
+    """
+    Path for `inode`, which may name a file or a synthesized directory.
+    """
+    if inode == ROOT_INODE:
+        return ""
+    with FILES_LOCK:
+        return inode_names.get(inode)
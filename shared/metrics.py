@@ -0,0 +1,117 @@
+import contextlib
+import errno
+
+from config.constants import DEFAULT_LATENCY_BUCKETS
+
+
+class Metrics:
+    """
+    Prometheus collectors for requests, downloads, the cache and FUSE errors.
+    Every method is a no-op until enable() is called, so prometheus_client is
+    only imported by mounts that ask for metrics.
+    """
+
+    def __init__(self):
+        self.registry = None
+        self._requests = None
+
+    @property
+    def enabled(self):
+        return self._requests is not None
+
+    def enable(self, registry=None, latency_buckets=DEFAULT_LATENCY_BUCKETS):
+        """
+        Create the collectors on `registry` (the default prometheus_client
+        registry if None), with `latency_buckets` as the upper bounds of the
+        latency histogram's buckets.
+        """
+        import prometheus_client
+
+        self.registry = registry or prometheus_client.REGISTRY
+        self._requests = prometheus_client.Counter(
+            "httpfs_http_requests_total",
+            "HTTP requests sent, by method and status ('error' for transport failures)",
+            ["method", "status"],
+            registry=self.registry,
+        )
+        self._in_flight = prometheus_client.Gauge(
+            "httpfs_http_requests_in_flight",
+            "HTTP requests waiting for response headers",
+            registry=self.registry,
+        )
+        self._bytes = prometheus_client.Counter(
+            "httpfs_downloaded_bytes_total",
+            "Response body bytes downloaded",
+            registry=self.registry,
+        )
+        self._cache = prometheus_client.Counter(
+            "httpfs_cache_lookups_total",
+            "Chunk cache lookups, by result (memory, disk or miss)",
+            ["result"],
+            registry=self.registry,
+        )
+        self._latency = prometheus_client.Histogram(
+            "httpfs_request_latency_seconds",
+            "Time to first byte of requests and of whole chunk fetches, by host",
+            ["host", "phase"],
+            buckets=latency_buckets,
+            registry=self.registry,
+        )
+        self._clock_skew = prometheus_client.Gauge(
+            "httpfs_clock_skew_seconds",
+            "How far each origin's Date header is ahead of our clock",
+            ["host"],
+            registry=self.registry,
+        )
+        self._fuse_errors = prometheus_client.Counter(
+            "httpfs_fuse_errors_total",
+            "Errors returned to the kernel, by errno name",
+            ["errno"],
+            registry=self.registry,
+        )
+
+    def serve(self, port, addr="127.0.0.1"):
+        """
+        Serve the registry on http://addr:port/metrics from a background thread.
+        """
+        import prometheus_client
+
+        prometheus_client.start_http_server(port, addr=addr, registry=self.registry)
+
+    def request(self, method, status):
+        if self.enabled:
+            self._requests.labels(method, str(status)).inc()
+
+    @contextlib.contextmanager
+    def in_flight(self):
+        if not self.enabled:
+            yield
+            return
+        self._in_flight.inc()
+        try:
+            yield
+        finally:
+            self._in_flight.dec()
+
+    def downloaded(self, size):
+        if self.enabled:
+            self._bytes.inc(size)
+
+    def cache_lookup(self, result):
+        if self.enabled:
+            self._cache.labels(result).inc()
+
+    def latency(self, host, phase, seconds):
+        if self.enabled:
+            self._latency.labels(host, phase).observe(seconds)
+
+    def clock_skew(self, host, skew):
+        if self.enabled:
+            self._clock_skew.labels(host).set(skew)
+
+    def fuse_error(self, err):
+        if self.enabled:
+            self._fuse_errors.labels(errno.errorcode.get(err, str(err))).inc()
+
+
+metrics = Metrics()
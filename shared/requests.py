@@ -1,14 +1,85 @@
 import threading
 
-# Global dict for per-chunk events
+# Global dict of in-flight chunk fetches: (inode, block) -> Future
 ongoing_requests = {}
 ONGOING_LOCK = threading.Lock()
 
-# Global dict to track active prefetch threads per URL
+# Global dict to track the active prefetch per file handle: fh -> (thread, cancel event)
 prefetch_threads = {}
 PREFETCH_LOCK = threading.Lock()
 
 
-# Global mapping: file URL -> persistent requests.Session
-sessions = {}
+# URLs whose bodies have to be fetched whole instead of by Range
+full_fetch_urls = set()
+FULL_FETCH_LOCK = threading.Lock()
+
+# URLs the origin marked Cache-Control: no-store; their chunks are never cached
+no_store_urls = set()
+NO_STORE_LOCK = threading.Lock()
+
+
+# URLs whose servers don't answer multi-range requests with multipart/byteranges
+single_range_urls = set()
+SINGLE_RANGE_LOCK = threading.Lock()
+
+
+# URLs without a known length that can only be read front to back
+stream_only_urls = set()
+STREAM_ONLY_LOCK = threading.Lock()
+
+
+# Thread pool that chunk downloads run on (created on first use)
+fetch_pool = {"pool": None}
+FETCH_POOL_LOCK = threading.Lock()
+
+
+# Hosts that answered 429, or 503 with Retry-After: host_key -> monotonic time
+# before which we hold off
+host_cooldowns = {}
+COOLDOWN_LOCK = threading.Lock()
+
+
+# Circuit breakers: host_key -> {"failures": monotonic times of recent
+# failures, "open_until": monotonic time or None, "trial": bool}
+host_breakers = {}
+BREAKER_LOCK = threading.Lock()
+
+
+# Request signers: host_key -> func(request), for hosts whose requests each
+# need a fresh signature
+host_signers = {}
+SIGNERS_LOCK = threading.Lock()
+
+
+# Per-host limits on requests in flight: host_key -> BoundedSemaphore
+host_slots = {}
+HOST_SLOTS_LOCK = threading.Lock()
+
+
+# Index of the last mirror that answered, keyed by a file's primary URL
+mirror_index = {}
+MIRROR_LOCK = threading.Lock()
+
+
+# Whole-file background downloads: inode -> {"progress", "finished", "cond"}
+full_downloads = {}
+FULL_DOWNLOADS_LOCK = threading.Lock()
+
+
+# Chunks seen of files with an expected checksum: inode -> set of chunk
+# indices, and the inodes whose cached content already matched it
+chunk_coverage = {}
+verified_inodes = set()
+COVERAGE_LOCK = threading.Lock()
+
+
+# Set once the filesystem is shutting down; in-flight requests give up
+shutdown_event = threading.Event()
+
+# Set while a FUSE session is open, so the kernel can be sent notifications
+fuse_mounted = threading.Event()
+
+
+# The requests.Session shared by all files (created on first use)
+shared_session = {"session": None, "last_used": 0.0}
 SESSION_LOCK = threading.Lock()
@@ -0,0 +1,204 @@
+import bisect
+import threading
+
+from config.constants import DEFAULT_LATENCY_BUCKETS
+
+
+class FileStats:
+    """
+    Per-file counters for operators: bytes served to readers, HTTP requests
+    sent, the last error and its HTTP status, chunk cache hits and misses,
+    the last known size and the progress of a whole-file download. All
+    methods are safe to call from any thread.
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._files = {}
+
+    def _file_locked(self, filename):
+        return self._files.setdefault(
+            filename,
+            {
+                "bytes_read": 0,
+                "requests": 0,
+                "last_error": None,
+                "last_status": None,
+                "cache_hits": 0,
+                "cache_misses": 0,
+                "size": None,
+                # {"bytes", "total", "finished"} of the latest download
+                "download": None,
+            },
+        )
+
+    def read(self, filename, nbytes):
+        with self._lock:
+            self._file_locked(filename)["bytes_read"] += nbytes
+
+    def request(self, filename):
+        with self._lock:
+            self._file_locked(filename)["requests"] += 1
+
+    def error(self, filename, err):
+        with self._lock:
+            counters = self._file_locked(filename)
+            counters["last_error"] = str(err)
+            # None for failures that never got a response
+            counters["last_status"] = getattr(err, "status", None)
+
+    def cache_lookup(self, filename, hit):
+        with self._lock:
+            self._file_locked(filename)["cache_hits" if hit else "cache_misses"] += 1
+
+    def size(self, filename, size):
+        with self._lock:
+            self._file_locked(filename)["size"] = size
+
+    def download(self, filename, nbytes, total, finished=False):
+        with self._lock:
+            self._file_locked(filename)["download"] = {
+                "bytes": nbytes,
+                "total": total,
+                "finished": finished,
+            }
+
+    def get(self, filename):
+        """
+        Copy of `filename`'s counters plus its cache hit ratio (None before
+        any lookup), or None if nothing has been recorded for it.
+        """
+        with self._lock:
+            counters = self._files.get(filename)
+            if counters is None:
+                return None
+            result = dict(counters)
+            if result["download"] is not None:
+                result["download"] = dict(result["download"])
+        lookups = result["cache_hits"] + result["cache_misses"]
+        result["cache_hit_ratio"] = result["cache_hits"] / lookups if lookups else None
+        return result
+
+    def snapshot(self):
+        """
+        {filename: counters} for every file anything has been recorded for.
+        """
+        with self._lock:
+            filenames = list(self._files)
+        return {filename: self.get(filename) for filename in filenames}
+
+    def rename(self, old, new):
+        with self._lock:
+            if old in self._files:
+                self._files[new] = self._files.pop(old)
+
+    def forget(self, filename):
+        with self._lock:
+            self._files.pop(filename, None)
+
+
+class HostStats:
+    """
+    Per-host observations, keyed by "host:port": the clock skew last measured
+    from the Date header (positive when the origin is ahead of us).
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._hosts = {}
+
+    def clock_skew(self, host, skew):
+        """
+        Record `host`'s measured skew and return the previous one, or None.
+        """
+        with self._lock:
+            counters = self._hosts.setdefault(host, {"clock_skew": None})
+            previous = counters["clock_skew"]
+            counters["clock_skew"] = skew
+        return previous
+
+    def get(self, host):
+        with self._lock:
+            counters = self._hosts.get(host)
+            return dict(counters) if counters is not None else None
+
+    def snapshot(self):
+        with self._lock:
+            return {host: dict(counters) for host, counters in self._hosts.items()}
+
+
+class LatencyHistograms:
+    """
+    Request latency histograms per (host, phase), phase being "first_byte"
+    or "chunk". Each thread counts into its own shard so recording takes no
+    lock; snapshot() adds the shards up, and may miss observations made
+    while it runs.
+    """
+
+    def __init__(self, buckets):
+        self._lock = threading.Lock()
+        self._local = threading.local()
+        self.configure(buckets)
+
+    def configure(self, buckets):
+        """
+        Start over with bucket upper bounds `buckets` (seconds); an implicit
+        last bucket counts everything slower.
+        """
+        with self._lock:
+            self.buckets = tuple(sorted(buckets))
+            self._shards = []
+            # Threads still holding an old shard register a new one
+            self._generation = object()
+
+    def _shard(self):
+        shard = getattr(self._local, "shard", None)
+        if shard is None or self._local.generation is not self._generation:
+            shard = {}
+            with self._lock:
+                self._shards.append(shard)
+                self._local.generation = self._generation
+            self._local.shard = shard
+        return shard
+
+    def observe(self, host, phase, seconds):
+        shard = self._shard()
+        counts = shard.get((host, phase))
+        if counts is None:
+            # Bucket counts, then the sum of observations
+            counts = shard[(host, phase)] = [0] * (len(self.buckets) + 1) + [0.0]
+        counts[bisect.bisect_left(self.buckets, seconds)] += 1
+        counts[-1] += seconds
+
+    def snapshot(self):
+        """
+        {host: {phase: {"buckets": [(upper bound, cumulative count)], "count",
+        "sum"}}}, the last bound being infinity.
+        """
+        with self._lock:
+            shards = list(self._shards)
+            bounds = [*self.buckets, float("inf")]
+        totals = {}
+        for shard in shards:
+            for key, counts in list(shard.items()):
+                total = totals.setdefault(key, [0] * len(counts))
+                for i, value in enumerate(counts):
+                    total[i] += value
+        result = {}
+        for (host, phase), counts in totals.items():
+            cumulative = 0
+            buckets = []
+            for bound, count in zip(bounds, counts[:-1]):
+                cumulative += count
+                buckets.append((bound, cumulative))
+            result.setdefault(host, {})[phase] = {
+                "buckets": buckets,
+                "count": cumulative,
+                "sum": counts[-1],
+            }
+        return result
+
+
+stats = FileStats()
+host_stats = HostStats()
+host_latency = LatencyHistograms(DEFAULT_LATENCY_BUCKETS)
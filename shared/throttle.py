@@ -0,0 +1,141 @@
+import threading
+import time
+
+
+class TokenBucket:
+    """
+    Token bucket letting `rate` bytes per second through, with bursts of up to
+    one second's worth. A rate of 0 means unlimited.
+    """
+
+    def __init__(self, rate=0):
+        self._lock = threading.Lock()
+        self.rate = rate
+        self._tokens = rate
+        self._updated = time.monotonic()
+
+    def consume(self, amount, cancelled=lambda: False):
+        """
+        Block until `amount` bytes may pass. Returns False if `cancelled()`
+        became true while waiting.
+        """
+        while True:
+            with self._lock:
+                if self.rate <= 0:
+                    return True
+                now = time.monotonic()
+                elapsed = now - self._updated
+                self._tokens = min(self.rate, self._tokens + elapsed * self.rate)
+                self._updated = now
+                # Parts bigger than a burst go through once the bucket is full
+                # and leave it in debt
+                if self._tokens >= min(amount, self.rate):
+                    self._tokens -= amount
+                    return True
+                wait = (min(amount, self.rate) - self._tokens) / self.rate
+            if cancelled():
+                return False
+            # Wake up regularly so cancellation isn't stuck behind a long wait
+            time.sleep(min(wait, 0.1))
+
+
+class Throttle:
+    """
+    A mount-wide bucket plus one bucket per file, both of which a body read
+    has to get through.
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self.mount = TokenBucket()
+        self.per_file_rate = 0
+        self._files = {}
+
+    def configure(self, rate, per_file_rate=0):
+        with self._lock:
+            self.mount = TokenBucket(rate)
+            self.per_file_rate = per_file_rate
+            self._files = {}
+
+    def _bucket_for(self, key):
+        with self._lock:
+            bucket = self._files.get(key)
+            if bucket is None:
+                bucket = self._files[key] = TokenBucket(self.per_file_rate)
+            return bucket
+
+    def consume(self, key, amount, cancelled=lambda: False):
+        if self.per_file_rate > 0 and not self._bucket_for(key).consume(
+            amount, cancelled
+        ):
+            return False
+        return self.mount.consume(amount, cancelled)
+
+
+class RetryBucket:
+    """
+    Up to `capacity` retries, `rate` of which come back per second. Only
+    used under RetryBudget's lock. A capacity of 0 is unlimited.
+    """
+
+    def __init__(self, capacity=0, rate=0):
+        self.capacity = capacity
+        self.rate = rate
+        self._tokens = capacity
+        self._updated = time.monotonic()
+
+    def available(self):
+        if self.capacity <= 0:
+            return True
+        now = time.monotonic()
+        self._tokens = min(
+            self.capacity, self._tokens + (now - self._updated) * self.rate
+        )
+        self._updated = now
+        return self._tokens >= 1
+
+    def take(self):
+        if self.capacity > 0:
+            self._tokens -= 1
+
+
+class RetryBudget:
+    """
+    A mount-wide bucket of retries plus one per host; a retry needs a token
+    from both.
+    """
+
+    def __init__(self):
+        self._lock = threading.Lock()
+        self.mount = RetryBucket()
+        self.host_capacity = 0
+        self.host_rate = 0
+        self._hosts = {}
+
+    def configure(self, capacity, rate, host_capacity=0, host_rate=0):
+        with self._lock:
+            self.mount = RetryBucket(capacity, rate)
+            self.host_capacity = host_capacity
+            self.host_rate = host_rate
+            self._hosts = {}
+
+    def take(self, host):
+        """
+        Spend a retry against `host`. Returns False, spending nothing, if the
+        mount or the host has none left.
+        """
+        with self._lock:
+            bucket = self._hosts.get(host)
+            if bucket is None:
+                bucket = self._hosts[host] = RetryBucket(
+                    self.host_capacity, self.host_rate
+                )
+            if not (bucket.available() and self.mount.available()):
+                return False
+            bucket.take()
+            self.mount.take()
+            return True
+
+
+throttle = Throttle()
+retry_budget = RetryBudget()
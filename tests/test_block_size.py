@@ -0,0 +1,75 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config, mount_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.mount_utils import check_mount_options
+
+SIZE = 256 * 1024
+
+
+class BlockSizeTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        add_file("dir/data.bin", self.origin.add("/data.bin", b"d" * SIZE))
+
+    def set_block_size(self, size):
+        patcher = mock.patch.object(mount_config, "block_size", size)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def reported(self):
+        statfs = self.fs._run(self.fs.ops.statfs, self.fs.ctx)
+        return {
+            self.fs.getattr("dir/data.bin").st_blksize,
+            self.fs.lookup("dir").st_blksize,
+            statfs.f_bsize,
+            statfs.f_frsize,
+        }
+
+    def reads_to_copy(self):
+        """
+        Read the file through as cp does, a st_blksize at a time; returns
+        how many reads that took.
+        """
+        size = self.fs.getattr("dir/data.bin").st_blksize
+        reads = offset = 0
+        while True:
+            part = self.fs.read("dir/data.bin", offset, size)
+            reads += 1
+            if not part:
+                return reads
+            offset += len(part)
+
+    def test_default(self):
+        self.assertEqual(self.reported(), {4096})
+
+    def test_configured_size_is_reported_everywhere(self):
+        self.set_block_size(128 * 1024)
+        self.assertEqual(self.reported(), {128 * 1024})
+
+    def test_zero_reports_the_chunk_size(self):
+        self.set_block_size(0)
+        self.assertEqual(self.reported(), {cache_config.chunk_size})
+
+    def test_default_blocks_take_many_reads(self):
+        # The last read is the one that finds the end of the file
+        self.assertEqual(self.reads_to_copy(), SIZE // 4096 + 1)
+
+    def test_larger_blocks_mean_fewer_reads(self):
+        self.set_block_size(128 * 1024)
+        self.assertEqual(self.reads_to_copy(), SIZE // (128 * 1024) + 1)
+
+    def test_negative_size_is_refused(self):
+        self.set_block_size(-1)
+        with self.assertRaises(ValueError):
+            check_mount_options()
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,59 @@
+import errno
+import io
+import math
+import unittest
+from unittest import mock
+
+import pyfuse3
+import requests
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, assign_inode, get_entry
+from utils.fetch_utils import read_whole_body
+
+CAP = 64 * 1024
+
+
+class BodyCapTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        patcher = mock.patch.object(cache_config, "max_buffered_body", CAP)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.fs = FileSystem()
+
+    def test_body_over_the_cap_fails_with_efbig(self):
+        # Answers every Range with the whole body, more than may be buffered
+        url = self.origin.add("/big.bin", b"x" * (CAP + 1), ranges=False)
+        add_file("big.bin", url)
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("big.bin", 0, 4096)
+        self.assertEqual(cm.exception.errno, errno.EFBIG)
+
+    def test_body_under_the_cap_is_buffered(self):
+        body = bytes(range(256)) * (CAP // 256)
+        add_file("small.bin", self.origin.add("/small.bin", body, ranges=False))
+        self.assertEqual(self.fs.read("small.bin", 1000, 24), body[1000:1024])
+        # The rest is served from the cached body
+        self.assertEqual(self.fs.read("small.bin"), body)
+        self.assertEqual(len(self.origin.requests_for("/small.bin", "GET")), 1)
+
+    def test_unparsable_length_is_ignored(self):
+        add_file("odd.bin", self.origin.add("/odd.bin", b"x" * 1000))
+        response = requests.Response()
+        response.url = self.origin.url("/odd.bin")
+        # urllib3 accepts repeated identical values, joined with ", "
+        response.headers["Content-Length"] = "1000, 1000"
+        response.raw = io.BytesIO(b"x" * 1000)
+        response.deadline = math.inf
+        inode = assign_inode("odd.bin")
+        body, length, _ = read_whole_body(inode, get_entry("odd.bin"), response, 4096)
+        self.assertEqual((body, length), (b"x" * 1000, 1000))
+
+
+if __name__ == "__main__":
+    unittest.main()
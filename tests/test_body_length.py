@@ -0,0 +1,35 @@
+import errno
+import unittest
+
+import pyfuse3
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class BodyLengthTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+
+    def test_short_body_fails_with_eio(self):
+        # Declares 1000 bytes, then hangs up after 800
+        url = self.origin.add(
+            "/short.bin", b"x" * 800, headers={"Content-Length": "1000"}
+        )
+        add_file("short.bin", url)
+        self.assertEqual(self.fs.getattr("short.bin").st_size, 1000)
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("short.bin")
+        self.assertEqual(cm.exception.errno, errno.EIO)
+
+    def test_honest_body_reads_whole(self):
+        add_file("whole.bin", self.origin.add("/whole.bin", b"y" * 1000))
+        self.assertEqual(self.fs.read("whole.bin"), b"y" * 1000)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,87 @@
+import unittest
+
+from shared.cache import (
+    BlockCache,
+    EvictionPolicy,
+    cache_policies,
+    register_cache_policy,
+)
+
+BLOCK = b"x" * 10
+
+
+def cache_of(policy, keys):
+    """
+    A three-block cache holding `keys`, stored in that order.
+    """
+    cache = BlockCache(3 * len(BLOCK), policy)
+    for key in keys:
+        cache.put(key, BLOCK)
+    return cache
+
+
+class CachePolicyTest(unittest.TestCase):
+    def test_lru_evicts_least_recently_read(self):
+        cache = cache_of("lru", ["a", "b", "c"])
+        cache.get("a")
+        cache.put("d", BLOCK)
+        self.assertNotIn("b", cache)
+        self.assertIn("a", cache)
+
+    def test_lfu_evicts_least_often_read(self):
+        cache = cache_of("lfu", ["a", "b", "c"])
+        for _ in range(3):
+            cache.get("a")
+            cache.get("c")
+        cache.get("b")
+        cache.put("d", BLOCK)
+        self.assertNotIn("b", cache)
+        self.assertIn("a", cache)
+        self.assertIn("c", cache)
+
+    def test_fifo_ignores_reads(self):
+        cache = cache_of("fifo", ["a", "b", "c"])
+        cache.get("a")
+        cache.put("d", BLOCK)
+        self.assertNotIn("a", cache)
+
+    def test_switching_policy_keeps_blocks(self):
+        cache = cache_of("lru", ["a", "b", "c"])
+        cache.set_policy("fifo")
+        self.assertEqual(cache.stats()["blocks"], 3)
+        cache.put("d", BLOCK)
+        self.assertNotIn("a", cache)
+
+    def test_resize_evicts_down_to_the_budget(self):
+        cache = cache_of("lru", ["a", "b", "c"])
+        cache.resize(len(BLOCK))
+        self.assertEqual(cache.stats()["bytes"], len(BLOCK))
+        self.assertIn("c", cache)
+
+    def test_registered_policy(self):
+        class Newest(EvictionPolicy):
+            def __init__(self):
+                self.keys = []
+
+            def admit(self, key):
+                self.keys.append(key)
+
+            def touch(self, key):
+                pass
+
+            def evict(self):
+                return self.keys.pop()
+
+            def discard(self, key):
+                self.keys.remove(key)
+
+        register_cache_policy("newest", Newest)
+        self.addCleanup(cache_policies.pop, "newest")
+        cache = cache_of("newest", ["a", "b", "c"])
+        cache.put("d", BLOCK)
+        self.assertNotIn("c", cache)
+        self.assertIn("a", cache)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,56 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, get_entry
+
+
+class CacheableTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        patcher = mock.patch.object(cache_config, "readahead", 0)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def gets_for_two_reads(self, cacheable):
+        url = self.origin.add("/data.bin", b"live log line")
+        add_file("data.bin", url, cacheable=cacheable)
+        for _ in range(2):
+            self.assertEqual(self.fs.read("data.bin"), b"live log line")
+        return len(self.origin.requests_for("/data.bin", "GET"))
+
+    def set_uncached(self):
+        patcher = mock.patch.object(cache_config, "uncached", True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_entry_exposes_the_flag(self):
+        add_file("data.bin", self.origin.add("/data.bin"), cacheable=False)
+        self.assertIs(get_entry("data.bin")["cacheable"], False)
+
+    def test_cacheable_file_is_read_once(self):
+        self.assertEqual(self.gets_for_two_reads(None), 1)
+
+    def test_non_cacheable_file_is_fetched_every_read(self):
+        self.assertEqual(self.gets_for_two_reads(False), 2)
+        # Its attributes are revalidated on every access too
+        heads = len(self.origin.requests_for("/data.bin", "HEAD"))
+        self.fs.getattr("data.bin")
+        self.assertGreater(len(self.origin.requests_for("/data.bin", "HEAD")), heads)
+
+    def test_mount_default_can_be_off(self):
+        self.set_uncached()
+        self.assertEqual(self.gets_for_two_reads(None), 2)
+
+    def test_file_overrides_the_mount(self):
+        self.set_uncached()
+        self.assertEqual(self.gets_for_two_reads(True), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
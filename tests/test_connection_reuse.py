@@ -0,0 +1,38 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class ConnectionReuseTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        # Small chunks and no readahead, so each read is one request and
+        # they never overlap
+        for field, value in (("chunk_size", 1024), ("readahead", 0)):
+            patcher = mock.patch.object(cache_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_sequential_reads_share_a_connection(self):
+        add_file("a.bin", self.origin.add("/a.bin", b"a" * 8192))
+        add_file("b.bin", self.origin.add("/b.bin", b"b" * 4096))
+        # A chunk per read; a larger read would fetch its chunks in parallel
+        for offset in range(0, 8192, 1024):
+            self.assertEqual(self.fs.read("a.bin", offset, 1024), b"a" * 1024)
+        for offset in range(0, 4096, 1024):
+            self.assertEqual(self.fs.read("b.bin", offset, 1024), b"b" * 1024)
+
+        gets = self.origin.requests_for("/a.bin", "GET")
+        self.assertGreaterEqual(len(gets), 8)
+        self.assertEqual(len(set(self.origin.peers)), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,55 @@
+import errno
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import cache_config, client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+BODY = bytes(range(256)) * 32
+
+
+class ContentRangeTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for config, field, value in (
+            (cache_config, "chunk_size", 1024),
+            (cache_config, "readahead", 0),
+            (client_config, "max_attempts", 1),
+        ):
+            patcher = mock.patch.object(config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def serve(self, content_range):
+        headers = {"Content-Range": content_range} if content_range else {}
+        add_file("data.bin", self.origin.add("/data.bin", BODY, headers=headers))
+
+    def test_shifted_window_fails_with_eio(self):
+        # Every 206 claims the second KiB, whatever was asked for
+        self.serve("bytes 1024-2047/8192")
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("data.bin", 2048, 1024)
+        self.assertEqual(cm.exception.errno, errno.EIO)
+        (get,) = self.origin.requests_for("/data.bin", "GET")
+        self.assertEqual(get[2]["Range"], "bytes=2048-3071")
+
+    def test_matching_window_is_served(self):
+        self.serve("bytes 1024-2047/8192")
+        self.assertEqual(self.fs.read("data.bin", 1024, 1024), BODY[1024:2048])
+
+    def test_missing_content_range_fails_with_eio(self):
+        self.serve("garbage")
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("data.bin", 0, 1024)
+        self.assertEqual(cm.exception.errno, errno.EIO)
+
+
+if __name__ == "__main__":
+    unittest.main()
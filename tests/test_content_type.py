@@ -0,0 +1,52 @@
+import errno
+import unittest
+
+import pyfuse3
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+PNG = b"\x89PNG\r\n\x1a\n"
+ERROR_PAGE = b"<html>Session expired</html>"
+
+
+class ContentTypeTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+
+    def serve(self, body, content_type, expected):
+        url = self.origin.add("/logo.png", body, headers={"Content-Type": content_type})
+        add_file("logo.png", url, content_type=expected)
+
+    def test_html_for_an_image_fails_with_eio(self):
+        self.serve(ERROR_PAGE, "text/html; charset=utf-8", "image/png")
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("logo.png")
+        self.assertEqual(cm.exception.errno, errno.EIO)
+
+    def test_expected_type_is_served(self):
+        for content_type, expected in (
+            ("image/png", "image/png"),
+            ("IMAGE/PNG; foo=bar", "image/png"),
+            ("image/png", "image/*"),
+        ):
+            with self.subTest(content_type=content_type, expected=expected):
+                reset()
+                self.serve(PNG, content_type, expected)
+                self.assertEqual(self.fs.read("logo.png"), PNG)
+
+    def test_unchecked_without_an_expectation(self):
+        self.serve(ERROR_PAGE, "text/html", None)
+        self.assertEqual(self.fs.read("logo.png"), ERROR_PAGE)
+
+    def test_expectation_must_be_a_media_type(self):
+        with self.assertRaises(ValueError):
+            add_file("logo.png", self.origin.url("/logo.png"), content_type="png")
+
+
+if __name__ == "__main__":
+    unittest.main()
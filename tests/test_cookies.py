@@ -0,0 +1,50 @@
+import unittest
+from unittest import mock
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from shared.requests import SESSION_LOCK, shared_session
+
+
+def drop_session():
+    # The jar is chosen when the shared session is made; start a new one
+    with SESSION_LOCK:
+        session = shared_session["session"]
+        shared_session["session"] = None
+    if session is not None:
+        session.close()
+
+
+class CookieTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        drop_session()
+        self.addCleanup(drop_session)
+        # Sets the session cookie on the first response, as a login would
+        login = {"Set-Cookie": "session=abc; Path=/"}
+        add_file("login.bin", self.origin.add("/login.bin", headers=login))
+        add_file("data.bin", self.origin.add("/data.bin", b"data"))
+
+    def cookies_sent(self):
+        self.fs.getattr("login.bin")
+        self.assertEqual(self.fs.read("data.bin"), b"data")
+        requests = self.origin.requests_for("/data.bin")
+        return [headers.get("Cookie") for _, _, headers in requests]
+
+    def test_cookies_are_replayed_when_enabled(self):
+        patcher = mock.patch.object(client_config, "cookies", True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.assertEqual(set(self.cookies_sent()), {"session=abc"})
+
+    def test_cookies_are_refused_by_default(self):
+        self.assertEqual(set(self.cookies_sent()), {None})
+
+
+if __name__ == "__main__":
+    unittest.main()
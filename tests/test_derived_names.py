@@ -0,0 +1,79 @@
+import unittest
+from unittest import mock
+
+from config.settings import mount_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, get_url, suffixed_name
+from utils.file_utils import url_filename
+from utils.manifest_utils import validate_entries
+
+
+class DerivedNameTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+
+    def set_config(self, field, value):
+        patcher = mock.patch.object(mount_config, field, value)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_weird_characters(self):
+        cases = {
+            "http://host/report.csv?v=2": "report.csv",
+            "http://host/a%20b%2Fc.txt": "a b_c.txt",
+            "http://host/tab%09here%00.bin": "tab_here_.bin",
+            "http://host/dir/%2E%2E": "__",
+            "http://host/dir/%2E": "_",
+        }
+        for url, name in cases.items():
+            with self.subTest(url=url):
+                self.assertEqual(url_filename(url), name)
+
+    def test_query_can_be_kept(self):
+        self.set_config("name_query", True)
+        self.assertEqual(url_filename("http://host/r.csv?v=2&a=%2F"), "r.csv?v=2&a=_")
+
+    def test_suffix_is_deterministic(self):
+        first = suffixed_name("dir/report.csv", "http://one/report.csv")
+        self.assertRegex(first, r"^dir/report-[0-9a-f]{8}\.csv$")
+        again = suffixed_name("dir/report.csv", "http://one/report.csv")
+        other = suffixed_name("dir/report.csv", "http://two/report.csv")
+        self.assertEqual(first, again)
+        self.assertNotEqual(first, other)
+        bare = suffixed_name("README", "http://one/README")
+        self.assertRegex(bare, r"^README-[0-9a-f]{8}$")
+
+    def test_collisions_are_errors_by_default(self):
+        entries = [{"url": "http://one/report.csv"}, {"url": "http://two/report.csv"}]
+        with self.assertRaisesRegex(ValueError, "duplicates name 'report.csv'"):
+            validate_entries(entries, "test")
+
+    def test_collisions_get_suffixed(self):
+        self.set_config("name_collisions", "suffix")
+        entries = validate_entries(
+            [{"url": "http://one/report.csv"}, {"url": "http://two/report.csv"}],
+            "test",
+        )
+        names = [item["name"] for item in entries]
+        self.assertEqual(names[0], "report.csv")
+        self.assertEqual(names[1], suffixed_name("report.csv", "http://two/report.csv"))
+
+    def test_add_file_unique(self):
+        origin = Origin().start()
+        self.addCleanup(origin.close)
+        first = origin.add("/one/report.csv", b"one")
+        second = origin.add("/two/report.csv", b"two")
+        self.assertEqual(add_file("report.csv", first), "report.csv")
+        with self.assertRaises(ValueError):
+            add_file("report.csv", second)
+        name = add_file("report.csv", second, unique=True)
+        self.assertNotEqual(name, "report.csv")
+        self.assertEqual(get_url(name), second)
+        fs = FileSystem()
+        self.assertEqual(fs.read("report.csv"), b"one")
+        self.assertEqual(fs.read(name), b"two")
+
+
+if __name__ == "__main__":
+    unittest.main()
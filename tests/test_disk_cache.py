@@ -0,0 +1,75 @@
+import errno
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from shared.cache import DiskCache
+
+
+class FullDisk:
+    """
+    A file opened for writing that is out of space once written to.
+    """
+
+    def __init__(self, path, mode):
+        self.file = open(path, mode)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        self.file.close()
+
+    def write(self, data):
+        raise OSError(errno.ENOSPC, os.strerror(errno.ENOSPC))
+
+
+class DiskCacheTest(unittest.TestCase):
+    def setUp(self):
+        directory = tempfile.TemporaryDirectory()
+        self.addCleanup(directory.cleanup)
+        self.path = directory.name
+
+    def test_survives_remounts(self):
+        cache = DiskCache()
+        cache.configure(self.path, 4)
+        cache.put("http://origin.test/a", 0, b"abcd")
+        remounted = DiskCache()
+        remounted.configure(self.path, 4)
+        self.assertEqual(remounted.get("http://origin.test/a", 0), b"abcd")
+
+    def test_stale_temp_files_are_removed(self):
+        stale = os.path.join(self.path, "0123_4_0.140245.tmp")
+        with open(stale, "wb") as f:
+            f.write(b"x" * 100)
+        cache = DiskCache()
+        cache.configure(self.path, 4, max_bytes=8)
+        self.assertFalse(os.path.exists(stale))
+        cache.put("http://origin.test/a", 0, b"abcd")
+        cache.put("http://origin.test/a", 4, b"efgh")
+        # Both fit the budget once the stale bytes aren't counted
+        self.assertEqual(cache.get("http://origin.test/a", 0), b"abcd")
+        self.assertEqual(cache.get("http://origin.test/a", 4), b"efgh")
+
+    def test_failed_write_leaves_no_temp_file(self):
+        cache = DiskCache()
+        cache.configure(self.path, 4)
+        with mock.patch("shared.cache.open", FullDisk, create=True):
+            with self.assertRaises(OSError):
+                cache.put("http://origin.test/a", 0, b"abcd")
+        self.assertEqual(os.listdir(self.path), [])
+
+    def test_evicts_least_recently_used(self):
+        cache = DiskCache()
+        cache.configure(self.path, 4, max_bytes=8)
+        cache.put("http://origin.test/a", 0, b"abcd")
+        os.utime(os.path.join(self.path, os.listdir(self.path)[0]), (0, 0))
+        cache.put("http://origin.test/b", 0, b"efgh")
+        cache.put("http://origin.test/c", 0, b"ijkl")
+        self.assertIsNone(cache.get("http://origin.test/a", 0))
+        self.assertEqual(cache.get("http://origin.test/c", 0), b"ijkl")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,75 @@
+import json
+import os
+import subprocess
+import sys
+import tempfile
+import unittest
+
+ROOT = os.path.dirname(os.path.dirname(os.path.abspath(__file__)))
+
+# Loads a manifest the way a mount does and prints the inode of every path
+MOUNT = """
+import json, sys
+from config.settings import mount_config
+from shared.files import inode_map
+from utils.file_utils import preassign_inodes
+from utils.manifest_utils import load_manifest
+
+mount_config.eager_inodes = sys.argv[2] == "eager"
+load_manifest(sys.argv[1])
+preassign_inodes()
+print(json.dumps(dict(inode_map)))
+"""
+
+ENTRIES = [
+    {"name": "videos/b.mp4", "url": "http://origin.test/b.mp4"},
+    {"name": "a.txt", "url": "http://origin.test/a.txt"},
+    {"name": "videos/old/c.mp4", "url": "http://origin.test/c.mp4"},
+    {"type": "symlink", "name": "latest", "target": "videos/b.mp4"},
+]
+
+
+class EagerInodeTest(unittest.TestCase):
+    def setUp(self):
+        directory = tempfile.TemporaryDirectory()
+        self.addCleanup(directory.cleanup)
+        self.dir = directory.name
+
+    def mount(self, entries, mode):
+        path = os.path.join(self.dir, "manifest.json")
+        with open(path, "w") as f:
+            json.dump(entries, f)
+        # A process each, as two mounts would be
+        output = subprocess.run(
+            [sys.executable, "-c", MOUNT, path, mode],
+            cwd=ROOT,
+            capture_output=True,
+            check=True,
+            text=True,
+        ).stdout
+        return json.loads(output.splitlines()[-1])
+
+    def test_same_manifest_same_inodes(self):
+        first = self.mount(ENTRIES, "eager")
+        self.assertEqual(self.mount(ENTRIES, "eager"), first)
+        # Sorted, so the manifest's order doesn't matter either
+        self.assertEqual(self.mount(ENTRIES[::-1], "eager"), first)
+        self.assertEqual(
+            sorted(first, key=first.get),
+            [
+                "a.txt",
+                "latest",
+                "videos",
+                "videos/b.mp4",
+                "videos/old",
+                "videos/old/c.mp4",
+            ],
+        )
+
+    def test_lazy_numbers_only_files(self):
+        inodes = self.mount(ENTRIES, "lazy")
+        self.assertEqual(sorted(inodes), ["a.txt", "videos/b.mp4", "videos/old/c.mp4"])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,42 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+BODY = bytes(range(256)) * 10
+
+
+class EofReadTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for field, value in (("chunk_size", 1024), ("readahead", 0)):
+            patcher = mock.patch.object(cache_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        add_file("data.bin", self.origin.add("/data.bin", BODY))
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 2560)
+
+    def gets(self):
+        return self.origin.requests_for("/data.bin", "GET")
+
+    def test_read_at_or_past_eof_sends_nothing(self):
+        for offset in (2560, 2561, 10_000):
+            with self.subTest(offset=offset):
+                self.assertEqual(self.fs.read("data.bin", offset, 1024), b"")
+        self.assertEqual(self.gets(), [])
+
+    def test_read_straddling_eof_is_clamped(self):
+        self.assertEqual(self.fs.read("data.bin", 2500, 1024), BODY[2500:])
+        # The last chunk is asked for only up to the real end, so no 416
+        (get,) = self.gets()
+        self.assertEqual(get[2]["Range"], "bytes=2048-2559")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,34 @@
+import os
+import unittest
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class FsyncTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        add_file("dir/data.bin", self.origin.add("/data.bin", b"data"))
+
+    def test_flush_and_fsync_succeed(self):
+        inode = self.fs.inode("dir/data.bin")
+        fh = self.fs._run(self.fs.ops.open, inode, os.O_RDONLY, self.fs.ctx).fh
+        self.addCleanup(self.fs._run, self.fs.ops.release, fh)
+        self.assertIsNone(self.fs._run(self.fs.ops.fsync, fh, False))
+        self.assertIsNone(self.fs._run(self.fs.ops.fsync, fh, True))
+        self.assertIsNone(self.fs._run(self.fs.ops.flush, fh))
+        # The handle is untouched by them
+        self.assertEqual(self.fs._run(self.fs.ops.read, fh, 0, 4), b"data")
+
+    def test_fsyncdir_succeeds(self):
+        fh = self.fs._run(self.fs.ops.opendir, self.fs.inode("dir"), self.fs.ctx)
+        self.addCleanup(self.fs._run, self.fs.ops.releasedir, fh)
+        self.assertIsNone(self.fs._run(self.fs.ops.fsyncdir, fh, False))
+
+
+if __name__ == "__main__":
+    unittest.main()
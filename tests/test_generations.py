@@ -0,0 +1,45 @@
+import errno
+import unittest
+
+import pyfuse3
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, get_inode_count, remove_file, restore_inodes
+
+
+class GenerationTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        self.url = self.origin.add("/data.bin", b"hello")
+
+    def node(self, path):
+        attr = self.fs.lookup(path)
+        return attr.st_ino, attr.generation
+
+    def test_re_added_file_gets_a_new_node(self):
+        add_file("data.bin", self.url)
+        inode, generation = self.node("data.bin")
+        remove_file("data.bin")
+        add_file("data.bin", self.url)
+        new_inode, new_generation = self.node("data.bin")
+        # Inode numbers are never recycled, so the old handle names nothing
+        self.assertNotEqual(new_inode, inode)
+        self.assertNotEqual((new_inode, new_generation), (inode, generation))
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs._run(self.fs.ops.getattr, inode, self.fs.ctx)
+        self.assertEqual(cm.exception.errno, errno.ENOENT)
+
+    def test_restored_generation_is_bumped(self):
+        # A persisted map knew the inode about to be handed out, at generation 3
+        inode = get_inode_count() + 1
+        restore_inodes({}, 0, {inode: 3})
+        add_file("data.bin", self.url)
+        self.assertEqual(self.node("data.bin"), (inode, 4))
+
+
+if __name__ == "__main__":
+    unittest.main()
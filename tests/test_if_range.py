@@ -0,0 +1,50 @@
+import errno
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import cache_config, client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class IfRangeTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for config, field, value in (
+            (cache_config, "chunk_size", 1024),
+            (cache_config, "readahead", 0),
+            (client_config, "max_attempts", 1),
+        ):
+            patcher = mock.patch.object(config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        add_file("data.bin", self.origin.add("/data.bin", b"a" * 4096))
+
+    def test_ranges_carry_the_cached_etag(self):
+        etag = self.origin.files["/data.bin"][2]["ETag"]
+        self.assertEqual(self.fs.read("data.bin", 0, 1024), b"a" * 1024)
+        self.assertEqual(self.fs.read("data.bin", 1024, 1024), b"a" * 1024)
+        gets = self.origin.requests_for("/data.bin", "GET")
+        self.assertEqual([get[2]["If-Range"] for get in gets], [etag, etag])
+
+    def test_change_mid_stream_drops_cached_blocks(self):
+        self.assertEqual(self.fs.read("data.bin", 0, 1024), b"a" * 1024)
+        # Replaced between two chunk requests: the If-Range fails and the
+        # origin answers the next range with the whole new body
+        self.origin.add("/data.bin", b"b" * 4096)
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("data.bin", 1024, 1024)
+        self.assertEqual(cm.exception.errno, errno.EIO)
+
+        # The old version's first block went with it; no read mixes the two
+        self.assertEqual(self.fs.read("data.bin"), b"b" * 4096)
+
+
+if __name__ == "__main__":
+    unittest.main()
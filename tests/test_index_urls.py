@@ -0,0 +1,75 @@
+import json
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from config.settings import client_config, mount_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import get_url
+from utils.file_utils import url_filename
+from utils.manifest_utils import load_manifest
+
+PAGE = b"<html>listing</html>"
+
+
+class UrlFilenameTest(unittest.TestCase):
+    def test_names(self):
+        cases = {
+            "https://host/dir/file.txt": "file.txt",
+            "https://host/dir/caf%C3%A9.txt": "café.txt",
+            "https://host/dir/": "index.html",
+            "https://host/": "index.html",
+            "https://host": "index.html",
+        }
+        for url, name in cases.items():
+            with self.subTest(url=url):
+                self.assertEqual(url_filename(url), name)
+
+    def test_index_name_is_configurable(self):
+        with mock.patch.object(mount_config, "index_name", "default.htm"):
+            self.assertEqual(url_filename("https://host/dir/"), "default.htm")
+
+
+class IndexUrlTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        self.url = self.origin.add("/dir/", PAGE)
+        self.dir = tempfile.TemporaryDirectory()
+        self.addCleanup(self.dir.cleanup)
+
+    def load(self, entries):
+        path = os.path.join(self.dir.name, "manifest.json")
+        with open(path, "w") as f:
+            json.dump(entries, f)
+        load_manifest(path)
+
+    def test_unnamed_index_url_becomes_index_html(self):
+        self.load([{"url": self.url}])
+        self.assertEqual(get_url("index.html"), self.url)
+        self.assertEqual(self.fs.getattr("index.html").st_size, len(PAGE))
+        self.assertEqual(self.fs.read("index.html"), PAGE)
+        # Stat'ed with a ranged GET rather than HEAD
+        self.assertEqual(self.origin.requests_for("/dir/", "HEAD"), [])
+        probe = self.origin.requests_for("/dir/", "GET")[0]
+        self.assertEqual(probe[2]["Range"], "bytes=0-0")
+
+    def test_index_url_under_a_name(self):
+        self.load([{"name": "docs/listing.html", "url": self.url}])
+        self.assertEqual(self.fs.read("docs/listing.html"), PAGE)
+
+    def test_head_index_urls(self):
+        patcher = mock.patch.object(client_config, "head_index_urls", True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.load([{"url": self.url}])
+        self.assertEqual(self.fs.getattr("index.html").st_size, len(PAGE))
+        self.assertEqual(len(self.origin.requests_for("/dir/", "HEAD")), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
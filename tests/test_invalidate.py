@@ -0,0 +1,39 @@
+import unittest
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class InvalidateTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        add_file("data.bin", self.origin.add("/data.bin", b"old contents"))
+
+    def test_serves_the_new_contents(self):
+        self.assertEqual(self.fs.read("data.bin"), b"old contents")
+        self.origin.add("/data.bin", b"new contents, longer")
+        # Cached, so the change isn't seen yet
+        self.assertEqual(self.fs.read("data.bin"), b"old contents")
+        self.fs.ops.invalidate("data.bin")
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 20)
+        self.assertEqual(self.fs.read("data.bin"), b"new contents, longer")
+
+    def test_refresh_fetches_right_away(self):
+        self.fs.read("data.bin")
+        self.origin.add("/data.bin", b"new contents")
+        self.assertIsNone(self.fs.ops.invalidate("data.bin", refresh=True))
+        gets = len(self.origin.requests_for("/data.bin", "GET"))
+        self.assertEqual(self.fs.read("data.bin"), b"new contents")
+        self.assertEqual(len(self.origin.requests_for("/data.bin", "GET")), gets)
+
+    def test_unknown_file(self):
+        with self.assertRaises(FileNotFoundError):
+            self.fs.ops.invalidate("missing.bin")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,62 @@
+import socket
+import unittest
+from unittest import mock
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from shared.requests import host_slots
+from utils.fetch_utils import host_key
+
+
+def has_ipv6_loopback():
+    try:
+        with socket.socket(socket.AF_INET6) as sock:
+            sock.bind(("::1", 0))
+    except OSError:
+        return False
+    return True
+
+
+class HostKeyTest(unittest.TestCase):
+    def test_ports_are_explicit(self):
+        self.assertEqual(host_key("http://example.com/a"), "example.com:80")
+        self.assertEqual(host_key("https://example.com/a"), "example.com:443")
+        self.assertEqual(host_key("http://user@EXAMPLE.com:80/a"), "example.com:80")
+        self.assertEqual(host_key("http://example.com:8443/a"), "example.com:8443")
+
+    def test_ipv6_literals_stay_bracketed(self):
+        self.assertEqual(
+            host_key("http://[2001:DB8::1]:8443/file"), "[2001:db8::1]:8443"
+        )
+        self.assertEqual(host_key("https://[::1]/file"), "[::1]:443")
+
+
+@unittest.skipUnless(has_ipv6_loopback(), "no IPv6 loopback")
+class IPv6OriginTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin("::1").start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        patcher = mock.patch.object(client_config, "max_conns_per_host", 4)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_reads_over_ipv6(self):
+        url = self.origin.add("/data.bin", b"over v6")
+        self.assertTrue(url.startswith("http://[::1]:"))
+        add_file("data.bin", url)
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 7)
+        self.assertEqual(self.fs.read("data.bin"), b"over v6")
+
+        port = self.origin.server.server_address[1]
+        for _, _, headers in self.origin.requests_for("/data.bin"):
+            self.assertEqual(headers["Host"], f"[::1]:{port}")
+        # Per-host limits are keyed on the bracketed host and its port
+        self.assertIn(f"[::1]:{port}", host_slots)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,44 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin, Zeros
+from shared.files import add_file
+
+GiB = 1 << 30
+MiB = 1 << 20
+
+
+class LargeFileTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for field, value in (("chunk_size", MiB), ("readahead", 0)):
+            patcher = mock.patch.object(cache_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_size_past_4_gib_is_reported_whole(self):
+        url = self.origin.add("/big.bin", headers={"Content-Length": "5368709120"})
+        add_file("big.bin", url)
+        self.assertEqual(self.fs.getattr("big.bin").st_size, 5368709120)
+
+    def test_read_at_5_gib_asks_for_that_range(self):
+        add_file("big.bin", self.origin.add("/big.bin", Zeros(6 * GiB)))
+        self.assertEqual(self.fs.getattr("big.bin").st_size, 6 * GiB)
+        self.assertEqual(self.fs.read("big.bin", 5 * GiB, 4096), bytes(4096))
+        (get,) = self.origin.requests_for("/big.bin", "GET")
+        self.assertEqual(get[2]["Range"], f"bytes={5 * GiB}-{5 * GiB + MiB - 1}")
+
+    def test_last_chunk_of_a_5_gib_file(self):
+        add_file("big.bin", self.origin.add("/big.bin", Zeros(5 * GiB + 100)))
+        self.assertEqual(self.fs.read("big.bin", 5 * GiB, 4096), bytes(100))
+        (get,) = self.origin.requests_for("/big.bin", "GET")
+        self.assertEqual(get[2]["Range"], f"bytes={5 * GiB}-{5 * GiB + 99}")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,40 @@
+import stat
+import unittest
+
+from config.constants import INDEX_FILE
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, list_files
+
+
+class ListFilesTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for name in ("zebra.bin", "apple.bin", "mango.bin"):
+            add_file(name, self.origin.add(f"/{name}", name.encode()))
+
+    def test_sorted_snapshot(self):
+        names = list_files()
+        self.assertEqual(names, ["apple.bin", "mango.bin", "zebra.bin"])
+        # A snapshot: later changes to the store don't show up in it
+        add_file("banana.bin", self.origin.add("/banana.bin"))
+        self.assertEqual(len(names), 3)
+
+    def test_readdir_lists_the_store(self):
+        entries = self.fs.listdir()
+        self.assertEqual(
+            [name for name, _ in entries],
+            [INDEX_FILE, "apple.bin", "mango.bin", "zebra.bin"],
+        )
+        for name, attr in entries[1:]:
+            with self.subTest(name=name):
+                self.assertTrue(stat.S_ISREG(attr.st_mode))
+                self.assertEqual(attr.st_ino, self.fs.inode(name))
+                self.assertEqual(attr.st_size, len(name))
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,32 @@
+import unittest
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+
+class LookupTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        add_file("dir/data.bin", self.origin.add("/data.bin", b"hello"))
+
+    def test_resolves_a_node_by_its_id(self):
+        # How the kernel resolves an NFS file handle: "." of the handle's inode
+        attr = self.fs.lookup("dir/data.bin")
+        again = self.fs._run(self.fs.ops.lookup, attr.st_ino, b".", self.fs.ctx)
+        self.assertEqual(
+            (again.st_ino, again.generation), (attr.st_ino, attr.generation)
+        )
+        self.assertEqual(again.st_size, 5)
+
+    def test_resolves_a_directory_by_its_id(self):
+        attr = self.fs.lookup("dir")
+        again = self.fs._run(self.fs.ops.lookup, attr.st_ino, b".", self.fs.ctx)
+        self.assertEqual(again.st_ino, attr.st_ino)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,111 @@
+import json
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+from config.settings import mount_config
+from filesystemtest.filesystem import reset
+from shared.files import get_symlink, get_url
+from utils.manifest_utils import load_manifest, parse_manifest, validate_entries
+
+FIXTURE = os.path.join(os.path.dirname(__file__), "fixtures", "manifest.json")
+
+
+class ManifestTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.dir = tempfile.TemporaryDirectory()
+        self.addCleanup(self.dir.cleanup)
+
+    def write(self, entries):
+        path = os.path.join(self.dir.name, "manifest.json")
+        with open(path, "w") as f:
+            json.dump(entries, f)
+        return path
+
+    def test_fixture_parses(self):
+        entries = parse_manifest(FIXTURE)
+        self.assertEqual(len(entries), 13)
+        self.assertEqual(entries[0]["name"], "BigBuckBunny.mp4")
+
+    def test_fixture_loads_once(self):
+        self.assertEqual(load_manifest(FIXTURE), 13)
+        self.assertEqual(
+            get_url("Sintel.mp4"),
+            "http://commondatastorage.googleapis.com/gtv-videos-bucket/sample/"
+            "Sintel.mp4",
+        )
+        # Reloading adds only what's new
+        self.assertEqual(load_manifest(FIXTURE), 0)
+
+    def test_symlink_entries_are_added(self):
+        path = self.write(
+            [
+                {"name": "a.bin", "url": "http://example.com/a.bin"},
+                {"type": "symlink", "name": "latest", "target": "a.bin"},
+            ]
+        )
+        self.assertEqual(load_manifest(path), 2)
+        self.assertEqual(get_symlink("latest"), "a.bin")
+
+    def test_rejects_duplicate_names(self):
+        entries = [
+            {"name": "a.bin", "url": "http://example.com/a.bin"},
+            {"name": "a.bin", "url": "http://example.com/b.bin"},
+        ]
+        with self.assertRaisesRegex(ValueError, "entry 1 duplicates name 'a.bin'"):
+            validate_entries(entries, "test")
+
+    def test_rejects_duplicate_derived_names(self):
+        patcher = mock.patch.object(mount_config, "name_collisions", "error")
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        entries = [
+            {"url": "http://example.com/one/a.bin"},
+            {"url": "http://example.com/two/a.bin"},
+        ]
+        with self.assertRaisesRegex(ValueError, "derived from its URL"):
+            validate_entries(entries, "test")
+
+    def test_rejects_bad_urls(self):
+        for url in ("ftp://example.com/a.bin", "http://", "http://[::1/a", 7):
+            with self.subTest(url=url):
+                with self.assertRaisesRegex(ValueError, "has invalid URL"):
+                    validate_entries([{"name": "a.bin", "url": url}], "test")
+
+    def test_rejects_bad_mirrors(self):
+        entries = [
+            {
+                "name": "a.bin",
+                "url": "http://example.com/a.bin",
+                "mirrors": ["not a url"],
+            }
+        ]
+        with self.assertRaisesRegex(ValueError, "has invalid mirrors"):
+            validate_entries(entries, "test")
+
+    def test_rejects_symlink_escapes(self):
+        for target in ("/etc/passwd", "../outside", "dir/../../outside"):
+            with self.subTest(target=target):
+                entries = [{"type": "symlink", "name": "link", "target": target}]
+                with self.assertRaisesRegex(ValueError, "leads out of the mount"):
+                    validate_entries(entries, "test")
+
+    def test_unsafe_symlinks_allows_escapes(self):
+        patcher = mock.patch.object(mount_config, "unsafe_symlinks", True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        entries = [{"type": "symlink", "name": "link", "target": "/etc/passwd"}]
+        self.assertEqual(validate_entries(entries, "test"), entries)
+
+    def test_invalid_file_names_the_path(self):
+        path = self.write({"name": "a.bin"})
+        with self.assertRaisesRegex(ValueError, "manifest must be a JSON array"):
+            parse_manifest(path)
+        with self.assertRaisesRegex(ValueError, path):
+            load_manifest(path)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,64 @@
+import stat
+import unittest
+from email.utils import formatdate
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.file_utils import STARTED_NS
+
+# path -> Last-Modified, in seconds since the epoch
+TREE = {
+    "top.bin": 1_600_000_000,
+    "a/one.bin": 1_600_000_100,
+    "a/b/c/two.bin": 1_600_000_500,
+    "a/d/three.bin": 1_600_000_200,
+    "g/four.bin": 1_600_000_300,
+}
+
+
+class NestedDirsTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for path, mtime in TREE.items():
+            headers = {"Last-Modified": formatdate(mtime, usegmt=True)}
+            add_file(path, self.origin.add(f"/{path}", b"x", headers=headers))
+
+    def test_link_counts(self):
+        expected = {"": 4, "a": 4, "a/b": 3, "a/b/c": 2, "a/d": 2, "g": 2}
+        for path, nlink in expected.items():
+            with self.subTest(path=path):
+                attr = self.fs.lookup(path)
+                self.assertTrue(stat.S_ISDIR(attr.st_mode))
+                self.assertEqual(attr.st_nlink, nlink)
+
+    def test_inodes_are_stable_and_distinct(self):
+        dirs = ["", "a", "a/b", "a/b/c", "a/d", "g"]
+        inodes = [self.fs.inode(path) for path in dirs]
+        self.assertEqual(len(set(inodes)), len(dirs))
+        self.assertEqual([self.fs.inode(path) for path in dirs], inodes)
+        # Listing the parent reports the same inode as looking it up
+        listed = dict(self.fs.listdir("a"))
+        self.assertEqual(listed["b"].st_ino, self.fs.inode("a/b"))
+        self.assertEqual(listed["b"].st_nlink, 3)
+
+    def test_mtime_is_the_latest_known_below(self):
+        self.assertEqual(self.fs.lookup("a").st_mtime_ns, STARTED_NS)
+        for path in TREE:
+            self.fs.getattr(path)
+        expected = {
+            "a": 1_600_000_500,
+            "a/b": 1_600_000_500,
+            "a/d": 1_600_000_200,
+            "g": 1_600_000_300,
+        }
+        for path, mtime in expected.items():
+            with self.subTest(path=path):
+                self.assertEqual(self.fs.lookup(path).st_mtime_ns, mtime * 10**9)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,91 @@
+import os
+import threading
+import unittest
+from unittest import mock
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file, get_entry
+from shared.requests import full_downloads
+from utils.fetch_utils import start_full_download
+from utils.file_utils import open_count
+
+
+class OpenCountTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        add_file("data.bin", self.origin.add("/data.bin", b"d" * 4096))
+        self.inode = self.fs.inode("data.bin")
+        # Hold the on-demand download open until the test lets it go, so its
+        # cancellation is what the releases decide
+        self.finish = threading.Event()
+        self.addCleanup(self.finish.set)
+        patcher = mock.patch(
+            "utils.fetch_utils.download_whole",
+            lambda inode, entry, state: self.finish.wait(),
+        )
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.addCleanup(full_downloads.clear)
+
+    def open(self):
+        return self.fs._run(self.fs.ops.open, self.inode, os.O_RDONLY, self.fs.ctx).fh
+
+    def release(self, fh):
+        self.fs._run(self.fs.ops.release, fh)
+
+    def start_download(self):
+        start_full_download(self.inode, get_entry("data.bin"), 4096, on_demand=True)
+        return full_downloads[self.inode]
+
+    def test_download_survives_until_last_release(self):
+        first, second, third = self.open(), self.open(), self.open()
+        state = self.start_download()
+        self.assertEqual(open_count(self.inode), 3)
+
+        self.release(second)
+        self.assertEqual(open_count(self.inode), 2)
+        fourth = self.open()
+        self.release(first)
+        self.release(third)
+        self.assertEqual(open_count(self.inode), 1)
+        self.assertFalse(state["cancel"].is_set())
+
+        self.release(fourth)
+        self.assertEqual(open_count(self.inode), 0)
+        self.assertTrue(state["cancel"].is_set())
+
+    def test_concurrent_releases_cancel_once_all_are_gone(self):
+        handles = [self.open() for _ in range(8)]
+        state = self.start_download()
+        keep = handles.pop()
+        threads = [
+            threading.Thread(target=self.release, args=(fh,)) for fh in handles
+        ]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+        self.assertEqual(open_count(self.inode), 1)
+        self.assertFalse(state["cancel"].is_set())
+
+        self.release(keep)
+        self.assertEqual(open_count(self.inode), 0)
+        self.assertTrue(state["cancel"].is_set())
+
+    def test_releasing_twice_does_not_drop_another_handle(self):
+        first, second = self.open(), self.open()
+        state = self.start_download()
+        self.release(first)
+        self.release(first)
+        self.assertEqual(open_count(self.inode), 1)
+        self.assertFalse(state["cancel"].is_set())
+        self.release(second)
+        self.assertTrue(state["cancel"].is_set())
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,64 @@
+import socket
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.constants import LAST_ERROR_XATTR, LAST_STATUS_XATTR
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.file_utils import prefetch_attrs
+
+
+def closed_port():
+    with socket.socket() as sock:
+        sock.bind(("127.0.0.1", 0))
+        return sock.getsockname()[1]
+
+
+class PartialListingTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        patcher = mock.patch.object(client_config, "max_attempts", 1)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        add_file("up.bin", self.origin.add("/up.bin", b"reachable"))
+        add_file("broken.bin", self.origin.add("/broken.bin", status=500))
+        add_file("down.bin", f"http://127.0.0.1:{closed_port()}/down.bin")
+
+    def test_every_file_is_listed(self):
+        failures = prefetch_attrs()
+        self.assertEqual(set(failures), {"broken.bin", "down.bin"})
+
+        sizes = {name: attr.st_size for name, attr in self.fs.listdir()[1:]}
+        self.assertEqual(sizes, {"broken.bin": 0, "down.bin": 0, "up.bin": 9})
+
+    def test_errors_are_in_xattrs(self):
+        self.fs.listdir()
+
+        def xattr(path, name):
+            inode = self.fs.inode(path)
+            return self.fs._run(self.fs.ops.getxattr, inode, name, self.fs.ctx)
+
+        self.assertEqual(xattr("broken.bin", LAST_STATUS_XATTR), b"500")
+        self.assertIn(b"500", xattr("broken.bin", LAST_ERROR_XATTR))
+        self.assertIn(b"failed", xattr("down.bin", LAST_ERROR_XATTR))
+        with self.assertRaises(pyfuse3.FUSEError):
+            xattr("up.bin", LAST_ERROR_XATTR)
+
+    def test_only_reads_of_failing_files_fail(self):
+        self.fs.listdir()
+        self.assertEqual(self.fs.read("up.bin"), b"reachable")
+        for path in ("broken.bin", "down.bin"):
+            with self.subTest(path=path):
+                with self.assertRaises(pyfuse3.FUSEError):
+                    self.fs.read(path)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,66 @@
+import os
+import unittest
+from unittest import mock
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+# Only reachable through the proxy, which serves it by absolute URL
+REMOTE_URL = "http://files.test/data.bin"
+PROXY_VARIABLES = ("HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY")
+
+
+class ProxyTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.proxy = Origin().start()
+        self.addCleanup(self.proxy.close)
+        self.proxy.add(REMOTE_URL, b"through the proxy")
+        self.fs = FileSystem()
+        environ = {
+            name: value
+            for name, value in os.environ.items()
+            if name.upper() not in PROXY_VARIABLES
+        }
+        patcher = mock.patch.dict(os.environ, environ, clear=True)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def set_proxy(self, proxy):
+        patcher = mock.patch.object(client_config, "proxy", proxy)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def assert_proxied(self):
+        add_file("data.bin", REMOTE_URL)
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 17)
+        self.assertEqual(self.fs.read("data.bin", 4, 5), b"ugh t")
+        self.assertTrue(self.proxy.requests_for(REMOTE_URL, "HEAD"))
+        (get,) = self.proxy.requests_for(REMOTE_URL, "GET")
+        self.assertIn("Range", get[2])
+
+    def test_environment_proxy(self):
+        os.environ["HTTP_PROXY"] = self.proxy.url("")
+        self.assert_proxied()
+
+    def test_explicit_proxy_overrides_environment(self):
+        # Nothing listens on port 9 (discard); using it would fail every request
+        os.environ["HTTP_PROXY"] = "http://127.0.0.1:9"
+        os.environ["NO_PROXY"] = "files.test"
+        self.set_proxy(self.proxy.url(""))
+        self.assert_proxied()
+
+    def test_no_proxy_goes_direct(self):
+        origin = Origin().start()
+        self.addCleanup(origin.close)
+        add_file("direct.bin", origin.add("/direct.bin", b"direct"))
+        os.environ["HTTP_PROXY"] = self.proxy.url("")
+        os.environ["NO_PROXY"] = "127.0.0.1"
+        self.assertEqual(self.fs.read("direct.bin"), b"direct")
+        self.assertEqual(self.proxy.requests, [])
+
+
+if __name__ == "__main__":
+    unittest.main()
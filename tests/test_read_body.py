@@ -0,0 +1,41 @@
+import errno
+import io
+import math
+import unittest
+
+import requests
+
+from utils.fetch_utils import FetchError, read_body
+
+
+def make_response(body, content_length):
+    response = requests.Response()
+    response.status_code = 200
+    response.url = "http://origin.test/data.bin"
+    response.headers["Content-Length"] = content_length
+    response.raw = io.BytesIO(body)
+    response.deadline = math.inf
+    return response
+
+
+class ReadBodyTest(unittest.TestCase):
+    def test_unparsable_length_is_ignored(self):
+        # urllib3 accepts repeated identical values, joined with ", "
+        for content_length in ("1000, 1000", "abc"):
+            with self.subTest(content_length=content_length):
+                response = make_response(b"x" * 1000, content_length)
+                self.assertEqual(read_body(response, limit=4096), b"x" * 1000)
+
+    def test_limit_still_applies_to_the_body(self):
+        with self.assertRaises(FetchError) as cm:
+            read_body(make_response(b"x" * 1000, "abc"), limit=100)
+        self.assertEqual(cm.exception.errno, errno.EFBIG)
+
+    def test_declared_length_over_limit(self):
+        with self.assertRaises(FetchError) as cm:
+            read_body(make_response(b"x" * 1000, "1000"), limit=100)
+        self.assertEqual(cm.exception.errno, errno.EFBIG)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,59 @@
+import errno
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.fetch_utils import FetchError, RedirectLoop, send_request
+
+
+class RedirectLoopTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        patcher = mock.patch.object(client_config, "max_redirects", 5)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def redirect(self, path, to):
+        return self.origin.add(path, status=302, headers={"Location": to})
+
+    def test_ping_pong_is_a_loop(self):
+        url = self.redirect("/a", "/b")
+        self.redirect("/b", "/a")
+        with self.assertRaises(RedirectLoop) as cm:
+            send_request("GET", url)
+        self.assertEqual(cm.exception.errno, errno.EIO)
+        # Caught on coming back to /a, well before the hop limit
+        self.assertEqual(len(self.origin.requests_for("/a")), 1)
+        self.assertEqual(len(self.origin.requests_for("/b")), 1)
+
+        add_file("loop.bin", url)
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.getattr("loop.bin")
+        self.assertEqual(cm.exception.errno, errno.EIO)
+
+    def test_long_chain_is_not_a_loop(self):
+        for hop in range(7):
+            self.redirect(f"/{hop}", f"/{hop + 1}")
+        with self.assertRaises(FetchError) as cm:
+            send_request("GET", self.origin.url("/0"))
+        self.assertNotIsInstance(cm.exception, RedirectLoop)
+        self.assertIn("too many redirects", str(cm.exception))
+
+    def test_chain_within_the_limit_is_followed(self):
+        for hop in range(4):
+            self.redirect(f"/{hop}", f"/{hop + 1}")
+        self.origin.add("/4", b"arrived")
+        add_file("chain.bin", self.origin.url("/0"))
+        self.assertEqual(self.fs.read("chain.bin"), b"arrived")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,62 @@
+import errno
+import os
+import threading
+import time
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+# One chunk, which the origin takes over five seconds to send. Cancellation
+# is noticed between the 64 KiB parts the body is read in, a third of a
+# second apart at this pace.
+SIZE = 1024 * 1024
+PACE = 0.005
+
+
+class ReleaseCancelsTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for field, value in (("chunk_size", SIZE), ("readahead", 0)):
+            patcher = mock.patch.object(cache_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        add_file("slow.bin", self.origin.add("/slow.bin", b"s" * SIZE, pace=PACE))
+
+    def test_release_aborts_a_slow_read(self):
+        inode = self.fs.inode("slow.bin")
+        fh = self.fs._run(self.fs.ops.open, inode, os.O_RDONLY, self.fs.ctx).fh
+        outcome = {}
+
+        def read():
+            try:
+                outcome["data"] = self.fs._run(self.fs.ops.read, fh, 0, SIZE)
+            except pyfuse3.FUSEError as e:
+                outcome["errno"] = e.errno
+
+        reader = threading.Thread(target=read)
+        reader.start()
+        deadline = time.monotonic() + 5
+        while not self.origin.requests_for("/slow.bin", "GET"):
+            self.assertLess(time.monotonic(), deadline)
+            time.sleep(0.01)
+        time.sleep(0.5)
+
+        released_at = time.monotonic()
+        self.fs._run(self.fs.ops.release, fh)
+        reader.join(2)
+        self.assertFalse(reader.is_alive())
+        self.assertLess(time.monotonic() - released_at, 1)
+        self.assertEqual(outcome, {"errno": errno.EINTR})
+
+
+if __name__ == "__main__":
+    unittest.main()
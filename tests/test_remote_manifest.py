@@ -0,0 +1,88 @@
+import json
+import threading
+import time
+import unittest
+from unittest import mock
+
+import requests
+import urllib3
+
+from filesystemtest.filesystem import reset
+from filesystemtest.origin import Origin
+from shared.files import get_url
+from shared.requests import shutdown_event
+from utils.fetch_utils import FetchError, send_request
+from utils.manifest_utils import RemoteManifest
+
+
+class DroppedBody:
+    """
+    A connection that hangs up once the headers are in.
+    """
+
+    def stream(self, chunk_size, decode_content=None):
+        raise urllib3.exceptions.ProtocolError("Connection broken")
+        yield
+
+    def close(self):
+        pass
+
+
+def dropped_response(url):
+    response = requests.Response()
+    response.status_code = 200
+    response.url = url
+    response.raw = DroppedBody()
+    return response
+
+
+class RemoteManifestTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.file_url = self.origin.url("/a.bin")
+        listing = json.dumps([{"name": "a.bin", "url": self.file_url}])
+        self.url = self.origin.add("/manifest.json", listing.encode())
+        self.drops = 0
+
+    def send_request(self, method, url, *args, **kwargs):
+        # Drops the body `self.drops` times before letting requests through
+        if self.drops > 0:
+            self.drops -= 1
+            return dropped_response(url)
+        return send_request(method, url, *args, **kwargs)
+
+    def patch_send_request(self):
+        patcher = mock.patch("utils.manifest_utils.send_request", self.send_request)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_dropped_body_is_a_fetch_error(self):
+        self.patch_send_request()
+        self.drops = 1
+        with self.assertRaises(FetchError) as cm:
+            RemoteManifest(self.url).sync()
+        self.assertTrue(cm.exception.retryable)
+        self.assertIsNone(get_url("a.bin"))
+
+    def test_watch_outlives_a_dropped_body(self):
+        self.patch_send_request()
+        self.drops = 2
+        watcher = threading.Thread(
+            target=RemoteManifest(self.url).watch, args=(0.01,), daemon=True
+        )
+        watcher.start()
+        self.addCleanup(shutdown_event.clear)
+        self.addCleanup(watcher.join, 5)
+        self.addCleanup(shutdown_event.set)
+
+        deadline = time.monotonic() + 5
+        while get_url("a.bin") is None and time.monotonic() < deadline:
+            time.sleep(0.01)
+        self.assertEqual(get_url("a.bin"), self.file_url)
+        self.assertTrue(watcher.is_alive())
+
+
+if __name__ == "__main__":
+    unittest.main()
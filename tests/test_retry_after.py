@@ -0,0 +1,80 @@
+import errno
+import time
+import unittest
+from email.utils import formatdate
+from unittest import mock
+
+from config.settings import client_config
+from filesystemtest.filesystem import reset
+from filesystemtest.origin import Origin
+from shared.requests import host_cooldowns
+from utils.fetch_utils import FetchError, host_key, send_request
+
+
+class Shutdown:
+    """
+    Stands in for shutdown_event, recording each wait instead of sleeping.
+    """
+
+    def __init__(self):
+        self.waits = []
+
+    def wait(self, timeout=None):
+        self.waits.append(timeout)
+        return False
+
+    def is_set(self):
+        return False
+
+
+class RetryAfterTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.shutdown = Shutdown()
+        patcher = mock.patch("utils.fetch_utils.shutdown_event", self.shutdown)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        for field, value in (
+            ("max_attempts", 2),
+            ("request_timeout", 60),
+            ("retry_backoff", 0.25),
+            ("retry_jitter", 0),
+        ):
+            patcher = mock.patch.object(client_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def fetch(self, headers=None):
+        url = self.origin.add("/busy", status=503, headers=headers)
+        with send_request("GET", url) as response:
+            self.assertEqual(response.status_code, 503)
+        self.assertEqual(len(self.origin.requests_for("/busy")), 2)
+        return url
+
+    def test_503_with_retry_after_seconds(self):
+        url = self.fetch({"Retry-After": "7"})
+        self.assertEqual(self.shutdown.waits[0], 7)
+        # Other requests to the host hold off too
+        self.assertIn(host_key(url), host_cooldowns)
+
+    def test_503_with_retry_after_date(self):
+        self.fetch({"Retry-After": formatdate(time.time() + 20, usegmt=True)})
+        self.assertAlmostEqual(self.shutdown.waits[0], 20, delta=1.5)
+
+    def test_503_without_retry_after_backs_off(self):
+        url = self.fetch()
+        self.assertEqual(self.shutdown.waits, [0.25])
+        self.assertNotIn(host_key(url), host_cooldowns)
+
+    def test_retry_after_past_the_timeout_fails(self):
+        url = self.origin.add("/busy", status=503, headers={"Retry-After": "3600"})
+        with self.assertRaises(FetchError) as cm:
+            send_request("GET", url)
+        self.assertEqual(cm.exception.errno, errno.ETIMEDOUT)
+        self.assertEqual(self.shutdown.waits, [])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,50 @@
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+# Kept across the replacement, as by an origin whose validators don't notice
+VALIDATORS = {"ETag": '"v1"', "Last-Modified": "Wed, 14 Oct 2026 00:00:00 GMT"}
+
+
+class ShrinkingFileTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for field, value in (("chunk_size", 1024), ("readahead", 0)):
+            patcher = mock.patch.object(cache_config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        add_file("data.bin", self.serve(b"a" * 4096))
+
+    def serve(self, body):
+        return self.origin.add("/data.bin", body, headers=VALIDATORS)
+
+    def test_range_response_reports_the_new_size(self):
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 4096)
+        self.assertEqual(self.fs.read("data.bin", 0, 1024), b"a" * 1024)
+        self.assertEqual(self.fs.read("data.bin", 3072, 1024), b"a" * 1024)
+
+        self.serve(b"b" * 2048)
+        # The first uncached chunk's Content-Range gives the new total away
+        self.assertEqual(self.fs.read("data.bin", 1024, 1024), b"b" * 1024)
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 2048)
+        # Neither stale blocks nor an error past the new end of file
+        self.assertEqual(self.fs.read("data.bin", 3072, 1024), b"")
+        self.assertEqual(self.fs.read("data.bin"), b"b" * 2048)
+
+    def test_range_past_the_new_end_reads_empty(self):
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 4096)
+        self.serve(b"b" * 2048)
+        # Answered with a 416 naming the new size
+        self.assertEqual(self.fs.read("data.bin", 3072, 1024), b"")
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 2048)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,50 @@
+import errno
+import time
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import cache_config, client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+
+SIZE = 16 * 1024
+
+
+class StallTimeoutTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        for config, field, value in (
+            (client_config, "stall_timeout", 0.5),
+            (client_config, "max_attempts", 1),
+            (cache_config, "readahead", 0),
+        ):
+            patcher = mock.patch.object(config, field, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_stalled_body_fails_with_eio(self):
+        # A KiB, then nothing for far longer than the stall timeout
+        add_file("stuck.bin", self.origin.add("/stuck.bin", b"s" * SIZE, pace=30))
+        self.fs.getattr("stuck.bin")
+        started = time.monotonic()
+        with self.assertRaises(pyfuse3.FUSEError) as cm:
+            self.fs.read("stuck.bin", 0, SIZE)
+        self.assertEqual(cm.exception.errno, errno.EIO)
+        self.assertLess(time.monotonic() - started, 5)
+
+    def test_slow_steady_body_completes(self):
+        # Takes longer than the stall timeout in all, but bytes keep coming
+        add_file("slow.bin", self.origin.add("/slow.bin", b"s" * SIZE, pace=0.05))
+        started = time.monotonic()
+        self.assertEqual(self.fs.read("slow.bin", 0, SIZE), b"s" * SIZE)
+        self.assertGreater(time.monotonic() - started, 0.5)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,76 @@
+import errno
+import unittest
+from unittest import mock
+
+import pyfuse3
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.fetch_utils import status_to_errno
+
+MAPPING = {
+    401: errno.EACCES,
+    403: errno.EACCES,
+    404: errno.ENOENT,
+    410: errno.ENOENT,
+    416: errno.EINVAL,
+    500: errno.EIO,
+    502: errno.EIO,
+    503: errno.EIO,
+}
+
+
+class StatusErrnoTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        # 5xx would otherwise be retried with backoff
+        patcher = mock.patch.object(client_config, "max_attempts", 1)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_mapping(self):
+        for status, expected in MAPPING.items():
+            with self.subTest(status=status):
+                self.assertEqual(status_to_errno(status), expected)
+
+    def test_head_path(self):
+        for status, expected in MAPPING.items():
+            if status >= 500:
+                continue
+            with self.subTest(status=status):
+                reset()
+                add_file("data.bin", self.origin.add("/data.bin", status=status))
+                with self.assertRaises(pyfuse3.FUSEError) as cm:
+                    self.fs.getattr("data.bin")
+                self.assertEqual(cm.exception.errno, expected)
+
+    def test_get_path(self):
+        for status, expected in MAPPING.items():
+            with self.subTest(status=status):
+                reset()
+                add_file("data.bin", self.origin.add("/data.bin", b"data"))
+                self.assertEqual(self.fs.getattr("data.bin").st_size, 4)
+                self.origin.add("/data.bin", status=status)
+                with self.assertRaises(pyfuse3.FUSEError) as cm:
+                    self.fs.read("data.bin")
+                self.assertEqual(cm.exception.errno, expected)
+
+    def test_server_errors_fail_reads_only(self):
+        for status in (500, 502, 503):
+            with self.subTest(status=status):
+                reset()
+                add_file("data.bin", self.origin.add("/data.bin", status=status))
+                # An origin being down still lets the file stat
+                self.fs.getattr("data.bin")
+                with self.assertRaises(pyfuse3.FUSEError) as cm:
+                    self.fs.read("data.bin")
+                self.assertEqual(cm.exception.errno, errno.EIO)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,79 @@
+import json
+import os
+import posixpath
+import stat
+import tempfile
+import unittest
+
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_symlink
+from utils.manifest_utils import load_manifest
+
+
+class SymlinkTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        directory = tempfile.TemporaryDirectory()
+        self.addCleanup(directory.cleanup)
+        path = os.path.join(directory.name, "manifest.json")
+        with open(path, "w") as f:
+            json.dump(
+                [
+                    {
+                        "name": "releases/v2.bin",
+                        "url": self.origin.add("/v2.bin", b"version two"),
+                    },
+                    {"type": "symlink", "name": "latest", "target": "releases/v2.bin"},
+                    {"type": "symlink", "name": "docs/current", "target": "../latest"},
+                ],
+                f,
+            )
+        load_manifest(path)
+
+    def resolve(self, path):
+        # What the kernel does with readlink's answer
+        for _ in range(8):
+            attr = self.fs.lookup(path)
+            if not stat.S_ISLNK(attr.st_mode):
+                return path
+            target = self.fs.readlink(path)
+            path = posixpath.normpath(posixpath.join(posixpath.dirname(path), target))
+        self.fail(f"{path}: too many levels of symlinks")
+
+    def test_lookup_and_readlink(self):
+        attr = self.fs.lookup("latest")
+        self.assertTrue(stat.S_ISLNK(attr.st_mode))
+        self.assertEqual(attr.st_size, len("releases/v2.bin"))
+        self.assertEqual(self.fs.readlink("latest"), "releases/v2.bin")
+        self.assertEqual(self.fs.readlink("docs/current"), "../latest")
+
+    def test_readdir_presents_links(self):
+        modes = {name: attr.st_mode for name, attr in self.fs.listdir()}
+        self.assertTrue(stat.S_ISLNK(modes["latest"]))
+        self.assertTrue(stat.S_ISDIR(modes["releases"]))
+        ((name, attr),) = self.fs.listdir("docs")
+        self.assertEqual(name, "current")
+        self.assertTrue(stat.S_ISLNK(attr.st_mode))
+        self.assertEqual(attr.st_ino, self.fs.inode("docs/current"))
+
+    def test_links_resolve_to_the_file(self):
+        for link in ("latest", "docs/current"):
+            with self.subTest(link=link):
+                path = self.resolve(link)
+                self.assertEqual(path, "releases/v2.bin")
+                self.assertEqual(self.fs.read(path), b"version two")
+
+    def test_escaping_targets_are_refused(self):
+        with self.assertRaises(ValueError):
+            add_symlink("docs/out", "../../etc/passwd")
+        self.assertFalse(self.fs.exists("docs/out"))
+        add_symlink("docs/out", "../../etc/passwd", allow_unsafe=True)
+        self.assertEqual(self.fs.readlink("docs/out"), "../../etc/passwd")
+
+
+if __name__ == "__main__":
+    unittest.main()
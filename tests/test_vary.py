@@ -0,0 +1,60 @@
+import tempfile
+import unittest
+from unittest import mock
+
+from config.settings import cache_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.cache import disk_cache
+from shared.files import add_file, get_entry
+from utils.fetch_utils import variant_key
+
+
+class VaryTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.origin = Origin().start()
+        self.addCleanup(self.origin.close)
+        self.fs = FileSystem()
+        patcher = mock.patch.object(cache_config, "readahead", 0)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        # Memory blocks are per inode; only the disk cache is shared by URL
+        directory = tempfile.TemporaryDirectory()
+        self.addCleanup(directory.cleanup)
+        for field in ("path", "chunk_size", "max_bytes"):
+            patcher = mock.patch.object(disk_cache, field)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+        disk_cache.configure(directory.name, cache_config.chunk_size)
+
+    def add_variants(self, vary, header, values=("en", "fr")):
+        """
+        Map the same URL twice, sending `header` with each of `values`, read
+        both and return how many GETs that took.
+        """
+        url = self.origin.add("/page", b"negotiated", headers={"Vary": vary})
+        add_file("en.html", url, headers={header: values[0]})
+        add_file("fr.html", url, headers={header: values[1]})
+        for name in ("en.html", "fr.html"):
+            self.assertEqual(self.fs.read(name), b"negotiated")
+        return len(self.origin.requests_for("/page", "GET"))
+
+    def test_varying_header_splits_the_disk_cache(self):
+        self.assertEqual(self.add_variants("Accept-Language", "Accept-Language"), 2)
+        self.assertNotEqual(
+            variant_key(get_entry("en.html")), variant_key(get_entry("fr.html"))
+        )
+
+    def test_vary_accept_encoding_shares_blocks(self):
+        # Bodies are cached decoded, so the encoding can't tell variants apart
+        gets = self.add_variants("Accept-Encoding", "Accept-Encoding", ("gzip", "br"))
+        self.assertEqual(gets, 1)
+        self.assertEqual(variant_key(get_entry("en.html")), self.origin.url("/page"))
+
+    def test_other_headers_dont_split(self):
+        self.assertEqual(self.add_variants("Accept-Language", "X-Trace"), 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,64 @@
+import socket
+import stat
+import threading
+import time
+import unittest
+from unittest import mock
+
+from config.settings import client_config
+from filesystemtest.filesystem import FileSystem, reset
+from filesystemtest.origin import Origin
+from shared.files import add_file
+from utils.file_utils import wait_for_network
+
+
+def free_port():
+    with socket.socket() as sock:
+        sock.bind(("127.0.0.1", 0))
+        return sock.getsockname()[1]
+
+
+class WaitForNetworkTest(unittest.TestCase):
+    def setUp(self):
+        reset()
+        self.fs = FileSystem()
+        # Nothing listens here until start_origin
+        self.port = free_port()
+        add_file("data.bin", f"http://127.0.0.1:{self.port}/data.bin")
+        patcher = mock.patch.object(client_config, "max_attempts", 1)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def start_origin(self):
+        origin = Origin(port=self.port).start()
+        self.addCleanup(origin.close)
+        origin.add("/data.bin", b"finally up")
+        return origin
+
+    def test_waits_for_a_late_origin(self):
+        starter = threading.Timer(0.5, self.start_origin)
+        starter.start()
+        self.addCleanup(starter.cancel)
+        started = time.monotonic()
+        self.assertTrue(wait_for_network(5, 0.1))
+        self.assertGreaterEqual(time.monotonic() - started, 0.4)
+
+    def test_gives_up_after_the_timeout(self):
+        started = time.monotonic()
+        self.assertFalse(wait_for_network(0.3, 0.1))
+        self.assertLess(time.monotonic() - started, 2)
+
+    def test_files_are_presented_before_the_network(self):
+        self.assertEqual([name for name, _ in self.fs.listdir()][1:], ["data.bin"])
+        attr = self.fs.getattr("data.bin")
+        self.assertTrue(stat.S_ISREG(attr.st_mode))
+        # A stand-in the kernel mustn't keep, so the next stat asks again
+        self.assertEqual((attr.st_size, attr.attr_timeout), (0, 0))
+
+        self.start_origin()
+        self.assertEqual(self.fs.getattr("data.bin").st_size, 10)
+        self.assertEqual(self.fs.read("data.bin"), b"finally up")
+
+
+if __name__ == "__main__":
+    unittest.main()
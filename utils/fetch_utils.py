@@ -1,171 +1,2138 @@
-import asyncio
+import errno
+import hashlib
+import http.cookiejar
+import math
+import random
 import threading
 import time
+from concurrent.futures import Future, ThreadPoolExecutor
+from datetime import datetime, timezone
+from email.utils import parsedate_to_datetime
+from urllib.parse import parse_qs, urljoin, urlparse
 
-import aiohttp
 import requests
+import urllib3
+from requests.adapters import HTTPAdapter
+from requests.auth import AuthBase, HTTPBasicAuth
+from requests.structures import CaseInsensitiveDict
 
-from config.constants import DEFAULT_CHUNK_SIZE, MAX_PREFETCH_AHEAD, PREFETCH_BATCH_SIZE
-from shared.files import CACHE_LOCK, file_chunk_cache
-from shared.requests import PREFETCH_LOCK, SESSION_LOCK, prefetch_threads, sessions
+from config.settings import cache_config, client_config
+from shared.buffers import BlockBuffer, buffer_pool
+from shared.cache import block_cache, disk_cache
+from shared.files import (
+    file_attributes_cache,
+    file_freshness,
+    file_vary,
+    get_filename,
+    refresh_url,
+)
+from shared.metrics import metrics
+from shared.stats import host_latency, host_stats, stats
+from shared.throttle import retry_budget, throttle
+from shared.requests import (
+    BREAKER_LOCK,
+    COOLDOWN_LOCK,
+    COVERAGE_LOCK,
+    FETCH_POOL_LOCK,
+    FULL_DOWNLOADS_LOCK,
+    FULL_FETCH_LOCK,
+    HOST_SLOTS_LOCK,
+    MIRROR_LOCK,
+    NO_STORE_LOCK,
+    ONGOING_LOCK,
+    PREFETCH_LOCK,
+    SESSION_LOCK,
+    SIGNERS_LOCK,
+    SINGLE_RANGE_LOCK,
+    STREAM_ONLY_LOCK,
+    chunk_coverage,
+    fetch_pool,
+    full_downloads,
+    full_fetch_urls,
+    host_breakers,
+    host_cooldowns,
+    host_signers,
+    host_slots,
+    mirror_index,
+    no_store_urls,
+    ongoing_requests,
+    prefetch_threads,
+    shared_session,
+    shutdown_event,
+    single_range_urls,
+    stream_only_urls,
+    verified_inodes,
+)
 
 from .logger import log_time, logger
 
-IDLE_TIMEOUT = 300  # seconds
 
+class FetchError(Exception):
+    """
+    A remote request failed; `errno` is what the FUSE handler should report and
+    `status` the HTTP status, if we got that far. `retryable` marks transient
+    transport failures worth another attempt.
+    """
 
-@log_time
-def get_session_for_url(url):
-    now = time.time()
-    with SESSION_LOCK:
-        if url in sessions:
-            session, _ = sessions[url]
-            sessions[url] = (session, now)
-            return session
+    def __init__(self, message, err=errno.EIO, status=None, retryable=False):
+        super().__init__(message)
+        self.errno = err
+        self.status = status
+        self.retryable = retryable
+
+
+class FullFetchRequired(FetchError):
+    """
+    The server answered a Range request in a way we can't slice, e.g. with a
+    compressed body.
+    """
+
+
+class HostUnavailable(FetchError):
+    """
+    The host's circuit breaker is open, so the request wasn't attempted.
+    """
+
+
+class RedirectLoop(FetchError):
+    """
+    A redirect chain came back to a URL it had already visited.
+    """
+
+
+class RequestCancelled(FetchError):
+    """
+    The caller gave up on the request: its handle was released or the
+    filesystem is shutting down.
+    """
+
+    def __init__(self, message):
+        super().__init__(message, errno.EINTR)
+
+
+def is_network_error(e):
+    """
+    Whether `e` means the server couldn't be reached at all (a connection
+    failure or timeout) rather than that it answered badly.
+    """
+    if isinstance(e, HostUnavailable):
+        return True
+    return (
+        isinstance(e, FetchError)
+        and not isinstance(e, RequestCancelled)
+        and e.status is None
+        and (e.retryable or e.errno == errno.ETIMEDOUT)
+    )
+
+
+# Encodings requests decodes for us; anything else would hand back raw bytes.
+# urllib3 decodes brotli when the brotli (or brotlicffi) package is installed.
+DECODABLE_ENCODINGS = ("gzip", "deflate") + (
+    ("br",) if getattr(urllib3.response, "brotli", None) is not None else ()
+)
+
+
+def accept_encoding(entry):
+    """
+    Accept-Encoding for requests that learn a file's size or fetch it whole:
+    identity, unless the file is marked compressible.
+    """
+    if entry["compressible"]:
+        return ", ".join(DECODABLE_ENCODINGS)
+    return "identity"
+
+
+def content_type_matches(expected, content_type):
+    """
+    Whether a Content-Type header is of media type `expected`, where
+    "image/*" stands for any subtype. Parameters (charset=...) are ignored.
+    """
+    media_type = (content_type or "").split(";")[0].strip().lower()
+    if expected.endswith("/*"):
+        return media_type.startswith(expected[:-1])
+    return media_type == expected
+
+
+def check_content_type(entry, response):
+    """
+    Fail with EIO if a successful response isn't of the file's expected
+    Content-Type; multipart range replies carry theirs per part and pass.
+    """
+    expected = entry.get("content_type")
+    if not expected or not 200 <= response.status_code < 300:
+        return
+    content_type = response.headers.get("Content-Type")
+    if content_type and content_type.lower().startswith("multipart/byteranges"):
+        return
+    if content_type_matches(expected, content_type):
+        return
+    response.close()
+    logger.warning(
+        "'%s' was served as %s, not the expected %s; refusing it",
+        entry["name"],
+        content_type or "no Content-Type",
+        expected,
+    )
+    raise FetchError(
+        f"{entry['url']} is {content_type or 'untyped'}, not {expected}", errno.EIO
+    )
+
+
+def content_encoding(response):
+    return response.headers.get("Content-Encoding", "identity").strip().lower()
+
+
+def needs_full_fetch(url):
+    with FULL_FETCH_LOCK:
+        return url in full_fetch_urls
+
+
+def mark_full_fetch(url, reason):
+    with FULL_FETCH_LOCK:
+        if url in full_fetch_urls:
+            return
+        full_fetch_urls.add(url)
+    logger.warning("Fetching %s whole from now on: %s", url, reason)
+
+
+def is_cacheable(entry):
+    """
+    Whether reads of `entry` may use the block and disk caches: its own
+    cacheable flag, else the mount's (cache_config.uncached turns it off).
+    """
+    if entry["cacheable"] is not None:
+        return entry["cacheable"]
+    return not cache_config.uncached
+
+
+def is_no_store(url):
+    with NO_STORE_LOCK:
+        return url in no_store_urls
+
+
+def set_no_store(url, no_store):
+    with NO_STORE_LOCK:
+        if no_store:
+            no_store_urls.add(url)
         else:
-            s = requests.Session()
-            sessions[url] = (s, now)
-            return s
+            no_store_urls.discard(url)
+
+
+def is_stream_only(url):
+    with STREAM_ONLY_LOCK:
+        return url in stream_only_urls
+
+
+def is_single_range(url):
+    with SINGLE_RANGE_LOCK:
+        return url in single_range_urls
+
+
+def mark_single_range(url, reason):
+    with SINGLE_RANGE_LOCK:
+        if url in single_range_urls:
+            return
+        single_range_urls.add(url)
+    logger.info("Not combining ranges of %s any more: %s", url, reason)
+
+
+def set_stream_only(url, stream_only):
+    with STREAM_ONLY_LOCK:
+        if stream_only:
+            stream_only_urls.add(url)
+        else:
+            stream_only_urls.discard(url)
+
+
+def freshness_lifetime(response):
+    """
+    Seconds the origin lets us reuse `response` before revalidating, from
+    Cache-Control max-age/no-cache or Expires, falling back to
+    cache_config.revalidate_ttl. None means no-store: don't cache at all.
+    """
+    directives = {}
+    for part in response.headers.get("Cache-Control", "").split(","):
+        name, _, value = part.strip().partition("=")
+        if name:
+            directives[name.lower()] = value.strip('"')
+    if "no-store" in directives:
+        return None
+    if "no-cache" in directives:
+        return 0
+    if "max-age" in directives:
+        try:
+            return max(0, int(directives["max-age"]))
+        except ValueError:
+            pass
+    expires = response.headers.get("Expires")
+    if expires is not None:
+        expires_at = parse_http_date(expires)
+        # Invalid dates such as "0" mean already expired
+        if expires_at is None:
+            return 0
+        return max(0, expires_at - response_date(response))
+    return cache_config.revalidate_ttl
+
+
+def response_date(response):
+    """
+    When `response` was generated, by the clock Expires should be counted
+    from (see client_config.server_clock_freshness).
+    """
+    if not client_config.server_clock_freshness:
+        return time.time()
+    date = parse_http_date(response.headers.get("Date"))
+    if date is not None:
+        return date
+    host = host_stats.get(host_key(response.url)) or {}
+    return time.time() + (host.get("clock_skew") or 0)
+
+
+def record_latency(url, phase, seconds):
+    host = host_key(url)
+    host_latency.observe(host, phase, seconds)
+    metrics.latency(host, phase, seconds)
+
+
+def note_clock_skew(url, response):
+    """
+    Measure how far `url`'s host's clock is from ours using the response's
+    Date header, warning when it first goes past client_config.max_clock_skew.
+    """
+    date = parse_http_date(response.headers.get("Date"))
+    if date is None:
+        return
+    # Date has whole-second resolution and is stamped before the response
+    # travels to us, so small skews are noise
+    skew = date - time.time()
+    host = host_key(url)
+    previous = host_stats.clock_skew(host, skew)
+    metrics.clock_skew(host, skew)
+    limit = client_config.max_clock_skew
+    if limit > 0 and abs(skew) > limit and (previous is None or abs(previous) <= limit):
+        logger.warning(
+            "Clock of %s is %+.0fs off ours; cache lifetimes from Expires may be off",
+            host,
+            skew,
+        )
+
+
+def status_to_errno(code):
+    if code in (404, 410):
+        return errno.ENOENT
+    if code in (401, 403):
+        return errno.EACCES
+    if code == 416:
+        return errno.EINVAL
+    return errno.EIO
+
+
+def raise_for_status(response):
+    """
+    Raise a FetchError carrying the matching errno for error responses.
+    """
+    if response.status_code >= 400:
+        raise FetchError(
+            f"HTTP error {response.status_code} for {response.url}",
+            status_to_errno(response.status_code),
+            response.status_code,
+        )
+
+
+class BearerAuth(AuthBase):
+    def __init__(self, token):
+        self.token = token
+
+    def __call__(self, r):
+        r.headers["Authorization"] = f"Bearer {self.token}"
+        return r
+
+    def __repr__(self):
+        return "BearerAuth(<redacted>)"
+
+
+def make_auth(bearer_token=None, basic_auth=None):
+    """
+    Build a requests auth object from a bearer token or a (user, password) pair.
+    """
+    if bearer_token:
+        return BearerAuth(bearer_token)
+    if basic_auth:
+        return HTTPBasicAuth(*basic_auth)
+    return None
+
+
+def get_session():
+    """
+    The session shared by every request, so connections to a host are pooled
+    and reused across files.
+    """
+    with SESSION_LOCK:
+        session = shared_session["session"]
+        if session is None:
+            if client_config.insecure_skip_verify:
+                logger.warning(
+                    "TLS certificate verification is disabled; "
+                    "connections can be intercepted"
+                )
+                # Warned once above instead of on every request
+                urllib3.disable_warnings(urllib3.exceptions.InsecureRequestWarning)
+            if client_config.http2:
+                enable_http2()
+            session = requests.Session()
+            if not client_config.cookies:
+                # requests keeps cookies by default; refuse every one instead
+                session.cookies.set_policy(
+                    http.cookiejar.DefaultCookiePolicy(allowed_domains=[])
+                )
+            adapter = HTTPAdapter(
+                pool_connections=client_config.max_idle_hosts,
+                pool_maxsize=max(
+                    client_config.max_idle_conns_per_host,
+                    client_config.max_concurrent_chunks,
+                ),
+            )
+            if client_config.transport is not None:
+                adapter = client_config.transport(adapter)
+            session.mount("http://", adapter)
+            session.mount("https://", adapter)
+            shared_session["session"] = session
+        shared_session["last_used"] = time.time()
+        return session
+
+
+def enable_http2():
+    """
+    Let urllib3 negotiate HTTP/2 via ALPN. This affects every urllib3 pool in
+    the process; without h2 installed we stay on HTTP/1.1.
+    """
+    try:
+        import urllib3.http2
+
+        urllib3.http2.inject_into_urllib3()
+    except ImportError as e:
+        logger.error("HTTP/2 unavailable (%s); using HTTP/1.1", e)
+        return
+    logger.info("HTTP/2 enabled for TLS origins that offer it")
 
 
-@log_time
 def cleanup_sessions():
     while True:
-        time.sleep(60)  # check every minute
-        now = time.time()
+        time.sleep(min(60, client_config.idle_conn_timeout))
         with SESSION_LOCK:
-            for url in list(sessions.keys()):
-                session, last_used = sessions[url]
-                if now - last_used > IDLE_TIMEOUT:
-                    session.close()
-                    del sessions[url]
-                    # also clear the redirect cache
-                    del redirect_cache[url]
+            session = shared_session["session"]
+            idle = time.time() - shared_session["last_used"]
+            if session is not None and idle > client_config.idle_conn_timeout:
+                # Closes idle pooled connections; pools reopen on next use
+                session.close()
 
 
 # Start cleanup thread
 threading.Thread(target=cleanup_sessions, daemon=True).start()
 
-# Global cache for resolved URLs
-redirect_cache = {}
-redirect_cache_lock = threading.Lock()
 
+def is_retryable_status(code):
+    return code == 429 or code >= 500
 
-@log_time
-def resolve_redirect(url):
-    with redirect_cache_lock:
-        if url in redirect_cache:
-            return redirect_cache[url]
-    session = get_session_for_url(url)
-    r = session.head(url, allow_redirects=True)
-    final_url = r.url
-    with redirect_cache_lock:
-        redirect_cache[url] = final_url
-    return final_url
-
-
-async def fetch_chunk(session, url, offset, chunk_size):
-    headers = {"Range": f"bytes={offset}-{offset + chunk_size - 1}"}
-    start = time.perf_counter()
-    async with session.get(url, headers=headers) as response:
-        if response.status in (200, 206):
-            ret = await response.read()
-            end = time.perf_counter() - start
-            logger.debug(
-                f"fetch_chunk: offset={offset}, chunk_size={chunk_size}, elapsed={end:.4f} seconds"
+
+def parse_retry_after(value):
+    """
+    Seconds to wait from a Retry-After header (delta-seconds or HTTP-date).
+    """
+    if not value:
+        return None
+    if value.strip().isdigit():
+        return int(value)
+    retry_at = parse_http_date(value)
+    if retry_at is None:
+        return None
+    return max(0.0, retry_at - time.time())
+
+
+DEFAULT_PORTS = {"http": 80, "https": 443}
+
+
+def host_key(url):
+    """
+    "host:port" that `url` connects to, with IPv6 literals bracketed, the
+    port made explicit and any userinfo dropped, so http://h/ and
+    http://user@H:80/ share per-host state.
+    """
+    parsed = urlparse(url)
+    host = (parsed.hostname or "").lower()
+    if ":" in host:
+        host = f"[{host}]"
+    return f"{host}:{parsed.port or DEFAULT_PORTS.get(parsed.scheme, 0)}"
+
+
+def same_origin(url, other):
+    """
+    Whether two URLs share scheme, host and port, i.e. credentials for one
+    may be sent to the other.
+    """
+    if urlparse(url).scheme != urlparse(other).scheme:
+        return False
+    return host_key(url) == host_key(other)
+
+
+def wait_for_cooldown(url, deadline):
+    """
+    Hold off while the URL's host is cooling down after a 429 or 503, so one
+    throttled file doesn't make every other file on that host hit it too.
+    """
+    host = host_key(url)
+    with COOLDOWN_LOCK:
+        until = host_cooldowns.get(host, 0.0)
+    delay = until - time.monotonic()
+    if delay <= 0:
+        return
+    if time.monotonic() + delay >= deadline:
+        raise FetchError(f"{host} asked us to wait before retrying", errno.ETIMEDOUT)
+    logger.debug("send_request: waiting %.2fs for %s to cool down", delay, host)
+    if shutdown_event.wait(delay):
+        raise RequestCancelled(f"request to {host} cancelled")
+
+
+def start_cooldown(url, delay):
+    host = host_key(url)
+    with COOLDOWN_LOCK:
+        host_cooldowns[host] = max(
+            host_cooldowns.get(host, 0.0), time.monotonic() + delay
+        )
+
+
+def check_breaker(url):
+    """
+    Fail fast with HostUnavailable while the URL's host's breaker is open.
+    Once the cool-down is over a single trial request is let through; others
+    keep failing until record_result settles it.
+    """
+    if client_config.breaker_threshold <= 0:
+        return
+    host = host_key(url)
+    with BREAKER_LOCK:
+        breaker = host_breakers.get(host)
+        if breaker is None or breaker["open_until"] is None:
+            return
+        if time.monotonic() >= breaker["open_until"] and not breaker["trial"]:
+            breaker["trial"] = True
+            logger.info("Trying %s again after its cool-down", host)
+            return
+    raise HostUnavailable(f"{host} is failing; not retrying it for now")
+
+
+def record_result(url, failed):
+    """
+    Count a finished attempt toward the host's breaker: enough failures in
+    client_config.breaker_window open it, a success closes it. `failed` None
+    (the caller gave up) only frees the trial slot.
+    """
+    if client_config.breaker_threshold <= 0:
+        return
+    host = host_key(url)
+    now = time.monotonic()
+    with BREAKER_LOCK:
+        if failed is None:
+            if host in host_breakers:
+                host_breakers[host]["trial"] = False
+            return
+        breaker = host_breakers.setdefault(
+            host, {"failures": [], "open_until": None, "trial": False}
+        )
+        if not failed:
+            if breaker["open_until"] is not None:
+                logger.info("%s is answering again", host)
+            host_breakers.pop(host)
+            return
+        window_start = now - client_config.breaker_window
+        failures = [t for t in breaker["failures"] if t > window_start] + [now]
+        breaker["failures"] = failures
+        if breaker["trial"] or (
+            breaker["open_until"] is None
+            and len(failures) >= client_config.breaker_threshold
+        ):
+            logger.warning(
+                "%s failed %d requests; failing its requests for %.0fs",
+                host,
+                len(failures),
+                client_config.breaker_cooldown,
             )
-            return ret
+            breaker["open_until"] = now + client_config.breaker_cooldown
+            breaker["trial"] = False
+
+
+def acquire_host_slot(url, deadline):
+    """
+    Wait for one of the URL's host's client_config.max_conns_per_host slots.
+    Returns the semaphore to release, or None when there is no limit.
+    """
+    limit = client_config.max_conns_per_host
+    if limit <= 0:
+        return None
+    host = host_key(url)
+    with HOST_SLOTS_LOCK:
+        slot = host_slots.get(host)
+        if slot is None:
+            slot = host_slots[host] = threading.BoundedSemaphore(limit)
+    # Poll so shutdown and the deadline still end the wait
+    while not slot.acquire(timeout=0.25):
+        if shutdown_event.is_set():
+            raise RequestCancelled(f"request to {host} cancelled")
+        if time.monotonic() >= deadline:
+            raise FetchError(
+                f"timed out waiting for a free connection to {host}", errno.ETIMEDOUT
+            )
+    return slot
+
+
+def release_on_close(response, slot):
+    """
+    Keep `slot` held until `response` is closed, since its body still
+    occupies the connection.
+    """
+    close = response.close
+    released = False
+
+    def close_and_release():
+        nonlocal released
+        try:
+            close()
+        finally:
+            if not released:
+                released = True
+                slot.release()
+
+    response.close = close_and_release
+
+
+def backoff_delay(attempt):
+    # Jitter keeps concurrent retries from synchronizing
+    delay = client_config.retry_backoff * 2**attempt
+    jitter = min(1.0, max(0.0, client_config.retry_jitter))
+    return delay * (1 - jitter * random.random())
+
+
+def set_host_signer(url, func):
+    """
+    Register `func(request)` to sign every request to `url`'s host and port
+    that has no signer of its own, or unregister it with None. It is called
+    on each prepared request just before it is sent, so signatures are fresh
+    on every retry and redirect hop, and may rewrite the URL or headers. It
+    may raise to fail the request.
+    """
+    with SIGNERS_LOCK:
+        if func is None:
+            host_signers.pop(host_key(url), None)
         else:
+            host_signers[host_key(url)] = func
+
+
+def request_signer(url, origin, signer):
+    """
+    Signer for a hop to `url`: the file's own while the chain stays on its
+    origin, else the one registered for the host, if any.
+    """
+    if signer is not None and same_origin(url, origin):
+        return signer
+    with SIGNERS_LOCK:
+        return host_signers.get(host_key(url))
+
+
+def send_request(method, url, headers=None, stream=False, auth=None, signer=None):
+    """
+    Issue a request, retrying connection errors, 5xx and 429 responses with
+    exponential backoff. 4xx responses are returned to the caller untouched, as
+    is the last retryable response once attempts, or the retry budget (see
+    ClientConfig.retry_budget), run out. Attempts stop early with
+    HostUnavailable once the host's circuit breaker opens. `signer` signs
+    each attempt (see set_host_signer).
+
+    The returned response carries a `deadline` (monotonic seconds) that
+    iter_body enforces while the body is read.
+    """
+    deadline = time.monotonic() + client_config.request_timeout
+    attempts = max(1, client_config.max_attempts)
+    attempt = 0
+    while True:
+        last_attempt = attempt == attempts - 1
+        wait_for_cooldown(url, deadline)
+        check_breaker(url)
+        try:
+            response = send_once(
+                method, url, headers, stream, auth, deadline, signer
+            )
+        except RequestCancelled:
+            record_result(url, failed=None)
+            raise
+        except FetchError as e:
+            record_result(url, failed=True)
+            if last_attempt or not e.retryable or not spend_retry(url):
+                raise
+            delay = backoff_delay(attempt)
+            logger.debug("send_request: %s, retrying in %.2fs", e, delay)
+        else:
+            record_result(url, failed=response.status_code >= 500)
+            delay = backoff_delay(attempt)
+            retry_after = None
+            if response.status_code in (429, 503):
+                retry_after = parse_retry_after(response.headers.get("Retry-After"))
+            if retry_after is not None:
+                delay = retry_after
+            # Rate limiting, or maintenance announced with Retry-After; a bare
+            # 503 is backed off like any other 5xx
+            if response.status_code == 429 or retry_after is not None:
+                start_cooldown(url, delay)
+            if last_attempt or not is_retryable_status(response.status_code):
+                return response
+            if not spend_retry(url):
+                return response
+            response.close()
+            logger.debug(
+                "send_request: %s %s returned %d, retrying in %.2fs",
+                method,
+                url,
+                response.status_code,
+                delay,
+            )
+        if time.monotonic() + delay >= deadline:
+            raise FetchError(f"{method} {url} timed out retrying", errno.ETIMEDOUT)
+        if shutdown_event.wait(delay):
+            raise RequestCancelled(f"{method} {url} cancelled")
+        attempt += 1
+
+
+def spend_retry(url):
+    """
+    Take a retry of `url` out of the retry budget. Returns False, after
+    logging it, if none is left.
+    """
+    if retry_budget.take(host_key(url)):
+        return True
+    logger.warning("Retry budget spent; not retrying %s", url)
+    return False
+
+
+def send_file_request(method, entry, headers=None, stream=False):
+    """
+    send_request against a file's mirrors, starting from the last one that
+    answered and moving to the next after connection errors, timeouts or 5xx
+    responses. Only the last mirror's failure reaches the caller.
+    """
+    urls = entry["mirrors"]
+    with MIRROR_LOCK:
+        start = mirror_index.get(entry["url"], 0) % len(urls)
+    for i in range(len(urls)):
+        index = (start + i) % len(urls)
+        url = urls[index]
+        last = i == len(urls) - 1
+        if index == 0 and url_expired(url):
+            url = try_refresh(entry, url, "has expired") or url
+        try:
+            stats.request(entry["name"])
+            response = send_request(
+                method,
+                url,
+                headers=headers,
+                stream=stream,
+                auth=url_auth(entry, url),
+                signer=entry["signer"],
+            )
+            if index == 0 and response.status_code == 403:
+                fresh = try_refresh(entry, url, "was refused with 403")
+                if fresh is not None:
+                    # Retry once against the fresh URL
+                    response.close()
+                    stats.request(entry["name"])
+                    response = send_request(
+                        method,
+                        fresh,
+                        headers=headers,
+                        stream=stream,
+                        auth=url_auth(entry, fresh),
+                        signer=entry["signer"],
+                    )
+        except FetchError as e:
+            if last or not (
+                e.retryable
+                or e.errno == errno.ETIMEDOUT
+                or isinstance(e, HostUnavailable)
+            ):
+                raise
+            logger.warning("Mirror %s failed: %s; trying the next one", url, e)
+            continue
+        if response.status_code >= 500 and not last:
+            response.close()
+            logger.warning(
+                "Mirror %s returned %d; trying the next one", url, response.status_code
+            )
+            continue
+        check_content_type(entry, response)
+        with MIRROR_LOCK:
+            mirror_index[entry["url"]] = index
+        # Bandwidth is accounted per file, whichever mirror serves it
+        response.file_url = entry["url"]
+        return response
+
+
+def url_auth(entry, url):
+    """
+    Auth for one of a file's URLs: credentials that were embedded in it,
+    else the file's own.
+    """
+    return entry["credentials"].get(url, entry["auth"])
+
+
+def try_refresh(entry, url, reason):
+    """
+    Ask the registered refresher for a replacement for a file's primary URL.
+    Returns it, or None if there is none.
+    """
+    try:
+        fresh = refresh_url(entry["name"], url)
+    except Exception as e:
+        logger.error("Refreshing the URL of '%s' failed: %s", entry["name"], e)
+        return None
+    if fresh is not None:
+        logger.info("URL of '%s' %s; refreshed it", entry["name"], reason)
+    return fresh
+
+
+def url_expired(url):
+    """
+    Whether `url` is a presigned S3 or GCS URL past its expiry time.
+    """
+    query = parse_qs(urlparse(url).query)
+    for prefix in ("X-Amz-", "X-Goog-"):
+        date = query.get(f"{prefix}Date")
+        expires = query.get(f"{prefix}Expires")
+        if date and expires:
+            try:
+                signed = datetime.strptime(date[0], "%Y%m%dT%H%M%SZ")
+                lifetime = int(expires[0])
+            except ValueError:
+                return False
+            signed = signed.replace(tzinfo=timezone.utc).timestamp()
+            return time.time() >= signed + lifetime
+    # Signature V2: an absolute epoch
+    expires = query.get("Expires")
+    if expires and expires[0].isdigit():
+        return time.time() >= int(expires[0])
+    return False
+
+
+def sign_request(request, signer):
+    if signer is None:
+        return
+    try:
+        signer(request)
+    except Exception as e:
+        # Not retryable: the signer would most likely fail the same way again
+        raise FetchError(f"signing {request.method} {request.url} failed: {e}") from e
+
+
+def transport_error(method, url, e):
+    if isinstance(e, requests.Timeout):
+        return FetchError(
+            f"{method} {url} timed out: {e}", errno.ETIMEDOUT, retryable=True
+        )
+    if isinstance(e, requests.exceptions.SSLError):
+        # A bad certificate won't get better on retry
+        return FetchError(f"{method} {url} TLS error: {e}")
+    return FetchError(f"{method} {url} failed: {e}", retryable=True)
+
+
+def send_once(method, url, headers, stream, auth, deadline, signer=None):
+    """
+    Issue a single attempt, following redirects ourselves so the hop limit is
+    enforced and headers (notably Range on 307/308) are re-sent on every hop.
+    Credentials and `signer` are only used while the chain stays on the
+    original scheme, host and port. A chain revisiting a URL fails with
+    RedirectLoop.
+    """
+    session = get_session()
+    merged = CaseInsensitiveDict(client_config.default_headers)
+    merged.update(headers or {})
+    headers = merged
+    headers.setdefault("User-Agent", client_config.user_agent)
+    auth = auth or client_config.auth
+    # requests reads the *_PROXY environment itself; an explicit proxy must be
+    # passed per request to take precedence over it.
+    proxies = (
+        {"http": client_config.proxy, "https": client_config.proxy}
+        if client_config.proxy
+        else None
+    )
+    # Passed per request too, since a REQUESTS_CA_BUNDLE in the environment
+    # would otherwise override session-level settings.
+    verify = (
+        False
+        if client_config.insecure_skip_verify
+        else client_config.ca_bundle or True
+    )
+    cert = client_config.client_cert
+    if cert and client_config.client_key:
+        cert = (cert, client_config.client_key)
+    origin = url
+    # Where the first hop pointed, if it was a permanent redirect
+    permanent_redirect = None
+    visited = [url]
+    for hop in range(client_config.max_redirects + 1):
+        hop_auth = auth if same_origin(url, origin) else None
+        remaining = deadline - time.monotonic()
+        if remaining <= 0:
+            raise FetchError(f"{method} {url} timed out", errno.ETIMEDOUT)
+        slot = acquire_host_slot(url, deadline)
+        remaining = deadline - time.monotonic()
+        if remaining <= 0:
+            if slot is not None:
+                slot.release()
+            raise FetchError(f"{method} {url} timed out", errno.ETIMEDOUT)
+        try:
+            request = session.prepare_request(
+                requests.Request(method, url, headers=headers, auth=hop_auth)
+            )
+            sign_request(request, request_signer(url, origin, signer))
+            # What session.request would merge in, after signing so the
+            # environment's proxy settings match the final URL
+            settings = session.merge_environment_settings(
+                request.url, proxies or {}, stream, verify, cert
+            )
+            sent_at = time.monotonic()
+            with metrics.in_flight():
+                response = session.send(
+                    request,
+                    allow_redirects=False,
+                    timeout=(
+                        min(client_config.connect_timeout, remaining),
+                        min(client_config.header_timeout, remaining),
+                    ),
+                    **settings,
+                )
+        except BaseException as e:
+            if slot is not None:
+                slot.release()
+            if not isinstance(e, requests.RequestException):
+                raise
+            metrics.request(method, "error")
+            raise transport_error(method, url, e) from e
+        metrics.request(method, response.status_code)
+        record_latency(url, "first_byte", time.monotonic() - sent_at)
+        note_clock_skew(url, response)
+        if not response.is_redirect:
+            if stream:
+                watch_stalls(response)
+            response.deadline = deadline
+            response.permanent_redirect = permanent_redirect
+            if slot is not None:
+                if stream:
+                    release_on_close(response, slot)
+                else:
+                    slot.release()
+            return response
+        response.close()
+        if slot is not None:
+            slot.release()
+        url = urljoin(url, response.headers["Location"])
+        # With cookies on, coming back after a Set-Cookie can be legitimate
+        if url in visited and not client_config.cookies:
+            chain = " -> ".join([*visited[visited.index(url) :], url])
+            logger.error("send_request: redirect loop: %s", chain)
+            raise RedirectLoop(f"redirect loop for {origin}: {chain}")
+        visited.append(url)
+        if hop == 0 and response.status_code in (301, 308):
+            permanent_redirect = url
+        logger.debug("send_request: %s redirected to %s", method, url)
+    logger.error(
+        "send_request: exceeded %d redirects for %s", client_config.max_redirects, url
+    )
+    raise FetchError(f"too many redirects for {url}")
+
+
+def parse_content_range(value):
+    """
+    (first, last) byte offsets of a `bytes first-last/total` Content-Range, or
+    None.
+    """
+    if not value:
+        return None
+    unit, _, spec = value.strip().partition(" ")
+    start, sep, rest = spec.partition("-")
+    end = rest.partition("/")[0]
+    if unit.lower() != "bytes" or not sep or not start.isdigit() or not end.isdigit():
+        return None
+    return int(start), int(end)
+
+
+def parse_content_range_total(value):
+    """
+    Complete length from a `bytes first-last/total` Content-Range, or None if
+    it's missing or unknown ("*").
+    """
+    if parse_content_range(value) is None:
+        return None
+    total = value.rpartition("/")[2].strip()
+    return int(total) if total.isdigit() else None
+
+
+def parse_unsatisfied_range(value):
+    """
+    Complete length from a 416's `bytes */total` Content-Range, or None.
+    """
+    if not value:
+        return None
+    unit, _, spec = value.strip().partition(" ")
+    if unit.lower() != "bytes" or not spec.startswith("*/"):
+        return None
+    total = spec[2:].strip()
+    return int(total) if total.isdigit() else None
+
+
+def parse_byteranges(body, content_type):
+    """
+    Split a multipart/byteranges body into (first offset, bytes) parts.
+    """
+    boundary = None
+    for param in content_type.split(";")[1:]:
+        name, _, value = param.strip().partition("=")
+        if name.lower() == "boundary":
+            boundary = value.strip('"')
+    if not boundary:
+        raise FetchError("multipart/byteranges response without a boundary")
+    delimiter = b"--" + boundary.encode("latin-1")
+    parts = []
+    # Skip the preamble; a section starting with "--" is the closing delimiter
+    for section in body.split(delimiter)[1:]:
+        if section.startswith(b"--"):
+            break
+        head, sep, data = section.lstrip(b"\r\n").partition(b"\r\n\r\n")
+        if not sep:
+            continue
+        byte_range = None
+        for line in head.split(b"\r\n"):
+            name, _, value = line.decode("latin-1").partition(":")
+            if name.strip().lower() == "content-range":
+                byte_range = parse_content_range(value)
+        if byte_range is None:
+            continue
+        start, end = byte_range
+        # Slice by the declared length; the CRLF before the next delimiter
+        # isn't part of the data
+        parts.append((start, data[: end - start + 1]))
+    return parts
+
+
+def extract_byteranges(body, content_type, offset):
+    """
+    The bytes from `offset` onwards that a multipart/byteranges body covers
+    contiguously.
+    """
+    data = bytearray()
+    for start, part in sorted(parse_byteranges(body, content_type)):
+        position = offset + len(data)
+        if start <= position < start + len(part):
+            data.extend(part[position - start :])
+    if not data:
+        raise FetchError(f"multipart/byteranges response doesn't cover offset {offset}")
+    return data
+
+
+def parse_http_date(value):
+    """
+    Parse an HTTP date (RFC 1123, numeric-zone RFC 1123Z or asctime) into epoch
+    seconds, or None when absent or unparseable.
+    """
+    if not value:
+        return None
+    try:
+        parsed = parsedate_to_datetime(value)
+    except (TypeError, ValueError):
+        return None
+    if parsed.tzinfo is None:
+        # asctime dates carry no zone; HTTP dates are always GMT
+        parsed = parsed.replace(tzinfo=timezone.utc)
+    return parsed.timestamp()
+
+
+def is_cancelled(cancel):
+    return shutdown_event.is_set() or (cancel is not None and cancel.is_set())
+
+
+def watch_stalls(response):
+    """
+    Give the socket under a streamed body client_config.stall_timeout, in
+    place of header_timeout, to wait for each byte; iter_body reports the
+    timeout as a stall. urllib3 sets the read timeout afresh for the next
+    request on the connection.
+    """
+    sock = getattr(getattr(response.raw, "connection", None), "sock", None)
+    if sock is not None and client_config.stall_timeout > 0:
+        sock.settimeout(client_config.stall_timeout)
+
+
+def is_read_timeout(e):
+    return any(isinstance(arg, urllib3.exceptions.ReadTimeoutError) for arg in e.args)
+
+
+def iter_body(response, part_size=64 * 1024, cancel=None):
+    """
+    Yield the response body in parts, failing with ETIMEDOUT once the request
+    deadline passes, EIO once no byte has arrived for stall_timeout (see
+    watch_stalls), RequestCancelled once `cancel` (a threading.Event) is
+    set, and mapping transport errors to FetchError.
+    """
+    try:
+        for part in response.iter_content(chunk_size=part_size):
+            if is_cancelled(cancel):
+                raise RequestCancelled(f"reading body of {response.url} cancelled")
+            key = getattr(response, "file_url", response.url)
+            if not throttle.consume(key, len(part), lambda: is_cancelled(cancel)):
+                raise RequestCancelled(f"reading body of {response.url} cancelled")
+            metrics.downloaded(len(part))
+            if time.monotonic() > response.deadline:
+                raise FetchError(
+                    f"reading body of {response.url} timed out", errno.ETIMEDOUT
+                )
+            yield part
+    except requests.RequestException as e:
+        if is_read_timeout(e):
+            logger.warning(
+                "%s stalled: no data for %ss", response.url, client_config.stall_timeout
+            )
+            raise FetchError(
+                f"reading body of {response.url} stalled", errno.EIO
+            ) from e
+        # The connection dropped; a new request can pick up where this stopped
+        raise FetchError(
+            f"reading body of {response.url} failed: {e}", retryable=True
+        ) from e
+
+
+def read_body(response, limit=None, cancel=None, into=None):
+    """
+    Read the whole body, failing with EFBIG once it grows past `limit` bytes.
+    With `into` (a bytearray or BlockBuffer) the body is appended to it as it
+    arrives, so a caller keeps what was received before a failure, and `into`
+    itself is returned instead of a copy. A body that ends short of its
+    Content-Length fails as retryable rather than passing as complete.
+    """
+    content_length = response.headers.get("Content-Length")
+    if (
+        limit is not None
+        and content_length
+        and content_length.strip().isdigit()
+        and int(content_length) > limit
+    ):
+        raise FetchError(f"{response.url} is larger than {limit} bytes", errno.EFBIG)
+    data = bytearray() if into is None else into
+    started_at = len(data)
+    for part in iter_body(response, cancel=cancel):
+        data.extend(part)
+        if limit is not None and len(data) > limit:
+            raise FetchError(
+                f"{response.url} is larger than {limit} bytes", errno.EFBIG
+            )
+    check_body_length(response, len(data) - started_at)
+    return bytes(data) if into is None else data
+
+
+def check_body_length(response, received):
+    """
+    Fail, as retryable if it came up short, when a body of `received` bytes
+    doesn't match its Content-Length.
+    """
+    content_length = response.headers.get("Content-Length")
+    # Decoded bodies can't be compared against the encoded length
+    if (
+        content_length
+        and content_length.strip().isdigit()
+        and content_encoding(response) == "identity"
+        and received != int(content_length)
+    ):
+        raise FetchError(
+            f"body of {response.url} was {received} bytes, "
+            f"not the declared {content_length}",
+            retryable=received < int(content_length),
+        )
+
+
+class BodyStream:
+    """
+    Front-to-back reader for a body whose length is unknown and that can't be
+    fetched by range (e.g. chunked without Content-Length). Up to `window`
+    bytes behind the furthest read are kept, so reads that jump back a little
+    are served from memory; jumping back further starts a fresh GET.
+    """
+
+    def __init__(self, entry, window):
+        self.entry = entry
+        self.window = window
+        # Reentrant since _open closes the previous response under it
+        self.lock = threading.RLock()
+        self.response = None
+        self.parts = None
+        # Offset of buffer[0] in the body
+        self.base = 0
+        self.buffer = bytearray()
+        self.eof = False
+
+    def _open(self):
+        self.close()
+        response = send_file_request(
+            "GET", self.entry, headers=self.entry["headers"], stream=True
+        )
+        try:
+            raise_for_status(response)
+        except FetchError:
+            response.close()
+            raise
+        # Only stalls end the stream, not the overall request timeout
+        response.deadline = math.inf
+        self.response = response
+        self.parts = iter_body(response)
+        self.base = 0
+        self.buffer = bytearray()
+        self.eof = False
+
+    def read(self, off, size, cancel=None):
+        with self.lock:
+            if self.response is None or off < self.base:
+                if self.response is not None:
+                    logger.info(
+                        "Read of %s at %d is behind the stream buffer; refetching",
+                        self.entry["url"],
+                        off,
+                    )
+                self._open()
+            end = off + size
+            while self.base + len(self.buffer) < end and not self.eof:
+                if is_cancelled(cancel):
+                    raise RequestCancelled(f"stream of {self.entry['url']} cancelled")
+                part = next(self.parts, None)
+                if part is None:
+                    self.eof = True
+                    break
+                self.buffer.extend(part)
+                # Trim to the window, but never what this read still needs
+                excess = min(len(self.buffer) - self.window, off - self.base)
+                if excess > 0:
+                    del self.buffer[:excess]
+                    self.base += excess
+            return bytes(self.buffer[max(0, off - self.base) : end - self.base])
+
+    def close(self):
+        with self.lock:
+            if self.response is not None:
+                self.response.close()
+                self.response = None
+
+
+def buffer_limit():
+    """
+    Most bytes a whole-body fetch may hold in memory.
+    """
+    if cache_config.max_file_size > 0:
+        return min(cache_config.max_buffered_body, cache_config.max_file_size)
+    return cache_config.max_buffered_body
+
+
+def if_range_validator(entry):
+    """
+    (header, value) of the validator our cached attributes and blocks were
+    taken under, for If-Range: a strong ETag, else Last-Modified. None if we
+    have neither (weak ETags aren't allowed in If-Range).
+    """
+    freshness = file_freshness.get(entry["name"])
+    if freshness is None:
+        return None
+    etag = freshness["etag"]
+    if etag and not etag.startswith("W/"):
+        return "ETag", etag
+    if freshness["last_modified"]:
+        return "Last-Modified", freshness["last_modified"]
+    return None
+
+
+def note_remote_size(inode, entry, total):
+    """
+    Check a size the server reported while serving ranges against the cached
+    attributes. If the file has been replaced with one of another size, its
+    attributes and blocks are dropped so getattr and later reads see the new
+    version.
+    """
+    cached = file_attributes_cache.get(entry["name"])
+    if cached is None or cached.st_size == total:
+        return
+    logger.warning(
+        "%s is now %d bytes, not %d; dropping its cached blocks",
+        entry["url"],
+        total,
+        cached.st_size,
+    )
+    file_attributes_cache.pop(entry["name"], None)
+    file_freshness.pop(entry["name"], None)
+    invalidate_chunks(inode, entry)
+
+
+def can_spill(entry):
+    """
+    Whether a whole body too big for memory may go to the disk cache instead.
+    """
+    return disk_cache.enabled and not is_no_store(entry["url"])
+
+
+def read_whole_body(inode, entry, response, chunk_size, want=None, cancel=None):
+    """
+    Read a whole body standing in for ranges and cache it chunk by chunk.
+    Up to buffer_limit() bytes are held in memory; past that the body is
+    spilled to the caches as it arrives and only the bytes in `want`
+    ((start, end), default everything) are kept, or, with nowhere to spill
+    to (see can_spill), it fails with EFBIG. max_file_size applies either way.
+    Returns (bytes of `want`, body length, SHA-256 hex digest).
+    """
+    limit = buffer_limit()
+    spillable = can_spill(entry)
+    content_length = response.headers.get("Content-Length")
+    if (
+        not spillable
+        and content_length
+        and content_length.strip().isdigit()
+        and int(content_length) > limit
+    ):
+        raise FetchError(f"{response.url} is larger than {limit} bytes", errno.EFBIG)
+    start, end = want if want is not None else (0, math.inf)
+    digest = hashlib.sha256()
+    buffer = bytearray()
+    kept = bytearray()
+    spilling = False
+    # Bytes already handed to the caches, all of them whole chunks
+    spilled = 0
+
+    def keep(chunk, at):
+        lo, hi = max(start, at), min(end, at + len(chunk))
+        if lo < hi:
+            kept.extend(chunk[lo - at : hi - at])
+
+    for part in iter_body(response, cancel=cancel):
+        digest.update(part)
+        buffer.extend(part)
+        length = spilled + len(buffer)
+        if 0 < cache_config.max_file_size < length:
+            raise FetchError(
+                f"{response.url} is larger than {cache_config.max_file_size} bytes",
+                errno.EFBIG,
+            )
+        if not spilling and length > limit:
+            if not spillable:
+                raise FetchError(
+                    f"{response.url} is larger than {limit} bytes", errno.EFBIG
+                )
+            logger.info(
+                "%s is over %d bytes; spilling it to the disk cache",
+                entry["url"],
+                limit,
+            )
+            spilling = True
+        if spilling:
+            # Whole chunks go to the caches; the remainder waits for more
+            whole = len(buffer) - len(buffer) % chunk_size
+            for offset in range(0, whole, chunk_size):
+                chunk = bytes(buffer[offset : offset + chunk_size])
+                store_chunk(inode, entry, spilled + offset, chunk_size, chunk)
+                keep(chunk, spilled + offset)
+            del buffer[:whole]
+            spilled += whole
+    length = spilled + len(buffer)
+    check_body_length(response, length)
+    if not spilling:
+        body = bytes(buffer)
+        cache_body(inode, entry, body, chunk_size)
+        return body[start:end] if want is not None else body, length, digest.hexdigest()
+    if buffer:
+        store_chunk(inode, entry, spilled, chunk_size, bytes(buffer))
+        keep(bytes(buffer), spilled)
+    return bytes(kept), length, digest.hexdigest()
+
+
+def cache_body(inode, entry, body, chunk_size):
+    for offset in range(0, len(body), chunk_size):
+        store_chunk(
+            inode, entry, offset, chunk_size, body[offset : offset + chunk_size]
+        )
+    logger.debug("cache_body: cached %d bytes of %s", len(body), entry["url"])
+
+
+def fetch_chunk(inode, entry, offset, chunk_size, cancel=None, uncached=False):
+    """
+    Fetch the chunk at `offset`. If the connection drops partway through the
+    body, the rest of the range is requested again from where it stopped, up
+    to client_config.max_attempts times.
+
+    `uncached` fetches an arbitrary range for an uncached read: its buffer
+    isn't pooled, and a server ignoring Range raises FullFetchRequired
+    instead of its whole body being cached.
+    """
+    if uncached:
+        # Sized to the read, so not worth keeping
+        return _fetch_chunk(
+            inode, entry, offset, chunk_size, cancel, BlockBuffer(chunk_size), True
+        )
+    data = buffer_pool.get(chunk_size)
+    try:
+        return _fetch_chunk(inode, entry, offset, chunk_size, cancel, data, False)
+    finally:
+        buffer_pool.put(data)
+
+
+def _fetch_chunk(inode, entry, offset, chunk_size, cancel, data, uncached):
+    # `data` is pooled, so only copies of it (getvalue) may be returned
+    end_offset = offset + chunk_size
+    # The last chunk only asks for what's left of the file. At or past the
+    # known end (a stale size) the server's 416 or 206 tells us the real one.
+    known = file_attributes_cache.get(entry["name"])
+    if known is not None and offset < known.st_size:
+        end_offset = min(end_offset, known.st_size)
+    resumes = 0
+    # Ranges are only served while the file is the version we cached, so a
+    # change can't leave us stitching together bytes of two versions
+    validator = if_range_validator(entry)
+    while True:
+        range_from = offset + len(data)
+        headers = {
+            **entry["headers"],
+            # Byte ranges only make sense against the unencoded representation
+            "Accept-Encoding": "identity",
+            "Range": f"bytes={range_from}-{end_offset - 1}",
+        }
+        if validator is not None:
+            headers["If-Range"] = validator[1]
+        if is_cancelled(cancel):
+            raise RequestCancelled(f"fetch of {entry['url']} cancelled")
+        start = time.perf_counter()
+        with send_file_request("GET", entry, headers=headers, stream=True) as response:
+            if response.ok and content_encoding(response) != "identity":
+                raise FullFetchRequired(
+                    f"{entry['url']} is served with Content-Encoding "
+                    f"{content_encoding(response)}"
+                )
+            if response.status_code == 416:
+                total = parse_unsatisfied_range(response.headers.get("Content-Range"))
+                if total is not None and range_from >= total:
+                    # The file shrank below this range: it now ends here
+                    note_remote_size(inode, entry, total)
+                    return data.getvalue()
+            if response.status_code == 206:
+                # Catch servers (or proxies) that mangle large offsets, e.g. by
+                # truncating them to 32 bits, instead of silently returning the
+                # wrong bytes.
+                content_range = response.headers.get("Content-Range")
+                byte_range = parse_content_range(content_range)
+                content_type = response.headers.get("Content-Type", "")
+                multipart = content_type.lower().startswith("multipart/byteranges")
+                if byte_range is None and not multipart:
+                    # Without it there's no telling where the bytes belong
+                    raise FetchError(
+                        f"{entry['url']} answered Range {range_from}-{end_offset - 1} "
+                        f"with 206 but Content-Range {content_range!r}"
+                    )
+                if byte_range is not None and byte_range[0] != range_from:
+                    raise FetchError(
+                        f"{entry['url']} answered Range from {range_from} "
+                        f"with bytes from {byte_range[0]}"
+                    )
+                # A range may only end early where the file does
+                total = parse_content_range_total(content_range)
+                if total is not None:
+                    note_remote_size(inode, entry, total)
+                if byte_range is not None and byte_range[1] != end_offset - 1:
+                    if total is None or byte_range[1] != total - 1:
+                        raise FetchError(
+                            f"{entry['url']} answered Range "
+                            f"{range_from}-{end_offset - 1} "
+                            f"with {byte_range[0]}-{byte_range[1]}"
+                        )
+                if multipart:
+                    # Some servers and proxies wrap even a single range
+                    body = read_body(response, buffer_limit(), cancel)
+                    data.extend(extract_byteranges(body, content_type, range_from))
+                    return data.getvalue()
+                try:
+                    read_body(response, cancel=cancel, into=data)
+                    if (
+                        byte_range is not None
+                        and offset + len(data) != byte_range[1] + 1
+                    ):
+                        raise FetchError(
+                            f"{entry['url']} sent {offset + len(data) - range_from} "
+                            f"bytes of range {range_from}-{byte_range[1]}",
+                            retryable=offset + len(data) < byte_range[1] + 1,
+                        )
+                except FetchError as e:
+                    if not e.retryable or resumes >= client_config.max_attempts - 1:
+                        raise
+                    resumes += 1
+                    logger.warning(
+                        "fetch_chunk: %s; resuming at %d", e, offset + len(data)
+                    )
+                    continue
+                ret = data.getvalue()
+            elif response.status_code == 200:
+                if validator is not None and response.headers.get(
+                    validator[0], validator[1]
+                ) != validator[1]:
+                    # If-Range failed: everything cached is of the old version
+                    logger.info(
+                        "%s changed on the server; dropping its cached blocks",
+                        entry["url"],
+                    )
+                    file_attributes_cache.pop(entry["name"], None)
+                    file_freshness.pop(entry["name"], None)
+                    invalidate_chunks(inode, entry)
+                    raise FetchError(f"{entry['url']} changed while being read")
+                # Server ignored the Range header and sent the whole body; keep
+                # all of it so later ranges come from the cache.
+                mark_full_fetch(entry["url"], "server ignores Range requests")
+                if uncached:
+                    raise FullFetchRequired(f"{entry['url']} ignores Range requests")
+                ret, _, _ = read_whole_body(
+                    inode, entry, response, chunk_size, (offset, end_offset), cancel
+                )
+            else:
+                end = time.perf_counter() - start
+                logger.debug(
+                    f"fetch_chunk FAIL: url={entry['url']}, offset={range_from}, "
+                    f"chunk_size={chunk_size}, status={response.status_code}, "
+                    f"elapsed={end:.4f} seconds"
+                )
+                raise_for_status(response)
+                raise FetchError(
+                    f"unexpected HTTP status {response.status_code}",
+                    status=response.status_code,
+                )
             end = time.perf_counter() - start
             logger.debug(
-                f"fetch_chunk FAIL: offset={offset}, chunk_size={chunk_size}, elapsed={end:.4f} seconds"
+                f"fetch_chunk: url={entry['url']}, offset={range_from}, "
+                f"chunk_size={chunk_size}, status={response.status_code}, "
+                f"elapsed={end:.4f} seconds"
+            )
+            record_latency(response.url, "chunk", end)
+            return ret
+
+
+def get_fetch_pool():
+    """
+    The pool every chunk download runs on, so max_concurrent_chunks caps the
+    Range requests in flight across all reads.
+    """
+    with FETCH_POOL_LOCK:
+        pool = fetch_pool["pool"]
+        if pool is None:
+            pool = ThreadPoolExecutor(
+                max_workers=max(1, client_config.max_concurrent_chunks)
             )
-            raise Exception(f"HTTP error {response.status}")
+            fetch_pool["pool"] = pool
+        return pool
 
 
-# Async function to fetch multiple chunks concurrently.
-async def fetch_chunks_async(url, offsets, chunk_size):
-    async with aiohttp.ClientSession() as session:
-        tasks = [fetch_chunk(session, url, offset, chunk_size) for offset in offsets]
-        return await asyncio.gather(*tasks)
+def fetch_chunk_shared(inode, entry, offset, chunk_size, cancel=None):
+    """
+    Fetch and cache one chunk, coalescing concurrent requests for the same
+    (inode, block) into a single HTTP request. A failure is raised to every
+    waiter and nothing is cached, except that waiters whose leader was
+    cancelled try again themselves.
+    """
+    key = (inode, offset // chunk_size)
+    while True:
+        with ONGOING_LOCK:
+            future = ongoing_requests.get(key)
+            leader = future is None
+            if leader:
+                future = Future()
+                ongoing_requests[key] = future
+        if leader:
+            break
+        try:
+            return future.result()
+        except RequestCancelled:
+            if is_cancelled(cancel):
+                raise
+    try:
+        chunk = fetch_chunk(inode, entry, offset, chunk_size, cancel)
+        store_chunk(inode, entry, offset, chunk_size, chunk)
+        future.set_result(chunk)
+        return chunk
+    except BaseException as e:
+        future.set_exception(e)
+        raise
+    finally:
+        with ONGOING_LOCK:
+            del ongoing_requests[key]
 
 
 @log_time
-# Synchronous wrapper around the async function for fuse compat
-def fetch_chunks_sync(url, offsets, chunk_size, total_size):
+# Fetch and cache several chunks concurrently, returned in offset order. Each
+# chunk is its own Range request with its own retries, so one failing chunk
+# doesn't refetch the others; those that succeeded stay cached either way.
+def fetch_chunks_sync(inode, entry, offsets, chunk_size, total_size, cancel=None):
     # Only fetch offsets less than the file's total size.
     valid_offsets = [offset for offset in offsets if offset < total_size]
     if not valid_offsets:
         return []
-    result = asyncio.run(fetch_chunks_async(url, valid_offsets, chunk_size))
+    if shutdown_event.is_set():
+        # The fetch pool no longer accepts work
+        raise RequestCancelled("filesystem is shutting down")
+    result = list(
+        get_fetch_pool().map(
+            lambda offset: fetch_chunk_shared(
+                inode, entry, offset, chunk_size, cancel
+            ),
+            valid_offsets,
+        )
+    )
     # Log the current cache size in MB and active prefetch threads.
-    with CACHE_LOCK:
-        total_bytes = sum(len(chunk) for chunk in file_chunk_cache.values())
-    cache_mb = total_bytes / (1024 * 1024)
+    cache_stats = block_cache.stats()
+    cache_mb = cache_stats["bytes"] / (1024 * 1024)
     with PREFETCH_LOCK:
         active_prefetch = len(prefetch_threads)
     logger.debug(
-        f"fetch_chunks_sync: current file_chunk_cache size: {cache_mb:.2f} MB; active prefetch threads: {active_prefetch}"
+        f"fetch_chunks_sync: block cache size: {cache_mb:.2f} MB, "
+        f"hits={cache_stats['hits']}, misses={cache_stats['misses']}; "
+        f"active prefetch threads: {active_prefetch}"
     )
     return result
 
 
+def fetch_ranges(inode, entry, offsets, chunk_size, total_size, cancel=None):
+    """
+    Fetch and cache the chunks at `offsets` with one multi-range request,
+    adjacent chunks sharing a range, for readahead that skips cached chunks.
+    Returns the offsets still missing, for fetch_chunks_sync: all of them if
+    the ranges are contiguous, or the server answers with one range or the
+    whole body (it isn't asked for several again).
+    """
+    spans = []
+    for offset in sorted(offsets):
+        end = min(offset + chunk_size, total_size)
+        if spans and spans[-1][1] == offset:
+            spans[-1][1] = end
+        else:
+            spans.append([offset, end])
+    if len(spans) < 2 or is_single_range(entry["url"]):
+        return offsets
+    headers = {
+        **entry["headers"],
+        "Accept-Encoding": "identity",
+        "Range": "bytes=" + ",".join(f"{start}-{end - 1}" for start, end in spans),
+    }
+    validator = if_range_validator(entry)
+    if validator is not None:
+        headers["If-Range"] = validator[1]
+    if is_cancelled(cancel):
+        raise RequestCancelled(f"fetch of {entry['url']} cancelled")
+    with send_file_request("GET", entry, headers=headers, stream=True) as response:
+        raise_for_status(response)
+        content_type = response.headers.get("Content-Type", "")
+        multipart = content_type.lower().startswith("multipart/byteranges")
+        if response.status_code == 206 and multipart:
+            body = read_body(response, buffer_limit(), cancel)
+        elif validator is not None and response.headers.get(
+            validator[0], validator[1]
+        ) != validator[1]:
+            # If-Range failed; the single-range fetches notice the change
+            return offsets
+        else:
+            mark_single_range(
+                entry["url"], f"a multi-range request got {response.status_code}"
+            )
+            return offsets
+    parts = parse_byteranges(body, content_type)
+    missing = []
+    for offset in offsets:
+        end = min(offset + chunk_size, total_size)
+        chunk = next(
+            (
+                part[offset - start : end - start]
+                for start, part in parts
+                if start <= offset and start + len(part) >= end
+            ),
+            None,
+        )
+        if chunk is None:
+            missing.append(offset)
+        else:
+            store_chunk(inode, entry, offset, chunk_size, chunk)
+    logger.debug(
+        "fetch_ranges: %d of %d chunks of %s in one request",
+        len(offsets) - len(missing),
+        len(offsets),
+        entry["url"],
+    )
+    return missing
+
+
 @log_time
-def prefetch(url, start_offset, chunk_size, max_prefetch_bytes, total_size):
+def fetch_full_body(inode, entry, chunk_size, want=None, cancel=None):
+    """
+    Download the whole body, decoding any gzip/deflate Content-Encoding, and
+    cache it chunk by chunk so later reads are served from the cache (see
+    read_whole_body for bodies too big for memory). Returns (bytes of `want`,
+    body length).
+    """
+    headers = entry["headers"]
+    if entry["compressible"]:
+        headers = {**headers, "Accept-Encoding": accept_encoding(entry)}
+    with send_file_request("GET", entry, headers=headers, stream=True) as response:
+        raise_for_status(response)
+        encoding = content_encoding(response)
+        if encoding not in DECODABLE_ENCODINGS + ("identity",):
+            raise FetchError(f"unsupported Content-Encoding {encoding}")
+        data, length, digest = read_whole_body(
+            inode, entry, response, chunk_size, want, cancel
+        )
+    if entry["sha256"]:
+        check_digest(inode, entry, digest)
+    return data, length
+
+
+def check_digest(inode, entry, actual):
+    """
+    Compare a file's assembled SHA-256 against the one it is expected to have.
+    On a mismatch its cached chunks are dropped and EIO is raised.
     """
-    Prefetch multiple chunks at once until we fill up max_prefetch_bytes.
+    if actual == entry["sha256"]:
+        with COVERAGE_LOCK:
+            verified_inodes.add(inode)
+            chunk_coverage.pop(inode, None)
+        logger.debug("Verified SHA-256 of %s", entry["url"])
+        return
+    logger.error(
+        "SHA-256 mismatch for %s: expected %s, got %s",
+        entry["url"],
+        entry["sha256"],
+        actual,
+    )
+    invalidate_chunks(inode, entry)
+    raise FetchError(f"{entry['url']} failed its integrity check", errno.EIO)
+
+
+def track_coverage(inode, entry, offsets, chunk_size, total_size):
+    """
+    Note that the chunks at `offsets` have been read and, once every chunk of
+    the file has been, verify the cached copy against its expected SHA-256.
+    """
+    chunk_count = (total_size + chunk_size - 1) // chunk_size
+    with COVERAGE_LOCK:
+        if inode in verified_inodes:
+            return
+        seen = chunk_coverage.setdefault(inode, set())
+        seen.update(offset // chunk_size for offset in offsets)
+        if len(seen) < chunk_count:
+            return
+        chunk_coverage.pop(inode, None)
+    digest = hashlib.sha256()
+    for offset in range(0, total_size, chunk_size):
+        data = block_cache.get((inode, offset // chunk_size))
+        if data is None:
+            data = disk_cache.get(variant_key(entry), offset)
+        if data is None:
+            # Evicted before we got to it; verify on the next full pass
+            logger.debug("Can't verify %s: chunk @ %d evicted", entry["url"], offset)
+            return
+        digest.update(data)
+    check_digest(inode, entry, digest.hexdigest())
+
+
+def get_cached_chunk(inode, entry, offset, chunk_size):
+    """
+    Look a chunk up in memory, then on disk (promoting disk hits into memory).
+    """
+    if is_no_store(entry["url"]):
+        return None
+    key = (inode, offset // chunk_size)
+    data = block_cache.get(key)
+    if data is not None:
+        logger.debug("cache hit (memory): %s @ %d", entry["url"], offset)
+        metrics.cache_lookup("memory")
+        stats.cache_lookup(entry["name"], True)
+        return data
+    data = disk_cache.get(variant_key(entry), offset)
+    if data is not None:
+        logger.debug("cache hit (disk): %s @ %d", entry["url"], offset)
+        metrics.cache_lookup("disk")
+        block_cache.put(key, data)
+    else:
+        metrics.cache_lookup("miss")
+    stats.cache_lookup(entry["name"], data is not None)
+    return data
+
+
+def is_chunk_cached(inode, entry, offset, chunk_size):
+    return (inode, offset // chunk_size) in block_cache or (
+        variant_key(entry),
+        offset,
+    ) in disk_cache
+
+
+def parse_vary(response):
     """
+    Sorted, lowercased request headers named in `response`'s Vary, without
+    Accept-Encoding: bodies are cached decoded, whatever their encoding.
+    """
+    names = {
+        name.strip().lower()
+        for name in response.headers.get("Vary", "").split(",")
+        if name.strip()
+    }
+    names.discard("accept-encoding")
+    return tuple(sorted(names))
+
+
+def variant_key(entry):
+    """
+    What `entry`'s blocks are filed under on disk: its URL, plus the values
+    it sends for the headers its responses vary on, so files fetching one URL
+    with different headers don't share blocks. (Memory blocks are per inode.)
+    """
+    vary = file_vary.get(entry["name"])
+    if not vary:
+        return entry["url"]
+    headers = CaseInsensitiveDict(client_config.default_headers)
+    headers.update(entry["headers"])
+    variant = [f"{name}: {headers.get(name, '')}" for name in vary]
+    return "\n".join([entry["url"], *variant])
+
+
+def invalidate_chunks(inode, entry):
+    """
+    Forget every cached chunk of a file whose remote copy has changed.
+    """
+    block_cache.invalidate(inode)
+    with COVERAGE_LOCK:
+        verified_inodes.discard(inode)
+        chunk_coverage.pop(inode, None)
+    try:
+        disk_cache.invalidate(variant_key(entry))
+    except OSError as e:
+        logger.warning("invalidate_chunks: disk cache cleanup failed: %s", e)
+    logger.info("Invalidated cached chunks of %s", entry["url"])
+
+
+def store_chunk(inode, entry, offset, chunk_size, data):
+    if is_no_store(entry["url"]):
+        return
+    block_cache.put((inode, offset // chunk_size), data)
+    try:
+        disk_cache.put(variant_key(entry), offset, data)
+    except OSError as e:
+        logger.warning("store_chunk: disk cache write failed: %s", e)
+
+
+@log_time
+def read_chunks(inode, entry, offsets, chunk_size, total_size, cancel=None):
+    """
+    Return the chunks starting at `offsets`, serving what we can from the memory
+    and disk caches and fetching the rest in one concurrent batch. Setting
+    `cancel` aborts the downloads with RequestCancelled.
+    """
+    chunks = {}
+    missing = []
+    for offset in offsets:
+        if offset >= total_size:
+            continue
+        data = get_cached_chunk(inode, entry, offset, chunk_size)
+        if data is None:
+            missing.append(offset)
+        else:
+            chunks[offset] = data
+    if missing and needs_full_fetch(entry["url"]) and not is_no_store(entry["url"]):
+        # Stream the body into the caches in the background so this read
+        # waits only until its own offsets have arrived
+        start_full_download(inode, entry, total_size, on_demand=True)
+    if missing and wait_for_full_download(
+        inode, min(max(missing) + chunk_size, total_size), cancel
+    ):
+        still_missing = []
+        for offset in missing:
+            data = get_cached_chunk(inode, entry, offset, chunk_size)
+            if data is None:
+                still_missing.append(offset)
+            else:
+                chunks[offset] = data
+        missing = still_missing
+    if missing and not needs_full_fetch(entry["url"]):
+        try:
+            fetched = fetch_chunks_sync(
+                inode, entry, missing, chunk_size, total_size, cancel
+            )
+        except FullFetchRequired as e:
+            mark_full_fetch(entry["url"], e)
+            # The size we reported came from the encoded representation
+            file_attributes_cache.pop(get_filename(inode), None)
+        else:
+            for offset, data in zip(missing, fetched):
+                chunks[offset] = data
+            missing = []
+    if missing:
+        if total_size > buffer_limit() and not can_spill(entry):
+            raise FetchError(
+                f"{entry['url']} needs a whole-body fetch but is {total_size} bytes",
+                errno.EFBIG,
+            )
+        base = min(missing)
+        data, _ = fetch_full_body(
+            inode, entry, chunk_size, (base, max(missing) + chunk_size), cancel
+        )
+        for offset in missing:
+            if offset - base < len(data):
+                chunks[offset] = data[offset - base : offset - base + chunk_size]
+    elif entry["sha256"] and not is_no_store(entry["url"]):
+        # A no-store file keeps nothing to assemble; only whole bodies verify
+        track_coverage(inode, entry, chunks, chunk_size, total_size)
+    return [chunks[offset] for offset in offsets if offset in chunks]
+
+
+def start_full_download(inode, entry, total_size, on_demand=False):
+    """
+    Download the whole file into the caches in the background, unless that's
+    already underway or every chunk is cached. An `on_demand` download (one
+    started for reads) is cancelled once the file's last handle is released.
+    """
+    chunk_size = cache_config.chunk_size
+    if 0 < cache_config.max_file_size < total_size:
+        logger.info(
+            "Not downloading %s whole: %d bytes is over the size limit",
+            entry["url"],
+            total_size,
+        )
+        return
+    if is_no_store(entry["url"]) or all(
+        is_chunk_cached(inode, entry, offset, chunk_size)
+        for offset in range(0, total_size, chunk_size)
+    ):
+        return
+    with FULL_DOWNLOADS_LOCK:
+        if inode in full_downloads:
+            return
+        state = {
+            "progress": 0,
+            "total": total_size,
+            "finished": False,
+            "cond": threading.Condition(),
+            "on_demand": on_demand,
+            "cancel": threading.Event(),
+        }
+        full_downloads[inode] = state
+    threading.Thread(
+        target=download_whole, args=(inode, entry, state), daemon=True
+    ).start()
+
+
+def download_whole(inode, entry, state):
+    chunk_size = cache_config.chunk_size
+    buffer = bytearray()
+    offset = 0
+    digest = hashlib.sha256()
+    try:
+        headers = {**entry["headers"], "Accept-Encoding": "identity"}
+        with send_file_request("GET", entry, headers=headers, stream=True) as response:
+            raise_for_status(response)
+            if content_encoding(response) != "identity":
+                # Chunks must hold decoded bytes; fetch_full_body decodes
+                raise FullFetchRequired(
+                    f"{entry['url']} is served with Content-Encoding "
+                    f"{content_encoding(response)}"
+                )
+            # Only stalls end the download, not the overall request timeout
+            response.deadline = math.inf
+            for part in iter_body(response, cancel=state["cancel"]):
+                digest.update(part)
+                buffer.extend(part)
+                while len(buffer) >= chunk_size:
+                    chunk = bytes(buffer[:chunk_size])
+                    store_chunk(inode, entry, offset, chunk_size, chunk)
+                    del buffer[:chunk_size]
+                    offset += chunk_size
+                    with state["cond"]:
+                        state["progress"] = offset
+                        state["cond"].notify_all()
+                    stats.download(entry["name"], offset, state["total"])
+            if buffer:
+                store_chunk(inode, entry, offset, chunk_size, bytes(buffer))
+                offset += len(buffer)
+        if entry["sha256"]:
+            check_digest(inode, entry, digest.hexdigest())
+        logger.info("Downloaded %s (%d bytes) into the cache", entry["url"], offset)
+    except RequestCancelled:
+        logger.info(
+            "Stopped downloading %s at %d bytes: no longer read", entry["url"], offset
+        )
+    except FetchError as e:
+        # Waiting reads fall back to fetching their own ranges
+        logger.error("Background download of %s failed: %s", entry["url"], e)
+    finally:
+        with FULL_DOWNLOADS_LOCK:
+            full_downloads.pop(inode, None)
+        with state["cond"]:
+            state["progress"] = offset
+            state["finished"] = True
+            state["cond"].notify_all()
+        stats.download(entry["name"], offset, state["total"], finished=True)
+
+
+def cancel_full_download(inode):
+    """
+    Stop an on-demand background download of `inode`; what it has cached so
+    far stays cached.
+    """
+    with FULL_DOWNLOADS_LOCK:
+        state = full_downloads.get(inode)
+    if state is not None and state["on_demand"]:
+        state["cancel"].set()
+
+
+def wait_for_full_download(inode, upto, cancel=None):
+    """
+    Block until a running background download of `inode` has passed `upto`
+    or ended. Returns False if there's no such download.
+    """
+    with FULL_DOWNLOADS_LOCK:
+        state = full_downloads.get(inode)
+    if state is None:
+        return False
+    with state["cond"]:
+        while state["progress"] < upto and not state["finished"]:
+            if is_cancelled(cancel):
+                raise RequestCancelled("read cancelled while waiting for download")
+            # Wake up regularly to notice cancellation
+            state["cond"].wait(0.1)
+    return True
+
+
+@log_time
+def prefetch(
+    fh, inode, entry, start_offset, chunk_size, max_prefetch_bytes, total_size, cancel
+):
+    """
+    Prefetch multiple chunks at once until we fill up max_prefetch_bytes or
+    `cancel` is set.
+    """
+    url = entry["url"]
     current = start_offset
-    end_offset = start_offset + max_prefetch_bytes
+    end_offset = min(start_offset + max_prefetch_bytes, total_size)
 
-    while current < end_offset:
+    while current < end_offset and not cancel.is_set():
         # Accumulate a list of offsets we still need (and aren't cached yet).
         offsets_to_fetch = []
-        for _ in range(PREFETCH_BATCH_SIZE):
-            if current >= end_offset:
-                break
-            cache_key = (url, current)
-            with CACHE_LOCK:
-                # If it's already cached, skip it
-                if cache_key in file_chunk_cache:
-                    current += chunk_size
-                    continue
-            offsets_to_fetch.append(current)
+        while (
+            len(offsets_to_fetch) < cache_config.readahead_parallelism
+            and current < end_offset
+        ):
+            # If it's already cached, skip it
+            if not is_chunk_cached(inode, entry, current, chunk_size):
+                offsets_to_fetch.append(current)
             current += chunk_size
 
         # If we didn't find any offsets to fetch this round, break out
         if not offsets_to_fetch:
             break
 
-        # Now fetch them in one async batch
-        chunks = fetch_chunks_sync(url, offsets_to_fetch, chunk_size, total_size)
-        # Store them in the cache
-        with CACHE_LOCK:
-            for i, offset in enumerate(offsets_to_fetch):
-                file_chunk_cache[(url, offset)] = chunks[i]
+        # Now fetch and cache them in one concurrent batch
+        try:
+            if cache_config.multi_range_readahead:
+                offsets_to_fetch = fetch_ranges(
+                    inode, entry, offsets_to_fetch, chunk_size, total_size, cancel
+                )
+            fetch_chunks_sync(
+                inode, entry, offsets_to_fetch, chunk_size, total_size, cancel
+            )
+        except RequestCancelled:
+            logger.debug("prefetch: cancelled for %s", url)
+            break
+        except FetchError as e:
+            logger.error("prefetch: stopping for %s: %s", url, e)
+            break
 
-    # Remove thread marker when done
+    # Remove thread marker when done, unless a newer prefetch replaced it
     with PREFETCH_LOCK:
-        prefetch_threads.pop(url, None)
+        running = prefetch_threads.get(fh)
+        if running and running[0] is threading.current_thread():
+            del prefetch_threads[fh]
 
 
-@log_time
-def maybe_prefetch(url, current_read_offset, total_size):
-    # Determine how far we've cached for this URL.
-    with CACHE_LOCK:
-        cached_offsets = [off for (u, off) in file_chunk_cache if u == url]
-    highest_cached = max(cached_offsets) if cached_offsets else current_read_offset
-    target = current_read_offset + MAX_PREFETCH_AHEAD
-    if highest_cached < target:
-        # Spawn a thread to prefetch continuously from the current highest offset up to the target.
-        threading.Thread(
+def maybe_prefetch(fh, inode, entry, offset, total_size):
+    """
+    Read ahead `cache_config.readahead` bytes from `offset` in the background,
+    unless this handle already has a prefetch running.
+    """
+    # Fully fetched files are downloaded on demand instead
+    if needs_full_fetch(entry["url"]) or cache_config.readahead <= 0:
+        return
+    # Nothing to read ahead into when the origin forbids caching
+    if is_no_store(entry["url"]):
+        return
+    # A background download is already fetching everything
+    with FULL_DOWNLOADS_LOCK:
+        if inode in full_downloads:
+            return
+    chunk_size = cache_config.chunk_size
+    start = offset - (offset % chunk_size)
+    with PREFETCH_LOCK:
+        running = prefetch_threads.get(fh)
+        if running and running[0].is_alive():
+            return
+        cancel = threading.Event()
+        thread = threading.Thread(
             target=prefetch,
             args=(
-                url,
-                highest_cached,
-                DEFAULT_CHUNK_SIZE,
-                target - highest_cached,
+                fh,
+                inode,
+                entry,
+                start,
+                chunk_size,
+                cache_config.readahead,
                 total_size,
+                cancel,
             ),
             daemon=True,
-        ).start()
+        )
+        prefetch_threads[fh] = (thread, cancel)
+    thread.start()
+
+
+def cancel_prefetch(fh):
+    with PREFETCH_LOCK:
+        running = prefetch_threads.pop(fh, None)
+    if running:
+        running[1].set()
+
+
+def shutdown_requests():
+    """
+    Abort in-flight and queued downloads so unmounting isn't held up by them.
+    """
+    shutdown_event.set()
+    with PREFETCH_LOCK:
+        running = list(prefetch_threads.values())
+        prefetch_threads.clear()
+    for _, cancel in running:
+        cancel.set()
+    with FETCH_POOL_LOCK:
+        pool = fetch_pool["pool"]
+    if pool is not None:
+        pool.shutdown(wait=False, cancel_futures=True)
+    with SESSION_LOCK:
+        if shared_session["session"] is not None:
+            # Closing the pool breaks any body read still in progress
+            shared_session["session"].close()
+
+
+def resume_requests():
+    """
+    Undo shutdown_requests, so a filesystem mounted again in the same process
+    can download. The closed session reopens its pools on next use.
+    """
+    if not shutdown_event.is_set():
+        return
+    with FETCH_POOL_LOCK:
+        # Shut down for good; get_fetch_pool makes a new one
+        fetch_pool["pool"] = None
+    shutdown_event.clear()
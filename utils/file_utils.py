@@ -1,119 +1,975 @@
+import errno
+import mimetypes
 import os
+import re
+import socket
 import stat
 import threading
 import time
+from concurrent.futures import ThreadPoolExecutor
 from typing import cast
+from urllib.parse import unquote, urlparse
 
-import requests
-from pyfuse3 import ROOT_INODE, EntryAttributes, ModeT, FileHandleT
+import pyfuse3
+from pyfuse3 import EntryAttributes, ModeT, FileHandleT
 
+from shared.cache import block_cache
 from shared.files import (
-    CACHE_LOCK,
+    access_times,
+    add_file,
+    assign_inode,
     file_attributes_cache,
-    file_chunk_cache,
+    file_content_types,
+    file_freshness,
+    file_redirects,
+    file_vary,
+    find_by_url,
+    get_entry,
+    get_generation,
+    get_symlink,
+    get_url,
     inode_map,
-    source_files,
+    is_dir,
+    kernel_versions,
+    list_dir,
+    list_files,
+    list_paths,
+    local_fallbacks,
+    negative_cache,
 )
-from shared.requests import ONGOING_LOCK, ongoing_requests
-from utils.fetch_utils import fetch_chunks_sync
-from config.constants import MAX_FH
+from shared.requests import fuse_mounted, shutdown_event
+from shared.stats import stats
+from utils.fetch_utils import (
+    DECODABLE_ENCODINGS,
+    DEFAULT_PORTS,
+    FetchError,
+    accept_encoding,
+    cancel_full_download,
+    content_encoding,
+    fetch_full_body,
+    freshness_lifetime,
+    get_cached_chunk,
+    host_key,
+    invalidate_chunks,
+    is_chunk_cached,
+    is_network_error,
+    mark_full_fetch,
+    parse_content_range_total,
+    parse_vary,
+    parse_http_date,
+    raise_for_status,
+    read_chunks,
+    same_origin,
+    send_file_request,
+    set_no_store,
+    set_stream_only,
+)
+from config.constants import (
+    FETCH_WORKERS,
+    INDEX_FILE,
+    MAX_FH,
+    REDIRECTS_DIR,
+    RELATIME_INTERVAL,
+)
+from config.settings import cache_config, client_config, mount_config
 
 from .logger import log_time, logger
 
+# When the filesystem started: the mtime of directories whose files' times
+# aren't known yet
+STARTED_NS = time.time_ns()
+
 
 @log_time
 def get_file_attr(filename: str) -> EntryAttributes:
+    attr = _file_attr(filename)
+    attr.st_atime_ns = access_time(attr)
+    stats.size(filename, attr.st_size)
+    return attr
+
+
+def _file_attr(filename):
     logger.debug("Getting file attributes for '%s'", filename)
-    if filename in file_attributes_cache:
+    cached = file_attributes_cache.get(filename)
+    freshness = file_freshness.get(filename)
+    if freshness is None:
+        cached = None
+    elif cached is not None and (
+        time.time() - freshness["checked_at"] < freshness["ttl"]
+    ):
         logger.debug("Returning cached file attributes for '%s'", filename)
-        return file_attributes_cache[filename]
+        return cached
 
-    inode = inode_map.get(filename)
-    url = source_files.get(filename)
-    if inode is None or url is None:
+    entry = get_entry(filename)
+    if entry is None:
         logger.error("File not found: '%s'", filename)
         raise FileNotFoundError
+    inode = assign_inode(filename)
+    if is_serving_local(filename):
+        return local_file_attr(filename, entry, inode)
+
+    negative = negative_cache.get(filename)
+    if negative is not None:
+        err, expires_at = negative
+        if time.time() < expires_at:
+            logger.debug("Returning cached failure for '%s'", filename)
+            raise FetchError(f"'{filename}' recently failed", err)
+        negative_cache.pop(filename, None)
+
+    # A compressible file the origin answers gzipped is fetched whole below
+    headers = {**entry["headers"], "Accept-Encoding": accept_encoding(entry)}
+    if cached is not None:
+        # Stale: a 304 keeps the cached attributes and blocks.
+        if freshness["etag"]:
+            headers["If-None-Match"] = freshness["etag"]
+        if freshness["last_modified"]:
+            headers["If-Modified-Since"] = freshness["last_modified"]
 
+    # Only cache sizes the server actually told us about; transient failures
+    # should be retried on the next getattr.
+    cacheable = True
+    # Set when the size is a stand-in for one we couldn't learn
+    provisional = False
+    last_modified = None
+    link = None
     try:
-        logger.info("Fetching HEAD from remote")
-        r = requests.head(url, allow_redirects=True)
-        size = int(r.headers.get("Content-Length", 0))
+        if is_index_url(entry["url"]) and not client_config.head_index_urls:
+            logger.info("Probing index URL of '%s' with a ranged GET", filename)
+            r = range_probe(entry, headers)
+        else:
+            logger.info("Fetching HEAD from remote")
+            r = send_file_request("HEAD", entry, headers=headers)
+        if r.status_code in (405, 501):
+            logger.info(
+                "HEAD unsupported for '%s'; probing with a ranged GET", filename
+            )
+            r = range_probe(entry, headers)
+        raise_for_status(r)
+        if local_fallbacks.pop(filename, None) is not None:
+            logger.info("'%s' is reachable again; serving it remotely", filename)
+        ttl = freshness_lifetime(r)
+        vary = parse_vary(r)
+        if entry["cacheable"] is False or "*" in vary:
+            # Treated like no-store, so every access revalidates; Vary: * says
+            # no stored response may be reused
+            ttl = None
+        if cached is not None:
+            if r.status_code == 304:
+                if ttl is None:
+                    # The origin now forbids caching; answer once more, then forget
+                    file_attributes_cache.pop(filename, None)
+                    file_freshness.pop(filename, None)
+                    invalidate_chunks(inode, entry)
+                    set_no_store(entry["url"], True)
+                else:
+                    logger.debug("'%s' not modified; keeping cached blocks", filename)
+                    freshness["checked_at"] = time.time()
+                    freshness["ttl"] = ttl
+                return cached
+            logger.info("'%s' changed on the server; refetching", filename)
+            file_attributes_cache.pop(filename, None)
+            file_freshness.pop(filename, None)
+            invalidate_chunks(inode, entry)
+        if mount_config.redirect_symlinks and r.permanent_redirect:
+            link = redirect_link(filename, entry, r.permanent_redirect)
+        if link is None:
+            file_redirects.pop(filename, None)
+        set_no_store(entry["url"], ttl is None)
+        if ttl is None:
+            # no-store: serve this response but keep nothing from it
+            cacheable = False
+        if r.headers.get("Accept-Ranges", "").strip().lower() == "none":
+            # Don't bother with Range requests the server says it will ignore;
+            # without the header fetch_chunk learns from 200 vs 206 instead.
+            mark_full_fetch(entry["url"], "server sends Accept-Ranges: none")
+        content_length = r.headers.get("Content-Length")
+        probe = r
+        if content_length is None and link is None and r.status_code != 206:
+            logger.info(
+                "No Content-Length for '%s'; probing with a ranged GET", filename
+            )
+            probe = range_probe(entry, entry["headers"])
+            raise_for_status(probe)
+            content_length = probe.headers.get("Content-Length")
+        if probe.status_code == 206:
+            # Content-Length covers the one byte; the total is in Content-Range
+            total = parse_content_range_total(probe.headers.get("Content-Range"))
+            content_length = str(total) if total is not None else None
+        if link is not None:
+            size = len(os.fsencode(link))
+        elif content_encoding(r) in DECODABLE_ENCODINGS:
+            # Content-Length is the compressed size; the real size is only
+            # known once the body has been downloaded and decoded.
+            mark_full_fetch(entry["url"], f"Content-Encoding {content_encoding(r)}")
+            _, size = fetch_full_body(inode, entry, cache_config.chunk_size, (0, 0))
+        elif content_length is None:
+            # Reads stream the body front to back until it ends
+            logger.warning(
+                "No Content-Length for '%s'; reporting size 0 and streaming reads",
+                filename,
+            )
+            size = 0
+        elif not content_length.strip().isdigit():
+            # int() would accept "-1" or "+5"; a negative size can't be reported
+            logger.warning(
+                "Invalid Content-Length %r for '%s'; reporting size 0",
+                content_length,
+                filename,
+            )
+            size = 0
+        else:
+            size = int(content_length)
+        set_stream_only(
+            entry["url"],
+            link is None
+            and content_length is None
+            and content_encoding(r) not in DECODABLE_ENCODINGS,
+        )
         logger.debug("Size of '%s': %d bytes", filename, size)
+        last_modified = parse_http_date(r.headers.get("Last-Modified"))
+        content_type = r.headers.get("Content-Type")
+        if content_type:
+            file_content_types[filename] = content_type
+        file_vary[filename] = vary
+    except FetchError as e:
+        if e.errno in (errno.ENOENT, errno.EACCES) and cache_config.negative_ttl > 0:
+            expires_at = time.time() + cache_config.negative_ttl
+            negative_cache[filename] = (e.errno, expires_at)
+        if fall_back_to_local(filename, entry, e):
+            return local_file_attr(filename, entry, inode)
+        raise
     except Exception as e:
         logger.error("Error fetching HEAD for '%s': %s", filename, e)
+        if cached is not None:
+            # Keep serving what we have if only the revalidation failed
+            return cached
         size = 0
+        cacheable = False
+        provisional = True
+
+    # Without Last-Modified the file is reported as changed just now
+    mtime_ns = int(last_modified * 1e9) if last_modified is not None else None
+    attr = make_file_attr(inode, size, mtime_ns)
+    if link is not None:
+        attr.st_mode = cast(ModeT, stat.S_IFLNK | 0o777)
+    if provisional:
+        # The kernel keeps lookup and getattr replies for their timeouts; a
+        # stand-in size must not outlive this call, or a stat right after the
+        # lookup would report it instead of asking again
+        attr.attr_timeout = 0
+        attr.entry_timeout = 0
+    elif entry["cacheable"] is False:
+        # Nor may the kernel reuse the attributes of a file never cached
+        attr.attr_timeout = 0
+        attr.entry_timeout = 0
+
+    if cacheable:
+        file_freshness[filename] = {
+            "etag": r.headers.get("ETag"),
+            "last_modified": r.headers.get("Last-Modified"),
+            "checked_at": time.time(),
+            "ttl": ttl,
+        }
+        file_attributes_cache[filename] = attr
+    return attr
+
+
+def range_probe(entry, headers):
+    """
+    A `Range: bytes=0-0` GET standing in for HEAD, closed before any body is
+    read; a 206's Content-Range carries the file's total size.
+    """
+    r = send_file_request(
+        "GET", entry, headers={**headers, "Range": "bytes=0-0"}, stream=True
+    )
+    r.close()
+    return r
+
+
+def render_index():
+    """
+    Contents of INDEX_FILE: a tab-separated line per mapped file giving its
+    URL, last known size ("?" before the first HEAD) and status.
+    """
+    lines = ["# name\turl\tsize\tstatus"]
+    for filename in list_files():
+        url = get_url(filename)
+        if url is None:
+            continue
+        attr = file_attributes_cache.get(filename)
+        size = str(attr.st_size) if attr is not None else "?"
+        file_stats = stats.get(filename) or {}
+        if is_serving_local(filename):
+            status = "unreachable, serving local copy"
+        elif file_stats.get("last_error"):
+            status = f"last error: {file_stats['last_error']}"
+        else:
+            status = "ok"
+        lines.append("\t".join([filename, url, size, status]))
+    return ("\n".join(lines) + "\n").encode("utf-8")
+
+
+def get_index_attr():
+    """
+    Attributes of INDEX_FILE, sized by rendering it now.
+    """
+    return make_file_attr(assign_inode(INDEX_FILE), len(render_index()))
+
+
+def host_dir(url):
+    """
+    Directory name for `url`'s host under group_by_host: the lowercased host,
+    bracketed if an IPv6 literal, plus the port unless it's the default.
+    """
+    parsed = urlparse(url)
+    host = (parsed.hostname or "").lower()
+    if ":" in host:
+        host = f"[{host}]"
+    if parsed.port and parsed.port != DEFAULT_PORTS.get(parsed.scheme):
+        host += f":{parsed.port}"
+    return host
+
+
+def layout_name(name, url):
+    """
+    Store name for a file added as `name` with primary URL `url`: grouped
+    under its host's directory when mount_config.group_by_host is set.
+    """
+    if mount_config.group_by_host:
+        return f"{host_dir(url)}/{name}"
+    return name
+
+
+def is_index_url(url):
+    """
+    Whether `url` names a directory's index document: its path is empty or
+    ends in "/".
+    """
+    path = urlparse(url).path
+    return path == "" or path.endswith("/")
+
+
+def url_filename(url):
+    """
+    Name for a file mapped to `url` without one: its last path segment, or
+    mount_config.index_name for index URLs, made safe to list (see
+    mount_config.name_query).
+    """
+    parsed = urlparse(url)
+    if is_index_url(url):
+        name = mount_config.index_name
+    else:
+        name = unquote(parsed.path.rpartition("/")[2])
+    if mount_config.name_query and parsed.query:
+        name += f"?{unquote(parsed.query)}"
+    # Decoding may have produced separators; "." and ".." can't be files
+    name = re.sub(r"[/\x00-\x1f\x7f]", "_", name)
+    return "_" * len(name) if name in (".", "..") else name
+
+
+def redirect_name(url):
+    """
+    Path under REDIRECTS_DIR that a redirect target `url` is mapped to, e.g.
+    .redirects/example.com/new/name.
+    """
+    parsed = urlparse(url)
+    parts = [
+        part
+        for part in f"{host_key(url)}{parsed.path}".split("/")
+        if part not in ("", ".", "..")
+    ]
+    if len(parts) == 1 or parsed.path.endswith("/"):
+        parts.append("index")
+    if parsed.query:
+        parts[-1] += f"?{parsed.query}"
+    return "/".join([REDIRECTS_DIR, *parts])
 
+
+def redirect_link(filename, entry, target):
+    """
+    Relative symlink target for `filename`, whose URL permanently redirects to
+    `target`. A file already mapped to `target` is linked to; otherwise one is
+    added under REDIRECTS_DIR. None if that name is taken by something else.
+    """
+    name = find_by_url(target, exclude=filename)
+    if name is None:
+        name = redirect_name(target)
+        try:
+            add_file(
+                name,
+                target,
+                auth=entry["auth"] if same_origin(target, entry["url"]) else None,
+                headers=entry["headers"],
+                signer=(
+                    entry["signer"] if same_origin(target, entry["url"]) else None
+                ),
+            )
+        except ValueError as e:
+            if get_url(name) != target:
+                logger.warning("Can't link '%s' to %s: %s", filename, target, e)
+                return None
+        logger.info("'%s' permanently redirects to %s", filename, target)
+    link = os.path.relpath(name, os.path.dirname(filename) or ".")
+    file_redirects[filename] = link
+    return link
+
+
+def make_file_attr(inode, size, mtime_ns=None):
+    """
+    Attributes of a read-only regular file; `mtime_ns` defaults to now.
+    """
     now_ns = int(time.time() * 1e9)
+    if mtime_ns is None:
+        mtime_ns = now_ns
     attr = EntryAttributes()
     attr.st_ino = inode
-    attr.st_mode = cast(ModeT, stat.S_IFREG | 0o444)
+    attr.generation = get_generation(inode)
+    attr.st_mode = cast(ModeT, stat.S_IFREG | mount_config.file_mode)
     attr.st_size = size
-    attr.st_uid = os.getuid()
-    attr.st_gid = os.getgid()
-    attr.st_atime_ns = now_ns
-    attr.st_mtime_ns = now_ns
-    attr.st_ctime_ns = now_ns
+    attr.st_blksize = block_size()
+    attr.st_blocks = (size + 511) // 512  # st_blocks is always in 512-byte units
+    attr.st_uid, attr.st_gid = owner()
+    attr.st_mtime_ns = mtime_ns
+    attr.st_ctime_ns = mtime_ns
+    attr.st_atime_ns = access_time(attr)
     attr.st_nlink = 1
+    attr.attr_timeout = cache_config.attr_timeout
+    attr.entry_timeout = cache_config.attr_timeout
+    return attr
 
-    file_attributes_cache[filename] = attr
+
+def placeholder_attr(filename):
+    """
+    Attributes of a file whose size couldn't be learned: size 0, not to be
+    kept by the kernel, so the next stat asks again.
+    """
+    attr = make_file_attr(assign_inode(filename), 0)
+    attr.attr_timeout = 0
+    attr.entry_timeout = 0
     return attr
 
 
+def block_size():
+    """
+    Block size to report, per mount_config.block_size.
+    """
+    return mount_config.block_size or cache_config.chunk_size
+
+
+def owner():
+    """
+    (uid, gid) to report, defaulting to the mounting user's.
+    """
+    uid = mount_config.uid if mount_config.uid is not None else os.getuid()
+    gid = mount_config.gid if mount_config.gid is not None else os.getgid()
+    return uid, gid
+
+
+def may_access(mode, want, uid, gid):
+    """
+    Whether a caller with `uid` and `gid` may access an entry with permission
+    bits `mode` for `want` (os.R_OK | os.X_OK bits), going by the owner we
+    report. Root may read anything and execute anything with an x bit.
+    """
+    owner_uid, owner_gid = owner()
+    if uid == 0:
+        return not want & os.X_OK or bool(mode & 0o111)
+    if uid == owner_uid:
+        granted = mode >> 6
+    elif gid == owner_gid:
+        granted = mode >> 3
+    else:
+        granted = mode
+    return not want & ~granted & 0o7
+
+
+def access_time(attr):
+    """
+    The atime to report for `attr`: its last recorded read, else its mtime.
+    """
+    return access_times.get(attr.st_ino, attr.st_mtime_ns)
+
+
+def record_access(inode, mtime_ns):
+    """
+    Note a read of `inode`, advancing its atime as mount_config.atime allows.
+    """
+    if mount_config.atime == "noatime":
+        return
+    now_ns = int(time.time() * 1e9)
+    if mount_config.atime == "relatime":
+        previous = access_times.get(inode, mtime_ns)
+        if previous > mtime_ns and now_ns - previous < RELATIME_INTERVAL * 1e9:
+            return
+    access_times[inode] = now_ns
+
+
+def is_serving_local(filename):
+    """
+    Whether `filename` is being served from its local copy for now.
+    """
+    retry_at = local_fallbacks.get(filename)
+    return retry_at is not None and time.time() < retry_at
+
+
+def fall_back_to_local(filename, entry, e):
+    """
+    Switch `filename` to its local copy if it has one and `e` says the network
+    is unreachable. The remote is tried again after negative_ttl seconds.
+    Returns whether reads should use the local copy.
+    """
+    if not entry.get("local_path") or not is_network_error(e):
+        return False
+    if filename not in local_fallbacks:
+        logger.warning(
+            "'%s' is unreachable (%s); serving local copy %s",
+            filename,
+            e,
+            entry["local_path"],
+        )
+    local_fallbacks[filename] = time.time() + cache_config.negative_ttl
+    return True
+
+
+def local_file_attr(filename, entry, inode):
+    """
+    Attributes of `filename` taken from its local copy.
+    """
+    try:
+        st = os.stat(entry["local_path"])
+    except OSError as e:
+        raise FetchError(
+            f"local copy of '{filename}' unavailable: {e}", e.errno or errno.EIO
+        ) from e
+    return make_file_attr(inode, st.st_size, st.st_mtime_ns)
+
+
+def read_local(filename, entry, off, size):
+    """
+    Up to `size` bytes at `off` from `filename`'s local copy.
+    """
+    logger.debug("Reading '%s' from local copy %s", filename, entry["local_path"])
+    try:
+        with open(entry["local_path"], "rb") as f:
+            return os.pread(f.fileno(), size, off)
+    except OSError as e:
+        raise FetchError(
+            f"local copy of '{filename}' unreadable: {e}", e.errno or errno.EIO
+        ) from e
+
+
+def extension_alias(filename):
+    """
+    `filename` plus an extension guessed from its Content-Type, when that mode
+    is on, the name has no extension yet and nothing else already uses the
+    longer name. Otherwise None.
+    """
+    if not mount_config.content_type_extensions:
+        return None
+    basename = filename.rpartition("/")[2]
+    content_type = file_content_types.get(filename)
+    if "." in basename or not content_type:
+        return None
+    extension = mimetypes.guess_extension(content_type.split(";")[0].strip())
+    if extension is None:
+        return None
+    alias = filename + extension
+    if get_url(alias) is not None or is_dir(alias):
+        return None
+    return alias
+
+
+def resolve_alias(path):
+    """
+    The mapped filename that `path` is the extension alias of, or None.
+    """
+    base, extension = os.path.splitext(path)
+    if not mount_config.content_type_extensions or not extension:
+        return None
+    if get_url(base) is None:
+        return None
+    if base not in file_content_types:
+        # Looked up before anything listed the directory; HEAD it now
+        try:
+            get_file_attr(base)
+        except (FileNotFoundError, FetchError):
+            return None
+    return base if extension_alias(base) == path else None
+
+
+def check_file(filename):
+    """
+    HEAD `filename`'s URL (mirrors, auth and headers included). Returns None if
+    it answered with a success status, else a description of the failure.
+    """
+    entry = get_entry(filename)
+    if entry is None:
+        return "not in the store"
+    try:
+        r = send_file_request("HEAD", entry, headers=entry["headers"])
+        r.close()
+        raise_for_status(r)
+    except FetchError as e:
+        return str(e)
+    return None
+
+
+@log_time
+def check_files(parallelism=FETCH_WORKERS):
+    """
+    Check every mapped URL concurrently, at most `parallelism` at a time.
+    Returns {filename: failure} for the ones that didn't answer successfully.
+    """
+    filenames = list_files()
+    with ThreadPoolExecutor(max_workers=max(1, parallelism)) as pool:
+        results = pool.map(check_file, filenames)
+    failures = {name: err for name, err in zip(filenames, results) if err}
+    logger.info("Checked %d URLs: %d failed", len(filenames), len(failures))
+    return failures
+
+
+def origins(extra_urls=()):
+    """
+    (host, port) of every file's URLs and mirrors and of `extra_urls`; just the
+    proxy's if one is configured, since that's all we connect to then.
+    """
+    if client_config.proxy:
+        urls = [client_config.proxy]
+    else:
+        urls = list(extra_urls)
+        for filename in list_files():
+            entry = get_entry(filename)
+            if entry is not None:
+                urls.extend(entry["mirrors"])
+    targets = set()
+    for url in urls:
+        parsed = urlparse(url)
+        port = parsed.port or DEFAULT_PORTS.get(parsed.scheme)
+        if parsed.hostname and port:
+            targets.add((parsed.hostname, port))
+    return targets
+
+
+@log_time
+def wait_for_network(timeout, interval, extra_urls=()):
+    """
+    Block until one of the origins (see origins) accepts a TCP connection, for
+    at most `timeout` seconds, trying them all every `interval` seconds.
+    Returns whether one did.
+    """
+    targets = origins(extra_urls)
+    if not targets:
+        return True
+    deadline = time.monotonic() + timeout
+    while True:
+        for host, port in targets:
+            try:
+                socket.create_connection(
+                    (host, port), timeout=min(interval, client_config.connect_timeout)
+                ).close()
+            except OSError:
+                continue
+            logger.info("Network is up: %s:%d accepted a connection", host, port)
+            return True
+        remaining = deadline - time.monotonic()
+        if remaining <= 0:
+            logger.warning("No origin reachable after %.0fs; mounting anyway", timeout)
+            return False
+        logger.info("Waiting for the network: no origin reachable yet")
+        if shutdown_event.wait(min(interval, remaining)):
+            return False
+
+
+def preassign_inodes():
+    """
+    Hand out the inodes of what's in the store before mounting: every file,
+    or every path with mount_config.eager_inodes.
+    """
+    for path in list_paths() if mount_config.eager_inodes else list_files():
+        assign_inode(path)
+
+
+def prefetch_attr(filename):
+    """
+    Fetch `filename`'s attributes into the cache. Returns None on success,
+    else a description of the failure (its size stays unknown until a later
+    getattr succeeds).
+    """
+    try:
+        get_file_attr(filename)
+    except FileNotFoundError:
+        return "not in the store"
+    except FetchError as e:
+        stats.error(filename, e)
+        return str(e)
+    return None
+
+
+@log_time
+def prefetch_attrs(parallelism=FETCH_WORKERS):
+    """
+    Fill the attribute cache for every mapped file, at most `parallelism`
+    HEADs at a time, so the first listing doesn't wait on them one by one.
+    Returns {filename: failure} for the ones that failed.
+    """
+    filenames = list_files()
+    with ThreadPoolExecutor(max_workers=max(1, parallelism)) as pool:
+        results = pool.map(prefetch_attr, filenames)
+    failures = {name: err for name, err in zip(filenames, results) if err}
+    for filename, failure in sorted(failures.items()):
+        logger.warning("Prefetching the size of '%s' failed: %s", filename, failure)
+    logger.info(
+        "Prefetched sizes of %d files (%d failed)",
+        len(filenames) - len(failures),
+        len(failures),
+    )
+    return failures
+
+
+def warm_file(filename):
+    """
+    Download `filename`'s missing chunks into the cache through the normal
+    read path, a batch of max_concurrent_chunks at a time. Returns None on
+    success, else a description of the failure.
+    """
+    entry = get_entry(filename)
+    if entry is None:
+        return "not in the store"
+    try:
+        total_size = get_file_attr(filename).st_size
+        inode = assign_inode(filename)
+        chunk_size = cache_config.chunk_size
+        missing = [
+            offset
+            for offset in range(0, total_size, chunk_size)
+            if not is_chunk_cached(inode, entry, offset, chunk_size)
+        ]
+        if not missing:
+            logger.debug("'%s' is already cached", filename)
+            return None
+        batch = max(1, client_config.max_concurrent_chunks)
+        for i in range(0, len(missing), batch):
+            read_chunks(inode, entry, missing[i : i + batch], chunk_size, total_size)
+        if mount_config.kernel_cache:
+            push_to_kernel(filename, inode, entry, total_size)
+    except FileNotFoundError:
+        return "not in the store"
+    except FetchError as e:
+        stats.error(filename, e)
+        return str(e)
+    return None
+
+
+def file_version(filename):
+    """
+    (ETag, Last-Modified) of the cached version of `filename`, or None if it
+    has neither (or isn't cached).
+    """
+    freshness = file_freshness.get(filename)
+    if freshness is None or not (freshness["etag"] or freshness["last_modified"]):
+        return None
+    return freshness["etag"], freshness["last_modified"]
+
+
+def keep_kernel_cache(filename, inode):
+    """
+    Whether an open of `filename` may keep the kernel's cached pages: only
+    when they are of the version cached now. Records that version as the one
+    the kernel holds from here on.
+    """
+    version = file_version(filename)
+    previous = kernel_versions.get(inode)
+    kernel_versions[inode] = version
+    return version is not None and version == previous
+
+
+def push_to_kernel(filename, inode, entry, total_size):
+    """
+    Store `filename`'s cached blocks in the kernel's page cache. Stops quietly
+    if the kernel has dropped the inode (or never looked it up).
+    """
+    if not fuse_mounted.is_set():
+        return
+    chunk_size = cache_config.chunk_size
+    for offset in range(0, total_size, chunk_size):
+        data = get_cached_chunk(inode, entry, offset, chunk_size)
+        if data is None:
+            continue
+        try:
+            pyfuse3.notify_store(inode, offset, data)
+        except OSError as e:
+            logger.debug("Not pushing '%s' to the kernel: %s", filename, e)
+            return
+    kernel_versions[inode] = file_version(filename)
+
+
+@log_time
+def warm_cache(filenames, parallelism=FETCH_WORKERS):
+    """
+    Pull the bodies of `filenames` into the cache, at most `parallelism` files
+    at a time. Returns {filename: failure} for those that couldn't be cached.
+    """
+    with ThreadPoolExecutor(max_workers=max(1, parallelism)) as pool:
+        results = pool.map(warm_file, filenames)
+    failures = {name: err for name, err in zip(filenames, results) if err}
+    for filename, failure in sorted(failures.items()):
+        logger.warning("Warming the cache for '%s' failed: %s", filename, failure)
+    logger.info(
+        "Warmed the cache for %d files (%d failed)",
+        len(filenames) - len(failures),
+        len(failures),
+    )
+    return failures
+
+
+def invalidate_file(filename):
+    """
+    Forget everything cached about `filename`, as if it had never been read:
+    its attributes, a remembered failure and its memory and disk blocks.
+    Returns its inode, or None if it isn't mapped.
+    """
+    entry = get_entry(filename)
+    if entry is None:
+        return None
+    inode = assign_inode(filename)
+    file_attributes_cache.pop(filename, None)
+    file_freshness.pop(filename, None)
+    negative_cache.pop(filename, None)
+    file_content_types.pop(filename, None)
+    # A download under way could cache more of the old version
+    cancel_full_download(inode)
+    invalidate_chunks(inode, entry)
+    kernel_versions.pop(inode, None)
+    return inode
+
+
+def sweep_caches():
+    """
+    Drop the in-memory blocks of files whose attributes are past their TTL,
+    unless a handle is still open on them, and negative entries that have
+    expired. Freshness records are kept, so the next access to a swept file
+    still revalidates it conditionally (and drops its disk blocks if it
+    changed).
+    """
+    now = time.time()
+    stale = [
+        filename
+        for filename, freshness in list(file_freshness.items())
+        if now - freshness["checked_at"] >= freshness["ttl"]
+    ]
+    with FH_LOCK:
+        busy = set(open_counts)
+    inodes = {inode_map[name] for name in stale if name in inode_map} - busy
+    dropped = block_cache.invalidate_inodes(inodes) if inodes else 0
+    for filename, (_, expires_at) in list(negative_cache.items()):
+        if now >= expires_at:
+            negative_cache.pop(filename, None)
+    if dropped:
+        logger.info("Swept %d cached blocks of %d stale files", dropped, len(inodes))
+
+
+def sweep_periodically(interval):
+    while not shutdown_event.wait(interval):
+        try:
+            sweep_caches()
+        except Exception:
+            logger.exception("Cache sweep failed")
+
+
+def start_sweeper():
+    """
+    Sweep caches every cache_config.sweep_interval seconds until shutdown.
+    """
+    if cache_config.sweep_interval > 0:
+        threading.Thread(
+            target=sweep_periodically,
+            args=(cache_config.sweep_interval,),
+            daemon=True,
+        ).start()
+
+
 @log_time
 def get_root_attr() -> EntryAttributes:
-    logger.debug("Getting root attributes")
-    now_ns = int(time.time() * 1e9)
+    return get_dir_attr("")
+
+
+def dir_mtime_ns(path):
+    """
+    Latest known mtime of the files under directory `path`, or when the
+    filesystem started if none is known yet; never triggers a HEAD.
+    """
+    prefix = f"{path}/" if path else ""
+    return max(
+        (
+            attr.st_mtime_ns
+            for filename, attr in list(file_attributes_cache.items())
+            if filename.startswith(prefix)
+        ),
+        default=STARTED_NS,
+    )
+
+
+@log_time
+def get_symlink_attr(path) -> EntryAttributes:
+    """
+    Attributes of symlink `path` declared in the manifest; its size is the
+    length of the target, as lstat reports.
+    """
+    target = get_symlink(path)
+    if target is None:
+        raise FileNotFoundError(path)
+    attr = make_file_attr(assign_inode(path), len(os.fsencode(target)), STARTED_NS)
+    attr.st_mode = cast(ModeT, stat.S_IFLNK | 0o777)
+    return attr
+
+
+def get_dir_attr(path) -> EntryAttributes:
+    """
+    Attributes of synthesized directory `path` ("" is the root). Its link
+    count is 2 plus one per subdirectory, as find and du expect.
+    """
+    logger.debug("Getting directory attributes for '%s'", path)
+    inode = assign_inode(path)
+    _, dirs = list_dir(path)
+    mtime_ns = dir_mtime_ns(path)
     attr = EntryAttributes()
-    attr.st_ino = ROOT_INODE
-    # Mark directory mode with 755 perms
-    attr.st_mode = cast(ModeT, stat.S_IFDIR | 0o755)
-    attr.st_uid = os.getuid()
-    attr.st_gid = os.getgid()
+    attr.st_ino = inode
+    attr.generation = get_generation(inode)
+    attr.st_mode = cast(ModeT, stat.S_IFDIR | mount_config.dir_mode)
+    attr.st_uid, attr.st_gid = owner()
     attr.st_size = 0
-    attr.st_atime_ns = now_ns
-    attr.st_mtime_ns = now_ns
-    attr.st_ctime_ns = now_ns
-    attr.st_nlink = 2
+    attr.st_blksize = block_size()
+    attr.st_mtime_ns = mtime_ns
+    attr.st_ctime_ns = mtime_ns
+    attr.st_atime_ns = access_time(attr)
+    attr.st_nlink = 2 + len(dirs)
+    attr.attr_timeout = cache_config.attr_timeout
+    attr.entry_timeout = cache_config.attr_timeout
     return attr
 
 
-@log_time
-def get_file_chunk(file_url, chunk_start, chunk_size, total_size):
-    cache_key = (file_url, chunk_start)
-    with CACHE_LOCK:
-        if cache_key in file_chunk_cache:
-            return file_chunk_cache[cache_key]
-
-    is_ongoing = False
-    with ONGOING_LOCK:
-        event = ongoing_requests.get(cache_key)
-        if event:
-            is_ongoing = True
-        else:
-            event = threading.Event()
-            ongoing_requests[cache_key] = event
-    if is_ongoing:
-        # Wait for the fetching thread to complete
-        event.wait()
-        with CACHE_LOCK:
-            return file_chunk_cache.get(cache_key, b"")
-    else:
-        chunk = fetch_chunks_sync(file_url, chunk_start, chunk_size, total_size)
-        with CACHE_LOCK:
-            file_chunk_cache[cache_key] = chunk
-        with ONGOING_LOCK:
-            ongoing_requests[cache_key].set()  # important to signal waiting threads
-            del ongoing_requests[cache_key]
-        return chunk
+def get_known_total_size():
+    """
+    Sum of the sizes we've already learned; never triggers a HEAD.
+    """
+    return sum(attr.st_size for attr in list(file_attributes_cache.values()))
 
 
 _next_fh = 1
 FH_LOCK = threading.Lock()
 # Mapping: file handle -> metadata dictionary (e.g. inode and allocation timestamp)
 open_handles = {}
+# inode -> handles open on it, under FH_LOCK. State shared by a file's
+# handles (its on-demand download, its cached blocks) is only torn down once
+# this drops to zero, so one process closing the file doesn't stall another
+open_counts = {}
 
 
-def get_next_fh(inode):
+def get_next_fh(inode, url=None):
+    """
+    Allocate a handle for `inode`; `url` is the source URL a file resolved to
+    when it was opened (None for directories).
+    """
     global _next_fh
     with FH_LOCK:
         candidate = _next_fh
@@ -121,5 +977,47 @@ def get_next_fh(inode):
         while candidate in open_handles:
             candidate = _next_fh
             _next_fh = (_next_fh + 1) % MAX_FH
-        open_handles[candidate] = {"inode": inode, "allocated_at": time.time()}
+        open_counts[inode] = open_counts.get(inode, 0) + 1
+        open_handles[candidate] = {
+            "inode": inode,
+            "url": url,
+            "allocated_at": time.time(),
+            # Where a sequential reader's next read would start; advanced as
+            # each read begins, under FH_LOCK
+            "next_offset": 0,
+            # Set on release to abort downloads still running for this handle
+            "cancel": threading.Event(),
+        }
         return FileHandleT(candidate)
+
+
+def open_count(inode):
+    """
+    Number of handles currently open on `inode`.
+    """
+    with FH_LOCK:
+        return open_counts.get(inode, 0)
+
+
+def release_fh(fh):
+    """
+    Free `fh`, aborting any download still running for it (including the
+    file's on-demand whole download, if it was the last handle on the file).
+    Returns the handle's details, or None if it wasn't open.
+    """
+    last = False
+    with FH_LOCK:
+        handle_details = open_handles.pop(fh, None)
+        if handle_details is not None:
+            inode = handle_details["inode"]
+            remaining = open_counts.pop(inode, 1) - 1
+            if remaining > 0:
+                open_counts[inode] = remaining
+            last = remaining <= 0
+    if handle_details is not None:
+        handle_details["cancel"].set()
+        if last and handle_details["url"] is not None:
+            cancel_full_download(handle_details["inode"])
+        if handle_details.get("stream") is not None:
+            handle_details["stream"].close()
+    return handle_details
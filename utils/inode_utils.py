@@ -0,0 +1,57 @@
+import json
+import os
+
+from shared.files import restore_inodes, snapshot_inodes
+
+from .logger import logger
+
+
+def save_inode_map(path):
+    """
+    Write the filename -> inode map to `path`, atomically so a crash mid-write
+    leaves the previous copy intact.
+    """
+    inodes, generations, next_inode = snapshot_inodes()
+    tmp_path = f"{path}.tmp"
+    with open(tmp_path, "w") as f:
+        json.dump(
+            {
+                "next_inode": next_inode,
+                "inodes": inodes,
+                # JSON object keys are strings
+                "generations": {str(ino): gen for ino, gen in generations.items()},
+            },
+            f,
+        )
+    os.replace(tmp_path, path)
+    logger.info("Saved %d inodes to %s", len(inodes), path)
+
+
+def load_inode_map(path):
+    """
+    Restore inodes saved by save_inode_map for names still in the store. Call
+    after the manifest is loaded and before any new inodes are assigned. A
+    missing file is not an error; returns the number of inodes restored.
+    """
+    try:
+        with open(path) as f:
+            saved = json.load(f)
+    except FileNotFoundError:
+        return 0
+    inodes = saved.get("inodes", {})
+    if not isinstance(inodes, dict) or not all(
+        isinstance(ino, int) for ino in inodes.values()
+    ):
+        raise ValueError(f"{path}: inodes must map names to integers")
+    generations = {
+        int(ino): int(gen) for ino, gen in saved.get("generations", {}).items()
+    }
+    restored = restore_inodes(inodes, int(saved.get("next_inode", 0)), generations)
+    logger.info(
+        "Restored %d of %d saved inodes from %s; %d dropped",
+        restored,
+        len(inodes),
+        path,
+        len(inodes) - restored,
+    )
+    return restored
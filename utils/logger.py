@@ -1,24 +1,35 @@
 import logging
 import functools
+import os
 from datetime import datetime
 import time
 
-logger = logging.getLogger()
-logger.setLevel(logging.DEBUG)
+# Every module logs through this logger. Embedders route records wherever they
+# want by attaching handlers to "httpfs" instead of calling configure_logging.
+# Request headers are never logged, so Authorization values stay out of logs.
+logger = logging.getLogger("httpfs")
 
-console_handler = logging.StreamHandler()
-console_handler.setLevel(logging.DEBUG)
-file_handler = logging.FileHandler(
-    f"logs/httpfs_{datetime.now().strftime('%Y%m%d_%H%M%S')}.log"
-)
-file_handler.setLevel(logging.DEBUG)
 
-formatter = logging.Formatter("%(asctime)s [%(levelname)s] %(message)s")
-console_handler.setFormatter(formatter)
-file_handler.setFormatter(formatter)
-
-logger.addHandler(console_handler)
-logger.addHandler(file_handler)
+def configure_logging(level=logging.INFO, log_dir=None):
+    """
+    Log `level` and above to stderr and, with `log_dir`, to a timestamped file
+    in it as well.
+    """
+    formatter = logging.Formatter("%(asctime)s [%(levelname)s] %(message)s")
+    handlers = [logging.StreamHandler()]
+    if log_dir:
+        os.makedirs(log_dir, exist_ok=True)
+        handlers.append(
+            logging.FileHandler(
+                os.path.join(
+                    log_dir, f"httpfs_{datetime.now().strftime('%Y%m%d_%H%M%S')}.log"
+                )
+            )
+        )
+    for handler in handlers:
+        handler.setFormatter(formatter)
+        logger.addHandler(handler)
+    logger.setLevel(level)
 
 
 # Decorator to log elapsed time for each function/method.
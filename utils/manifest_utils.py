@@ -0,0 +1,331 @@
+import json
+from urllib.parse import urljoin
+
+import requests
+
+from config.settings import mount_config
+from shared.files import (
+    add_file,
+    add_symlink,
+    get_entry,
+    get_symlink,
+    get_url,
+    inode_map,
+    is_valid_url,
+    remove_file,
+    split_userinfo,
+    suffixed_name,
+    symlink_escapes,
+)
+from shared.requests import shutdown_event
+from utils.fetch_utils import (
+    FetchError,
+    invalidate_chunks,
+    make_auth,
+    raise_for_status,
+    send_request,
+    transport_error,
+)
+
+from utils.file_utils import layout_name, url_filename
+
+from .logger import logger
+
+
+def validate_entries(entries, source):
+    """
+    Check a list of manifest entries, naming `source` and the first offending
+    entry in the ValueError raised. Entries without a name are given their
+    URL's (see url_filename), made unique if mount_config.name_collisions is
+    "suffix". Symlink entries need a name and a target that stays inside the
+    mount unless mount_config.unsafe_symlinks is set.
+    """
+    if not isinstance(entries, list):
+        raise ValueError(f"{source}: manifest must be a JSON array")
+
+    seen = set()
+    for i, item in enumerate(entries):
+        if not isinstance(item, dict):
+            raise ValueError(f"{source}: entry {i} is not an object")
+        kind = item.get("type", "file")
+        if kind not in ("file", "symlink"):
+            raise ValueError(f"{source}: entry {i} has unknown type {kind!r}")
+        name = item.get("name")
+        if kind == "symlink":
+            validate_symlink(item, i, source, seen)
+            seen.add(name)
+            continue
+        url = item.get("url")
+        derived = name is None and isinstance(url, str) and is_valid_url(url)
+        if derived:
+            stripped = split_userinfo(url)[0]
+            name = url_filename(stripped)
+            if mount_config.name_collisions == "suffix" and (
+                name in seen
+                or get_url(layout_name(name, stripped)) not in (None, stripped)
+            ):
+                name = suffixed_name(name, stripped)
+            item["name"] = name
+        if not name or not isinstance(name, str):
+            raise ValueError(f"{source}: entry {i} has no name")
+        if name in seen:
+            hint = (
+                " derived from its URL (name_collisions 'suffix' tells them apart)"
+                if derived
+                else ""
+            )
+            raise ValueError(f"{source}: entry {i} duplicates name '{name}'{hint}")
+        if not isinstance(url, str) or not is_valid_url(url):
+            raise ValueError(f"{source}: entry {i} ('{name}') has invalid URL {url!r}")
+        mirrors = item.get("mirrors", [])
+        if not isinstance(mirrors, list) or not all(
+            isinstance(m, str) and is_valid_url(m) for m in mirrors
+        ):
+            raise ValueError(f"{source}: entry {i} ('{name}') has invalid mirrors")
+        if not isinstance(item.get("headers", {}), dict):
+            raise ValueError(
+                f"{source}: entry {i} ('{name}') headers must be an object"
+            )
+        if not isinstance(item.get("local_path", ""), str):
+            raise ValueError(
+                f"{source}: entry {i} ('{name}') local_path must be a string"
+            )
+        if not isinstance(item.get("content_type", ""), str):
+            raise ValueError(
+                f"{source}: entry {i} ('{name}') content_type must be a string"
+            )
+        for flag in ("cacheable", "compressible"):
+            if not isinstance(item.get(flag, False), bool):
+                raise ValueError(
+                    f"{source}: entry {i} ('{name}') {flag} must be a boolean"
+                )
+        seen.add(name)
+    return entries
+
+
+def validate_symlink(item, i, source, seen):
+    name = item.get("name")
+    if not name or not isinstance(name, str):
+        raise ValueError(f"{source}: entry {i} has no name")
+    if name in seen:
+        raise ValueError(f"{source}: entry {i} duplicates name '{name}'")
+    target = item.get("target")
+    if not target or not isinstance(target, str):
+        raise ValueError(f"{source}: entry {i} ('{name}') has no target")
+    if not mount_config.unsafe_symlinks and symlink_escapes(name, target):
+        raise ValueError(
+            f"{source}: entry {i} ('{name}') target '{target}' leads out of "
+            "the mount (unsafe_symlinks allows it)"
+        )
+
+
+def is_symlink(item):
+    return item.get("type") == "symlink"
+
+
+def item_name(item):
+    """
+    Name a validated manifest entry is mapped under; symlinks keep theirs as
+    given, files go through layout_name.
+    """
+    if is_symlink(item):
+        return item["name"]
+    return layout_name(item["name"], item["url"])
+
+
+def item_source(item):
+    """
+    What a validated entry maps its name to, comparable with mapped_source.
+    """
+    if is_symlink(item):
+        return ("symlink", item["target"])
+    return ("file", split_userinfo(item["url"])[0])
+
+
+def mapped_source(name):
+    """
+    What `name` is mapped to in the store, or None if nothing.
+    """
+    target = get_symlink(name)
+    if target is not None:
+        return ("symlink", target)
+    url = get_url(name)
+    return ("file", url) if url is not None else None
+
+
+def parse_manifest(path):
+    """
+    Read and validate a manifest of
+    `[{"name": ..., "url": ..., "headers": {...}}, ...]` entries. Entries may
+    also carry "mirrors": [url, ...], "local_path", "sha256", "cacheable",
+    "compressible", "content_type", "bearer_token" or "basic_auth":
+    [user, password].
+    `{"type": "symlink", "name": ..., "target": ...}` entries add a symlink
+    instead. Raises ValueError naming the first offending entry.
+    """
+    with open(path) as f:
+        entries = json.load(f)
+    return validate_entries(entries, path)
+
+
+def add_entry(item):
+    """
+    Add a manifest entry under its item_name, which is returned.
+    """
+    name = item_name(item)
+    if is_symlink(item):
+        add_symlink(name, item["target"], allow_unsafe=mount_config.unsafe_symlinks)
+        return name
+    basic_auth = item.get("basic_auth")
+    auth = make_auth(
+        bearer_token=item.get("bearer_token"),
+        basic_auth=tuple(basic_auth) if basic_auth else None,
+    )
+    add_file(
+        name,
+        item["url"],
+        auth=auth,
+        headers=item.get("headers"),
+        mirrors=item.get("mirrors"),
+        local_path=item.get("local_path"),
+        sha256=item.get("sha256"),
+        cacheable=item.get("cacheable"),
+        compressible=item.get("compressible", False),
+        content_type=item.get("content_type"),
+    )
+    return name
+
+
+def load_manifest(path):
+    """
+    Add every manifest entry not already in the store. Safe to call again on a
+    mounted filesystem to pick up new entries. Returns the number added.
+    """
+    entries = parse_manifest(path)
+    added = 0
+    for item in entries:
+        name = item_name(item)
+        existing = mapped_source(name)
+        if existing is not None:
+            if existing != item_source(item):
+                logger.warning(
+                    "load_manifest: '%s' is already mapped to something else", name
+                )
+            continue
+        add_entry(item)
+        added += 1
+    logger.info(
+        "load_manifest: added %d of %d entries from %s", added, len(entries), path
+    )
+    return added
+
+
+def parse_json_listing(body, base_url):
+    """
+    Default remote manifest format: a JSON array of manifest entries, or of
+    bare names whose URLs are resolved against the listing's own URL.
+    """
+    entries = json.loads(body)
+    if isinstance(entries, list):
+        entries = [
+            {"name": item, "url": urljoin(base_url, item)}
+            if isinstance(item, str)
+            else item
+            for item in entries
+        ]
+    return entries
+
+
+# Remote manifest formats: name -> func(body bytes, listing URL) -> entries
+manifest_parsers = {"json": parse_json_listing}
+
+
+def register_manifest_parser(name, parser):
+    """
+    Make `parser(body, url)` available as remote manifest format `name`. It
+    returns a list of manifest entries (see parse_manifest).
+    """
+    manifest_parsers[name] = parser
+
+
+class RemoteManifest:
+    """
+    A manifest served over HTTP. Each sync adds the entries that are new,
+    replaces those whose URL changed and removes the ones it added earlier
+    that the listing no longer has; files mapped by other means are left alone.
+    """
+
+    def __init__(self, url, parser="json"):
+        self.url = url
+        self.parser = manifest_parsers[parser]
+        # name -> item_source of the entries this manifest put in the store
+        self.names = {}
+
+    def fetch(self):
+        response = send_request("GET", self.url)
+        with response:
+            raise_for_status(response)
+            try:
+                body = response.content
+            except requests.RequestException as e:
+                # Dropped mid-body; a FetchError keeps watch going
+                raise transport_error("GET", self.url, e) from e
+        return validate_entries(self.parser(body, self.url), self.url)
+
+    def sync(self):
+        """
+        Bring the store in line with the listing. Returns (added, removed).
+        """
+        entries = {item_name(item): item for item in self.fetch()}
+        added = removed = 0
+        for name, source in list(self.names.items()):
+            item = entries.get(name)
+            if item is not None and item_source(item) == source:
+                continue
+            self.forget(name)
+            removed += 1
+        for name, item in entries.items():
+            if name in self.names:
+                continue
+            existing = mapped_source(name)
+            if existing is not None:
+                if existing != item_source(item):
+                    logger.warning(
+                        "Remote manifest: '%s' is already mapped to something else",
+                        name,
+                    )
+                continue
+            try:
+                add_entry(item)
+            except ValueError as e:
+                logger.error("Remote manifest: skipping '%s': %s", name, e)
+                continue
+            self.names[name] = item_source(item)
+            added += 1
+        logger.info(
+            "Remote manifest %s: %d files, %d added, %d removed",
+            self.url,
+            len(self.names),
+            added,
+            removed,
+        )
+        return added, removed
+
+    def forget(self, name):
+        entry = get_entry(name)
+        inode = inode_map.get(name)
+        if entry is not None and inode is not None:
+            invalidate_chunks(inode, entry)
+        remove_file(name)
+        del self.names[name]
+
+    def watch(self, interval):
+        """
+        Sync every `interval` seconds until the filesystem shuts down.
+        """
+        while not shutdown_event.wait(interval):
+            try:
+                self.sync()
+            except (FetchError, ValueError) as e:
+                # Keep the last good listing until the endpoint recovers
+                logger.error("Remote manifest %s refresh failed: %s", self.url, e)
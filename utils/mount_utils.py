@@ -0,0 +1,224 @@
+import os
+import re
+import signal
+import threading
+
+import pyfuse3
+import trio
+
+from config.settings import mount_config
+from shared.requests import fuse_mounted
+
+from .logger import logger
+
+FUSE_CONF = "/etc/fuse.conf"
+FUSE_CONNECTIONS = "/sys/fs/fuse/connections"
+
+
+def check_mount_options():
+    """
+    Reject mount_config combinations the kernel or fusermount would refuse.
+    Raises ValueError explaining the problem.
+    """
+    for name in ("fsname", "subtype"):
+        value = getattr(mount_config, name)
+        if value is not None and ("," in value or not value):
+            raise ValueError(f"{name} must be non-empty and contain no commas")
+    if mount_config.block_size < 0:
+        raise ValueError("block_size must be positive, or 0 for the chunk size")
+    if mount_config.allow_other and os.geteuid() != 0:
+        try:
+            with open(FUSE_CONF) as f:
+                allowed = any(
+                    line.split("#")[0].strip() == "user_allow_other" for line in f
+                )
+        except OSError:
+            allowed = False
+        if not allowed:
+            raise ValueError(
+                f"allow_other needs user_allow_other in {FUSE_CONF} "
+                "unless mounting as root"
+            )
+    if mount_config.allow_other and not mount_config.default_permissions:
+        logger.warning(
+            "allow_other without default_permissions lets every local user read "
+            "every file, whatever mode is reported"
+        )
+
+
+async def serve(operations, mountpoint, options, on_shutdown=None):
+    """
+    Mount `operations` at `mountpoint` and serve until the FUSE loop ends or
+    SIGINT/SIGTERM arrives. On a signal `on_shutdown` runs first (e.g. to abort
+    in-flight downloads), then the filesystem is unmounted so the mount point
+    doesn't need a manual `fusermount -u`.
+    """
+    pyfuse3.init(operations, mountpoint, options)
+    fuse_mounted.set()
+    logger.info("FUSE filesystem mounted on '%s'", mountpoint)
+    tune_connection(mountpoint)
+    try:
+        async with trio.open_nursery() as nursery:
+            nursery.start_soon(terminate_on_signal, on_shutdown)
+            await pyfuse3.main(max_tasks=mount_config.workers)
+            nursery.cancel_scope.cancel()
+    finally:
+        logger.info("Unmounting filesystem")
+        fuse_mounted.clear()
+        pyfuse3.close(unmount=True)
+
+
+def fuse_connection(mountpoint):
+    """
+    Name of the mount's directory under FUSE_CONNECTIONS (its device number),
+    found in /proc/self/mountinfo so the mount itself isn't asked to stat.
+    None if it isn't listed.
+    """
+    target = os.path.realpath(mountpoint)
+    with open("/proc/self/mountinfo") as f:
+        for line in f:
+            fields = line.split()
+            # Spaces and other specials in paths are octal-escaped
+            path = re.sub(
+                r"\\([0-7]{3})", lambda m: chr(int(m.group(1), 8)), fields[4]
+            )
+            if path == target:
+                major, minor = (int(n) for n in fields[2].split(":"))
+                # The kernel's own dev_t layout, not os.makedev's
+                return str(major << 20 | minor)
+    return None
+
+
+def tune_connection(mountpoint):
+    """
+    Apply mount_config.max_background to the fresh mount. Failing to (not
+    root, no sysfs) only warns; the kernel's default still works.
+    """
+    if mount_config.max_background is None:
+        return
+    try:
+        connection = fuse_connection(mountpoint)
+        if connection is None:
+            raise OSError(f"{mountpoint} not found in /proc/self/mountinfo")
+        base = os.path.join(FUSE_CONNECTIONS, connection)
+        # Keep the congestion threshold at the kernel's usual 3/4 of it
+        for name, value in (
+            ("max_background", mount_config.max_background),
+            ("congestion_threshold", mount_config.max_background * 3 // 4),
+        ):
+            with open(os.path.join(base, name), "w") as f:
+                f.write(str(value))
+    except OSError as e:
+        logger.warning("Can't set max_background (needs root): %s", e)
+        return
+    logger.info("max_background set to %d", mount_config.max_background)
+
+
+class Server:
+    """
+    A filesystem served from a background thread, for programs that mount
+    in-process. pyfuse3 allows one mount per process at a time.
+    """
+
+    def __init__(self, operations, mountpoint, options, on_shutdown=None):
+        self.operations = operations
+        self.mountpoint = mountpoint
+        self.options = options
+        self.on_shutdown = on_shutdown
+        self._thread = None
+        self._token = None
+        self._error = None
+        self._mounted = threading.Event()
+
+    def start(self):
+        """
+        Mount and start serving. Returns self once mounted; raises whatever
+        mounting failed with. A Server mounts once; to mount again, make a
+        new one.
+        """
+        if self._thread is not None:
+            raise RuntimeError(f"{self.mountpoint} was already mounted by this Server")
+        self._thread = threading.Thread(target=trio.run, args=(self._run,))
+        self._thread.start()
+        self._mounted.wait()
+        if self._error is not None:
+            self._thread.join()
+            raise self._error
+        return self
+
+    async def _run(self):
+        self._token = trio.lowlevel.current_trio_token()
+        try:
+            pyfuse3.init(self.operations, self.mountpoint, self.options)
+        except Exception as e:
+            self._error = e
+            return
+        finally:
+            self._mounted.set()
+        fuse_mounted.set()
+        logger.info("FUSE filesystem mounted on '%s'", self.mountpoint)
+        tune_connection(self.mountpoint)
+        try:
+            await pyfuse3.main(max_tasks=mount_config.workers)
+        finally:
+            logger.info("Unmounting filesystem")
+            fuse_mounted.clear()
+            pyfuse3.close(unmount=True)
+
+    def wait(self, timeout=None):
+        """
+        Block until the filesystem is unmounted, or `timeout` seconds pass.
+        Returns whether it has been.
+        """
+        self._thread.join(timeout)
+        return not self._thread.is_alive()
+
+    def shutdown(self, timeout=None):
+        """
+        Drain the operations (if they support it), then unmount: requests
+        that would wait on the network are refused while running ones
+        finish, after which readahead is cancelled and the filesystem
+        unmounted. Raises TimeoutError, leaving the mount serving as before,
+        if requests are still running after `timeout` seconds.
+        """
+        if not self._thread.is_alive():
+            return
+        drain = getattr(self.operations, "drain", None)
+        if drain is not None and not drain(timeout):
+            raise TimeoutError(
+                f"requests on {self.mountpoint} still running after {timeout}s"
+            )
+        self.unmount()
+
+    def invalidate(self, name, refresh=False):
+        """
+        Make the next access to file `name` fetch it afresh, for remote files
+        changed out of band (if the operations support it). With `refresh` it
+        is fetched again right away.
+        """
+        invalidate = getattr(self.operations, "invalidate", None)
+        if invalidate is None:
+            raise NotImplementedError("operations can't invalidate files")
+        return invalidate(name, refresh)
+
+    def unmount(self):
+        """
+        Stop serving and unmount once running requests finish.
+        """
+        if not self._thread.is_alive():
+            return
+        if self.on_shutdown is not None:
+            self.on_shutdown()
+        trio.from_thread.run_sync(pyfuse3.terminate, trio_token=self._token)
+        self.wait()
+
+
+async def terminate_on_signal(on_shutdown=None):
+    with trio.open_signal_receiver(signal.SIGINT, signal.SIGTERM) as signals:
+        async for signum in signals:
+            logger.info("%s received, shutting down", signal.Signals(signum).name)
+            if on_shutdown is not None:
+                on_shutdown()
+            # Lets pyfuse3.main() return once running requests finish
+            pyfuse3.terminate()
+            return